@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// sameSiteModes are the SameSite values of the cookie configuration, browsers
+// treat cookies without the attribute as lax
+var sameSiteModes = map[string]http.SameSite{
+	"":       http.SameSiteLaxMode,
+	"lax":    http.SameSiteLaxMode,
+	"strict": http.SameSiteStrictMode,
+	"none":   http.SameSiteNoneMode,
+}
+
+// hostPrefix makes browsers accept a cookie only from the host itself over
+// HTTPS with Path=/ and no Domain, so that neither a subdomain nor a plain
+// HTTP response can plant or overwrite it
+const hostPrefix = "__Host-"
+
+// check reports configurations whose cookies browsers would reject
+func (c CookieConfiguration) check() error {
+	if _, ok := sameSiteModes[strings.ToLower(c.SameSite)]; !ok {
+		return fmt.Errorf("unknown SameSite %q", c.SameSite)
+	}
+	if strings.EqualFold(c.SameSite, "none") && !c.Secure {
+		return errors.New("SameSite none requires Secure")
+	}
+	if c.HostPrefix && (!c.Secure || c.Domain != "") {
+		return errors.New("HostPrefix requires Secure and no Domain")
+	}
+	return nil
+}
+
+// cookieName is the name a cookie is sent with, prefixed if configured
+func cookieName(name string) string {
+	if config.Cookie.HostPrefix {
+		return hostPrefix + name
+	}
+	return name
+}
+
+// newCookie makes a cookie with the configured attributes, all cookies of
+// the application are made by it so that they replace each other. A negative
+// maxAge deletes the cookie, zero keeps it until the browser is closed.
+func newCookie(name, value string, maxAge int) *http.Cookie {
+	c := config.Cookie
+	return &http.Cookie{
+		Name:     cookieName(name),
+		Value:    value,
+		Path:     "/",
+		Domain:   c.Domain,
+		MaxAge:   maxAge,
+		Secure:   c.Secure,
+		HttpOnly: true,
+		SameSite: sameSiteModes[strings.ToLower(c.SameSite)],
+	}
+}
+
+// newCallbackCookie makes a cookie which must come back with the redirect
+// from another site, a top-level GET browsers don't send strict cookies with
+func newCallbackCookie(name, value string, maxAge int) *http.Cookie {
+	c := newCookie(name, value, maxAge)
+	if c.SameSite == http.SameSiteStrictMode {
+		c.SameSite = http.SameSiteLaxMode
+	}
+	return c
+}
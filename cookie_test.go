@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCookieConfigurationCheck(t *testing.T) {
+	tests := []struct {
+		cookie CookieConfiguration
+		valid  bool
+	}{
+		{CookieConfiguration{}, true},
+		{CookieConfiguration{SameSite: "Strict"}, true},
+		{CookieConfiguration{SameSite: "none"}, false},
+		{CookieConfiguration{SameSite: "none", Secure: true}, true},
+		{CookieConfiguration{SameSite: "sometimes"}, false},
+		{CookieConfiguration{HostPrefix: true}, false},
+		{CookieConfiguration{HostPrefix: true, Secure: true, Domain: "example.com"}, false},
+		{CookieConfiguration{HostPrefix: true, Secure: true}, true},
+	}
+	for _, test := range tests {
+		if err := test.cookie.check(); (err == nil) != test.valid {
+			t.Errorf("%+v: error is %v", test.cookie, err)
+		}
+	}
+}
+
+func TestSessionCookieAttributes(t *testing.T) {
+	saved := config.Cookie
+	defer func() { config.Cookie = saved }()
+	config.Cookie = CookieConfiguration{Secure: true, SameSite: "strict", HostPrefix: true}
+	user := newTestUser(t, "peter@gmail.com", "user")
+
+	hardened := func(c *http.Cookie) bool {
+		return c.Name == "__Host-session" && c.Secure && c.HttpOnly && c.Path == "/" && c.Domain == "" && c.SameSite == http.SameSiteStrictMode
+	}
+	login := responseCookie(postLogin(testServer, user.Email, "john_pass"), "__Host-session")
+	if login == nil || !hardened(login) {
+		t.Fatalf("Login cookie is %v", login)
+	}
+
+	// the refresh keeps the attributes of the login
+	req := httptest.NewRequest("GET", "/profile", nil)
+	req.AddCookie(&http.Cookie{Name: login.Name, Value: login.Value})
+	w := httptest.NewRecorder()
+	if _, err := testServer.session(w, req); err != nil {
+		t.Fatal(err, "Cannot find session")
+	}
+	if refresh := responseCookie(w.Result(), "__Host-session"); refresh == nil || !hardened(refresh) || refresh.Value != login.Value {
+		t.Errorf("Refreshed cookie is %v", refresh)
+	}
+
+	req = httptest.NewRequest("POST", "/logout", nil)
+	req.AddCookie(&http.Cookie{Name: login.Name, Value: login.Value})
+	w = httptest.NewRecorder()
+	testServer.logout(w, req)
+	if logout := responseCookie(w.Result(), "__Host-session"); logout == nil || !hardened(logout) || logout.MaxAge >= 0 {
+		t.Errorf("Logout cookie is %v", logout)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/bakhtik/webapp_template/data"
+	"github.com/bakhtik/webapp_template/password"
+)
+
+const createAdminUsage = "usage: webapp_template createadmin <email> <name> (the password is read from stdin)"
+
+// runCreateAdmin implements the createadmin command, signup never grants the
+// admin role so the first admin of a new installation is created with it
+func runCreateAdmin(in io.Reader, w io.Writer, users data.UserStore, passwords *password.Hasher, args []string) (err error) {
+	if len(args) != 2 {
+		return errors.New(createAdminUsage)
+	}
+	fmt.Fprint(w, "Password: ")
+	pw, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return
+	}
+	pw = strings.TrimRight(pw, "\r\n")
+	if pw == "" {
+		return errors.New("empty password")
+	}
+	hash, err := passwords.Hash(pw)
+	if err != nil {
+		return
+	}
+	// the operator vouches for the address
+	user := data.User{Email: args[0], Name: args[1], Password: hash, Role: "admin", EmailVerifiedAt: time.Now()}
+	if err = users.CreateUser(context.Background(), &user); err != nil {
+		return
+	}
+	fmt.Fprintf(w, "\nadmin %s created\n", user.Email)
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+)
+
+const (
+	// csrfFieldName is the form field carrying the token
+	csrfFieldName = "csrf_token"
+	// csrfHeaderName is the header carrying the token for scripts
+	csrfHeaderName = "X-CSRF-Token"
+	// csrfCookieName identifies visitors without a session
+	csrfCookieName = "csrf_id"
+)
+
+type contextKey string
+
+const csrfTokenKey contextKey = "csrf_token"
+
+// csrf protects handlers against cross-site request forgery. Every visitor gets
+// a token bound to its session, or to an anonymous id cookie before login,
+// which must be sent back with each request using an unsafe method.
+func (s *server) csrf(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := s.csrfId(w, req)
+		token := s.csrfToken(id)
+
+		switch req.Method {
+		case "GET", "HEAD", "OPTIONS", "TRACE":
+		default:
+			sent := req.Header.Get(csrfHeaderName)
+			if sent == "" {
+				sent = req.PostFormValue(csrfFieldName)
+			}
+			if !hmac.Equal([]byte(sent), []byte(token)) {
+				logger.SetPrefix("WARNING ")
+				logger.Printf("CSRF token mismatch on %s %s from %s", req.Method, req.URL.Path, clientIP(req))
+				w.WriteHeader(http.StatusForbidden)
+				generateHTML(w, req, nil, "layout", "public.navbar", "forbidden")
+				return
+			}
+		}
+
+		ctx := context.WithValue(req.Context(), csrfTokenKey, token)
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// csrfId returns the value tokens are bound to: the session uuid if the
+// visitor has a session cookie, otherwise an anonymous id which is issued
+// when missing. The uuid stays the same when the cookie of a stateless
+// session is issued again.
+func (s *server) csrfId(w http.ResponseWriter, req *http.Request) string {
+	if cookie, err := req.Cookie(cookieName(sessionCookieName)); err == nil {
+		if sess, err := s.tokens.parse(cookie.Value); err == nil {
+			return sess.Uuid
+		}
+	}
+	if cookie, err := req.Cookie(cookieName(csrfCookieName)); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+	id := randomString(32)
+	http.SetCookie(w, newCookie(csrfCookieName, id, 0))
+	return id
+}
+
+// csrfToken derives the token for id so it can't be forged without the key
+func (s *server) csrfToken(id string) string {
+	mac := hmac.New(sha256.New, s.csrfKey)
+	mac.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// csrfToken returns the token of the request for the templates
+func csrfToken(req *http.Request) string {
+	if req == nil {
+		return ""
+	}
+	token, _ := req.Context().Value(csrfTokenKey).(string)
+	return token
+}
+
+// randomString returns n random bytes encoded for use in cookies and URLs
+func randomString(n int) string {
+	bs := make([]byte, n)
+	if _, err := rand.Read(bs); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(bs)
+}
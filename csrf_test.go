@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/bakhtik/webapp_template/data"
+)
+
+func TestCSRFTokenRendered(t *testing.T) {
+	req := httptest.NewRequest("GET", "/login", nil)
+	w := httptest.NewRecorder()
+	testServer.csrf(http.HandlerFunc(testServer.login)).ServeHTTP(w, req)
+
+	resp := w.Result()
+	var id string
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == csrfCookieName {
+			id = cookie.Value
+		}
+	}
+	if id == "" {
+		t.Fatal("No CSRF id cookie issued")
+	}
+	want := `name="csrf_token" value="` + testServer.csrfToken(id) + `"`
+	if !strings.Contains(w.Body.String(), want) {
+		t.Errorf("Body does not contain %q", want)
+	}
+}
+
+func TestCSRFValidation(t *testing.T) {
+	handler := testServer.csrf(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	session := &http.Cookie{Name: "session", Value: testServer.tokens.issue(data.Session{Uuid: "some-session"})}
+	token := testServer.csrfToken("some-session")
+
+	tests := []struct {
+		name   string
+		form   url.Values
+		header string
+		code   int
+	}{
+		{"missing token", url.Values{}, "", http.StatusForbidden},
+		{"wrong token", url.Values{csrfFieldName: {testServer.csrfToken("other-session")}}, "", http.StatusForbidden},
+		{"form token", url.Values{csrfFieldName: {token}}, "", http.StatusNoContent},
+		{"header token", url.Values{}, token, http.StatusNoContent},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", "/change_account", strings.NewReader(test.form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if test.header != "" {
+			req.Header.Set(csrfHeaderName, test.header)
+		}
+		req.AddCookie(session)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != test.code {
+			t.Errorf("%s: response code is %v, want %v", test.name, w.Code, test.code)
+		}
+	}
+}
@@ -1,18 +1,423 @@
 package data
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
-	"log"
+	"encoding/base64"
+	"encoding/hex"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/satori/go.uuid"
 )
 
-var Db *sql.DB
+// UserStore keeps user accounts and creates sessions for them
+type UserStore interface {
+	CreateUser(ctx context.Context, u *User) error
+	UpdateUser(ctx context.Context, u *User) error
+	DeleteUser(ctx context.Context, u *User) error
+	UserByEmail(ctx context.Context, email string) (User, error)
+	UserById(ctx context.Context, id int) (User, error)
+	Users(ctx context.Context) ([]User, error)
+	LoginFailed(ctx context.Context, u *User, threshold int, lockout time.Duration) error
+	UnlockUser(ctx context.Context, u *User) error
+	CreateSession(ctx context.Context, u *User, device Device) (Session, error)
+	UserSession(ctx context.Context, u *User) (Session, error)
+	UserSessions(ctx context.Context, u *User) ([]Session, error)
+}
+
+// SessionStore keeps sessions of logged in users
+type SessionStore interface {
+	// CheckSession reads the session by uuid, ErrSessionExpired if it expired at now
+	CheckSession(ctx context.Context, s *Session, expiry SessionExpiry, now time.Time) error
+	// TouchSession records activity on the session at now
+	TouchSession(ctx context.Context, s *Session, now time.Time) error
+	SessionUser(ctx context.Context, s *Session) (User, error)
+	// Sessions lists sessions with their users, of a single user unless userId is 0
+	Sessions(ctx context.Context, userId int) ([]UserSession, error)
+	DeleteSessionByUUID(ctx context.Context, s *Session) error
+	DeleteUserSession(ctx context.Context, u *User, id int) error
+	DeleteUserSessions(ctx context.Context, u *User, exceptUuid string) error
+	// RotateSession replaces the uuid of the session and clears RotationDue
+	RotateSession(ctx context.Context, s *Session) error
+	// RotateUserSessions sets RotationDue on all sessions of the user
+	RotateUserSessions(ctx context.Context, u *User) error
+	// CleanSessions removes the sessions which expired at now
+	CleanSessions(ctx context.Context, expiry SessionExpiry, now time.Time) (int64, error)
+}
+
+// Locker takes named locks shared by all instances using the same store,
+// so that a job runs on a single instance only
+type Locker interface {
+	// TryLock takes the lock if it is free, unlock releases it
+	TryLock(ctx context.Context, name string) (unlock func(), ok bool, err error)
+}
+
+// InviteStore keeps the invites for signing up
+type InviteStore interface {
+	CreateInvite(ctx context.Context, inv *Invite) error
+	Invites(ctx context.Context) ([]Invite, error)
+	// CreateInvitedUser creates the user with the role of the invite with
+	// token and marks the invite used, together so that the invite stays
+	// unused if the user can't be created. It fails with ErrInvalidInvite if
+	// the invite is used, expired or for another email.
+	CreateInvitedUser(ctx context.Context, u *User, token string) error
+	DeleteInvite(ctx context.Context, id int) error
+}
+
+// ResetStore keeps the password reset tokens
+type ResetStore interface {
+	// CreatePasswordReset returns a new token for the user, replacing its unused ones
+	CreatePasswordReset(ctx context.Context, u *User, expiresAt time.Time) (token string, err error)
+	// PasswordReset checks the token without using it
+	PasswordReset(ctx context.Context, token string) (PasswordReset, error)
+	UsePasswordReset(ctx context.Context, token string) (PasswordReset, error)
+}
+
+// TwoFactorStore keeps the TOTP secrets and recovery codes of users
+type TwoFactorStore interface {
+	// EnableTOTP sets the TOTP secret of the user and returns its new recovery
+	// codes. It only replaces the secret the user was read with, which is empty
+	// unless the caller checked a code of the current one, else it fails with
+	// ErrTwoFactorEnabled.
+	EnableTOTP(ctx context.Context, u *User, secret string) (recoveryCodes []string, err error)
+	// DisableTOTP removes the TOTP secret and the recovery codes of the user
+	DisableTOTP(ctx context.Context, u *User) error
+	// UseTOTPStep records the time step of an accepted code, it fails with
+	// ErrInvalidToken unless step is after the last recorded one
+	UseTOTPStep(ctx context.Context, u *User, step int64) error
+	// CreateRecoveryCodes returns new recovery codes for the user, replacing its old ones
+	CreateRecoveryCodes(ctx context.Context, u *User) (recoveryCodes []string, err error)
+	// UseRecoveryCode deletes the recovery code of the user, ErrInvalidToken if it has none such
+	UseRecoveryCode(ctx context.Context, u *User, code string) error
+	RecoveryCodesLeft(ctx context.Context, u *User) (int, error)
+}
+
+// RevocationStore keeps the uuids of revoked sessions whose cookies are still
+// valid by themselves, until the cookies expire
+type RevocationStore interface {
+	// RevokeSessions adds the uuids to the list until expiresAt, forever if it is zero
+	RevokeSessions(ctx context.Context, uuids []string, expiresAt time.Time) error
+	SessionRevoked(ctx context.Context, uuid string) (bool, error)
+	// CleanRevocations removes the uuids which expired at now
+	CleanRevocations(ctx context.Context, now time.Time) (int64, error)
+}
+
+// RememberStore keeps the long-lived tokens of remembered logins, which sign
+// their users in again once their sessions expired. A token is a selector
+// finding it and a validator of which only a hash is stored.
+type RememberStore interface {
+	// CreateRememberToken returns a new token for the user of the session until expiresAt
+	CreateRememberToken(ctx context.Context, s *Session, expiresAt time.Time) (token string, err error)
+	// RestoreSession creates a session for the user of the token and returns
+	// the token replacing it. The validator replaced last is accepted for a
+	// short while longer, as a browser may send it with concurrent requests,
+	// those sessions come without a new token. A known selector with another
+	// validator means that a copy of the token was used before, all tokens of
+	// the user are deleted and ErrTokenTheft is returned with the UserId of
+	// session set.
+	RestoreSession(ctx context.Context, token string, device Device) (session Session, next string, err error)
+	// DeleteSessionRememberToken deletes the token which last restored the session
+	DeleteSessionRememberToken(ctx context.Context, s *Session) error
+	// DeleteUserRememberTokens deletes all tokens of the user except the one of the session with exceptSessionId
+	DeleteUserRememberTokens(ctx context.Context, u *User, exceptSessionId int) error
+	// CleanRememberTokens removes the tokens which expired at now
+	CleanRememberTokens(ctx context.Context, now time.Time) (int64, error)
+}
+
+// IdentityStore links users to their accounts at external identity providers
+type IdentityStore interface {
+	// IdentityUser gets the user linked to the subject of the provider, sql.ErrNoRows if there is none
+	IdentityUser(ctx context.Context, provider, subject string) (User, error)
+	// LinkIdentity links the user to the subject of the provider
+	LinkIdentity(ctx context.Context, u *User, provider, subject string) error
+}
+
+// Store is a storage backend providing users, sessions, invites, password
+// resets, two-factor authentication, session revocations, remembered logins
+// and external identities
+type Store interface {
+	UserStore
+	SessionStore
+	InviteStore
+	ResetStore
+	TwoFactorStore
+	RevocationStore
+	RememberStore
+	IdentityStore
+}
+
+// PoolOptions configures the connection pool of a database
+type PoolOptions struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// Apply sets the pool options on db, zero values keep the database/sql defaults
+func (o PoolOptions) Apply(db *sql.DB) {
+	if o.MaxOpenConns != 0 {
+		db.SetMaxOpenConns(o.MaxOpenConns)
+	}
+	if o.MaxIdleConns != 0 {
+		db.SetMaxIdleConns(o.MaxIdleConns)
+	}
+	if o.ConnMaxLifetime != 0 {
+		db.SetConnMaxLifetime(o.ConnMaxLifetime)
+	}
+}
+
+// Connect pings db until it answers, trying at most attempts times and
+// doubling the wait between attempts starting from interval. Each ping is
+// limited by timeout unless it is zero.
+func Connect(db *sql.DB, timeout time.Duration, attempts int, interval time.Duration) (err error) {
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := withTimeout(context.Background(), timeout)
+		err = db.PingContext(ctx)
+		cancel()
+		if err == nil || attempt >= attempts {
+			return
+		}
+		time.Sleep(interval)
+		interval *= 2
+	}
+}
+
+// userColumns are selected by the database stores to scan a User
+const userColumns = "id, name, email, password, role, pending, email_verified_at, pending_email, failed_logins, locked_until, totp_secret, created_at"
+
+// scanUser scans the userColumns of a row, NULL times are left zero
+func scanUser(row scanner, u *User) (err error) {
+	var emailVerifiedAt, lockedUntil sql.NullTime
+	if err = row.Scan(&u.Id, &u.Name, &u.Email, &u.Password, &u.Role, &u.Pending, &emailVerifiedAt, &u.PendingEmail,
+		&u.FailedLogins, &lockedUntil, &u.TOTPSecret, &u.CreatedAt); err != nil {
+		return
+	}
+	u.EmailVerifiedAt, u.LockedUntil = emailVerifiedAt.Time, lockedUntil.Time
+	return
+}
+
+// nullTime stores the zero time as NULL
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+const inviteColumns = "id, token, email, role, expires_at, created_at"
+
+func scanInvite(row scanner, inv *Invite) error {
+	return row.Scan(&inv.Id, &inv.Token, &inv.Email, &inv.Role, &inv.ExpiresAt, &inv.CreatedAt)
+}
+
+// scanInvites scans all rows of inviteColumns
+func scanInvites(rows *sql.Rows) (invites []Invite, err error) {
+	defer rows.Close()
+	for rows.Next() {
+		inv := Invite{}
+		if err = scanInvite(rows, &inv); err != nil {
+			return
+		}
+		invites = append(invites, inv)
+	}
+	err = rows.Err()
+	return
+}
+
+const resetColumns = "id, user_id, expires_at, created_at"
+
+func scanReset(row scanner, r *PasswordReset) error {
+	return row.Scan(&r.Id, &r.UserId, &r.ExpiresAt, &r.CreatedAt)
+}
+
+// sessionColumns are selected by the database stores to scan a Session
+const sessionColumns = "id, uuid, user_id, user_agent, ip_address, device, last_activity, rotate, created_at"
+
+// scanner is implemented by *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
 
-func init() {
-	var err error
-	Db, err = sql.Open("postgres", "dbname=webapp_template sslmode=disable")
+// scanSession scans a row of sessionColumns into s
+func scanSession(row scanner, s *Session) error {
+	return row.Scan(&s.Id, &s.Uuid, &s.UserId, &s.UserAgent, &s.IPAddress, &s.Label, &s.LastActivity, &s.RotationDue, &s.CreatedAt)
+}
+
+// userSessionQuery selects sessions joined with their users, most recently active first
+const userSessionQuery = `SELECT s.id, s.uuid, s.user_id, s.user_agent, s.ip_address, s.device, s.last_activity, s.rotate, s.created_at,
+  u.id, u.name, u.email, u.role, u.created_at
+FROM sessions s JOIN users u ON u.id = s.user_id
+WHERE ($1 = 0 OR s.user_id = $1)
+ORDER BY s.last_activity DESC`
+
+// scanUserSessions scans all rows of userSessionQuery
+func scanUserSessions(rows *sql.Rows) (sessions []UserSession, err error) {
+	defer rows.Close()
+	for rows.Next() {
+		us := UserSession{}
+		s, u := &us.Session, &us.User
+		if err = rows.Scan(&s.Id, &s.Uuid, &s.UserId, &s.UserAgent, &s.IPAddress, &s.Label, &s.LastActivity, &s.RotationDue, &s.CreatedAt,
+			&u.Id, &u.Name, &u.Email, &u.Role, &u.CreatedAt); err != nil {
+			return
+		}
+		sessions = append(sessions, us)
+	}
+	err = rows.Err()
+	return
+}
+
+// scanSessions scans all rows of sessionColumns
+func scanSessions(rows *sql.Rows) (sessions []Session, err error) {
+	defer rows.Close()
+	for rows.Next() {
+		session := Session{}
+		if err = scanSession(rows, &session); err != nil {
+			return
+		}
+		sessions = append(sessions, session)
+	}
+	err = rows.Err()
+	return
+}
+
+// withTimeout limits ctx by timeout unless it is zero
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// createUUID generates a random UUID for a new session
+func createUUID() (string, error) {
+	uuidV4, err := uuid.NewV4()
 	if err != nil {
-		log.Fatal(err)
+		return "", err
+	}
+	return uuidV4.String(), nil
+}
+
+// newToken returns a random token and the hash which is stored in its place
+func newToken() (token, hash string, err error) {
+	bs := make([]byte, 32)
+	if _, err = rand.Read(bs); err != nil {
+		return
+	}
+	token = base64.RawURLEncoding.EncodeToString(bs)
+	return token, hashToken(token), nil
+}
+
+// hashToken hashes a token for storage, tokens are random so a plain hash is enough
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newRememberToken returns a token of selector and a new random validator,
+// with the hash of the validator which is stored in its place
+func newRememberToken(selector string) (token, hash string, err error) {
+	validator, hash, err := newToken()
+	if err != nil {
+		return
+	}
+	return selector + "." + validator, hash, nil
+}
+
+// rememberGrace is how long the validator replaced last still restores sessions
+const rememberGrace = 30 * time.Second
+
+// checkValidator reports whether hash is of the current validator of a
+// remember token, or replaced is of the validator it replaced at rotatedAt
+// which is still accepted at now
+func checkValidator(current, previous, hash string, rotatedAt, now time.Time) (valid, replaced bool) {
+	if subtle.ConstantTimeCompare([]byte(current), []byte(hash)) == 1 {
+		return true, false
+	}
+	replaced = previous != "" && subtle.ConstantTimeCompare([]byte(previous), []byte(hash)) == 1 && now.Sub(rotatedAt) < rememberGrace
+	return replaced, replaced
+}
+
+// newSelector returns a random selector for a new remember token
+func newSelector() (string, error) {
+	bs := make([]byte, 12)
+	if _, err := rand.Read(bs); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bs), nil
+}
+
+// splitRememberToken returns the selector and the hash of the validator of a token
+func splitRememberToken(token string) (selector, hash string, err error) {
+	dot := strings.IndexByte(token, '.')
+	if dot <= 0 || dot == len(token)-1 {
+		return "", "", ErrInvalidToken
+	}
+	return token[:dot], hashToken(token[dot+1:]), nil
+}
+
+// RecoveryCodeCount is the number of recovery codes a user gets at once
+const RecoveryCodeCount = 10
+
+// recoveryCodeAlphabet leaves out letters and digits which are easily confused
+const recoveryCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+// newRecoveryCodes returns RecoveryCodeCount random codes like "abcde-fghjk"
+// and the hashes which are stored in their place
+func newRecoveryCodes() (codes, hashes []string, err error) {
+	bs := make([]byte, 10)
+	for i := 0; i < RecoveryCodeCount; i++ {
+		if _, err = rand.Read(bs); err != nil {
+			return
+		}
+		code := make([]byte, len(bs))
+		for j, b := range bs {
+			// the modulo bias is negligible for codes which are used once
+			code[j] = recoveryCodeAlphabet[int(b)%len(recoveryCodeAlphabet)]
+		}
+		codes = append(codes, string(code[:5])+"-"+string(code[5:]))
+		hashes = append(hashes, hashRecoveryCode(string(code)))
+	}
+	return
+}
+
+// hashRecoveryCode hashes a recovery code as typed by the user, ignoring case,
+// spaces and dashes
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return hashToken(code)
+}
+
+// lockKey maps a lock name to a Postgres advisory lock key
+func lockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return int64(h.Sum64())
+}
+
+// localLocks are named locks shared within the process only
+type localLocks struct {
+	mu    sync.Mutex
+	names map[string]bool
+}
+
+// TryLock takes the lock if no one else in the process holds it
+func (l *localLocks) TryLock(ctx context.Context, name string) (unlock func(), ok bool, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.names[name] {
+		return
+	}
+	if l.names == nil {
+		l.names = make(map[string]bool)
+	}
+	l.names[name] = true
+	unlock = func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.names, name)
 	}
+	return unlock, true, nil
 }
@@ -1,22 +1,74 @@
 package data
 
-// test data
-var users = []User{
-	{
-		Name:     "Peter Jones",
-		Email:    "peter@gmail.com",
-		Password: "peter_pass",
-		Role:     "user",
-	},
-	{
-		Name:     "John Smith",
-		Email:    "john@gmail.com",
-		Password: "john_pass",
-		Role:     "admin",
-	},
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestUsers returns the test data, tests change the users they are given
+func newTestUsers() []User {
+	return []User{
+		{
+			Name:     "Peter Jones",
+			Email:    "peter@gmail.com",
+			Password: "peter_pass",
+			Role:     "user",
+		},
+		{
+			Name:     "John Smith",
+			Email:    "john@gmail.com",
+			Password: "john_pass",
+			Role:     "admin",
+		},
+	}
+}
+
+var ctx = context.Background()
+
+// store and users are set up anew for each run of a test by eachStore
+var store Store
+var users []User
+
+// testStores open an empty store of each kind the store tests run against,
+// Postgres only if TEST_POSTGRES_DSN names a database the tests may wipe
+var testStores = []struct {
+	name string
+	open func(t *testing.T) Store
+}{
+	{"memory", func(t *testing.T) Store { return NewMemory() }},
+	{"sqlite", func(t *testing.T) Store { return newTestSQLite(t) }},
+	{"postgres", func(t *testing.T) Store { return newTestPostgres(t) }},
+}
+
+// eachStore runs test against every kind of store so that they can't drift apart
+func eachStore(t *testing.T, test func(t *testing.T)) {
+	for _, s := range testStores {
+		s := s
+		t.Run(s.name, func(t *testing.T) {
+			store, users = s.open(t), newTestUsers()
+			test(t)
+		})
+	}
 }
 
-func setup() {
-	SessionDeleteAll()
-	UserDeleteAll()
+func Test_Connect(t *testing.T) {
+	sq, err := NewSQLite(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err, "Cannot open database")
+	}
+	defer sq.Db.Close()
+	if err = Connect(sq.Db, time.Second, 1, 0); err != nil {
+		t.Error(err, "Cannot connect to database")
+	}
+
+	unreachable, err := NewSQLite(filepath.Join(t.TempDir(), "missing", "test.db"))
+	if err != nil {
+		t.Fatal(err, "Cannot open database")
+	}
+	defer unreachable.Db.Close()
+	if err = Connect(unreachable.Db, time.Second, 2, time.Millisecond); err == nil {
+		t.Error("Connected to unreachable database")
+	}
 }
@@ -0,0 +1,899 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrDuplicateEmail is returned when a user with the same email already exists
+var ErrDuplicateEmail = errors.New("data: user with this email already exists")
+
+// ErrDuplicateIdentity is returned when an external identity is linked to a user already
+var ErrDuplicateIdentity = errors.New("data: external identity is linked already")
+
+// Memory stores users and sessions in memory, it is safe for concurrent use.
+// It mirrors the behaviour of the database backends and is used for tests
+// and local development.
+type Memory struct {
+	localLocks
+	mu            sync.RWMutex
+	users         map[int]User
+	sessions      map[string]Session
+	invites       map[string]memoryInvite
+	resets        map[string]memoryReset
+	lastUserId    int
+	lastSessionId int
+	lastInviteId  int
+	lastResetId   int
+	// totpSteps are the last used TOTP time steps by user id
+	totpSteps map[int]int64
+	// recoveryCodes are sets of recovery code hashes by user id
+	recoveryCodes map[int]map[string]bool
+	// revoked are the expiry times of revoked session uuids, zero for never
+	revoked map[string]time.Time
+	// remembered are the remember tokens by selector
+	remembered map[string]memoryRemember
+	// identities are the ids of the users linked to external identities
+	identities map[memoryIdentity]int
+}
+
+// memoryIdentity is the subject of an external identity provider
+type memoryIdentity struct {
+	provider, subject string
+}
+
+// memoryRemember is a remember token with the hash of its validator
+type memoryRemember struct {
+	hash      string
+	previous  string
+	userId    int
+	sessionId int
+	rotatedAt time.Time
+	expiresAt time.Time
+}
+
+// memoryReset is a password reset with the time it was used
+type memoryReset struct {
+	PasswordReset
+	usedAt time.Time
+}
+
+// memoryInvite is an invite with the time it was used
+type memoryInvite struct {
+	Invite
+	usedAt time.Time
+}
+
+// NewMemory creates an empty in-memory store
+func NewMemory() *Memory {
+	return &Memory{
+		users:         make(map[int]User),
+		sessions:      make(map[string]Session),
+		invites:       make(map[string]memoryInvite),
+		resets:        make(map[string]memoryReset),
+		totpSteps:     make(map[int]int64),
+		recoveryCodes: make(map[int]map[string]bool),
+		revoked:       make(map[string]time.Time),
+		remembered:    make(map[string]memoryRemember),
+		identities:    make(map[memoryIdentity]int),
+	}
+}
+
+// CreateSession creates a new session for existing user
+func (m *Memory) CreateSession(ctx context.Context, u *User, device Device) (session Session, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	uuid, err := createUUID()
+	if err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastSessionId++
+	now := time.Now()
+	session = Session{
+		Id:           m.lastSessionId,
+		Uuid:         uuid,
+		UserId:       u.Id,
+		Device:       device,
+		LastActivity: now,
+		CreatedAt:    now,
+	}
+	m.sessions[session.Uuid] = session
+	return
+}
+
+// CheckSession checks if session exists and is not expired at now
+func (m *Memory) CheckSession(ctx context.Context, s *Session, expiry SessionExpiry, now time.Time) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	session, ok := m.sessions[s.Uuid]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	*s = session
+	if s.Expired(expiry, now) {
+		return ErrSessionExpired
+	}
+	return
+}
+
+// TouchSession records activity on the session at now
+func (m *Memory) TouchSession(ctx context.Context, s *Session, now time.Time) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	session, ok := m.sessions[s.Uuid]
+	if !ok {
+		return
+	}
+	session.LastActivity = now
+	m.sessions[s.Uuid] = session
+	s.LastActivity = session.LastActivity
+	return
+}
+
+// SessionUser gets the user from the session
+func (m *Memory) SessionUser(ctx context.Context, s *Session) (user User, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	user, ok := m.users[s.UserId]
+	if !ok {
+		return User{}, sql.ErrNoRows
+	}
+	// password is not selected by the database backends either
+	user.Password = ""
+	return
+}
+
+// Sessions lists sessions with their users, of a single user unless userId is 0
+func (m *Memory) Sessions(ctx context.Context, userId int) (sessions []UserSession, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, s := range m.sessions {
+		user, ok := m.users[s.UserId]
+		if !ok || (userId != 0 && s.UserId != userId) {
+			continue
+		}
+		user.Password = ""
+		sessions = append(sessions, UserSession{Session: s, User: user})
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastActivity.After(sessions[j].LastActivity) })
+	return
+}
+
+// DeleteSessionByUUID deletes session
+func (m *Memory) DeleteSessionByUUID(ctx context.Context, s *Session) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, s.Uuid)
+	return
+}
+
+// DeleteUserSession deletes a session of the user by id
+func (m *Memory) DeleteUserSession(ctx context.Context, u *User, id int) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for uuid, session := range m.sessions {
+		if session.Id == id && session.UserId == u.Id {
+			delete(m.sessions, uuid)
+		}
+	}
+	return
+}
+
+// DeleteUserSessions deletes all sessions of the user except the one with exceptUuid
+func (m *Memory) DeleteUserSessions(ctx context.Context, u *User, exceptUuid string) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for uuid, session := range m.sessions {
+		if session.UserId == u.Id && uuid != exceptUuid {
+			delete(m.sessions, uuid)
+		}
+	}
+	return
+}
+
+// RotateSession replaces the uuid of the session and clears RotationDue
+func (m *Memory) RotateSession(ctx context.Context, s *Session) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	uuid, err := createUUID()
+	if err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	session, ok := m.sessions[s.Uuid]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	delete(m.sessions, s.Uuid)
+	session.Uuid, session.RotationDue = uuid, false
+	m.sessions[uuid] = session
+	s.Uuid, s.RotationDue = uuid, false
+	return
+}
+
+// RotateUserSessions sets RotationDue on all sessions of the user
+func (m *Memory) RotateUserSessions(ctx context.Context, u *User) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for uuid, session := range m.sessions {
+		if session.UserId == u.Id {
+			session.RotationDue = true
+			m.sessions[uuid] = session
+		}
+	}
+	return
+}
+
+// CleanSessions removes the sessions which expired at now
+func (m *Memory) CleanSessions(ctx context.Context, expiry SessionExpiry, now time.Time) (cleaned int64, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for uuid, session := range m.sessions {
+		if session.Expired(expiry, now) {
+			delete(m.sessions, uuid)
+			cleaned++
+		}
+	}
+	return
+}
+
+// RevokeSessions adds the uuids to the list until expiresAt, forever if it is zero
+func (m *Memory) RevokeSessions(ctx context.Context, uuids []string, expiresAt time.Time) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, uuid := range uuids {
+		if _, ok := m.revoked[uuid]; !ok {
+			m.revoked[uuid] = expiresAt
+		}
+	}
+	return
+}
+
+// SessionRevoked reports whether the session uuid is in the list
+func (m *Memory) SessionRevoked(ctx context.Context, uuid string) (revoked bool, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, revoked = m.revoked[uuid]
+	return
+}
+
+// CleanRevocations removes the uuids which expired at now
+func (m *Memory) CleanRevocations(ctx context.Context, now time.Time) (cleaned int64, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for uuid, expiresAt := range m.revoked {
+		if !expiresAt.IsZero() && !now.Before(expiresAt) {
+			delete(m.revoked, uuid)
+			cleaned++
+		}
+	}
+	return
+}
+
+// CreateRememberToken returns a new token for the user of the session until expiresAt
+func (m *Memory) CreateRememberToken(ctx context.Context, s *Session, expiresAt time.Time) (token string, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	selector, err := newSelector()
+	if err != nil {
+		return
+	}
+	token, hash, err := newRememberToken(selector)
+	if err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[s.UserId]; !ok {
+		return "", sql.ErrNoRows
+	}
+	m.remembered[selector] = memoryRemember{hash: hash, userId: s.UserId, sessionId: s.Id, rotatedAt: time.Now(), expiresAt: expiresAt}
+	return
+}
+
+// RestoreSession creates a session for the user of the token and replaces its
+// validator, a known selector with an unknown validator deletes all tokens of the user
+func (m *Memory) RestoreSession(ctx context.Context, token string, device Device) (session Session, next string, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	selector, hash, err := splitRememberToken(token)
+	if err != nil {
+		return
+	}
+	fresh, freshHash, err := newRememberToken(selector)
+	if err != nil {
+		return
+	}
+	uuid, err := createUUID()
+	if err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	r, ok := m.remembered[selector]
+	if !ok || !now.Before(r.expiresAt) {
+		return session, "", ErrInvalidToken
+	}
+	valid, replaced := checkValidator(r.hash, r.previous, hash, r.rotatedAt, now)
+	if !valid {
+		m.forgetUser(r.userId, 0)
+		return Session{UserId: r.userId}, "", ErrTokenTheft
+	}
+	m.lastSessionId++
+	session = Session{
+		Id:           m.lastSessionId,
+		Uuid:         uuid,
+		UserId:       r.userId,
+		Device:       device,
+		LastActivity: now,
+		CreatedAt:    now,
+	}
+	m.sessions[session.Uuid] = session
+	if replaced {
+		return
+	}
+	r.previous, r.hash, r.rotatedAt, r.sessionId = r.hash, freshHash, now, session.Id
+	m.remembered[selector] = r
+	return session, fresh, nil
+}
+
+// DeleteSessionRememberToken deletes the token which last restored the session
+func (m *Memory) DeleteSessionRememberToken(ctx context.Context, s *Session) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for selector, r := range m.remembered {
+		if r.userId == s.UserId && r.sessionId == s.Id {
+			delete(m.remembered, selector)
+		}
+	}
+	return
+}
+
+// DeleteUserRememberTokens deletes all tokens of the user except the one of the session with exceptSessionId
+func (m *Memory) DeleteUserRememberTokens(ctx context.Context, u *User, exceptSessionId int) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.forgetUser(u.Id, exceptSessionId)
+	return
+}
+
+// forgetUser deletes the remember tokens of the user except the one of the
+// session with exceptSessionId, m.mu must be held
+func (m *Memory) forgetUser(userId, exceptSessionId int) {
+	for selector, r := range m.remembered {
+		if r.userId == userId && r.sessionId != exceptSessionId {
+			delete(m.remembered, selector)
+		}
+	}
+}
+
+// CleanRememberTokens removes the tokens which expired at now
+func (m *Memory) CleanRememberTokens(ctx context.Context, now time.Time) (cleaned int64, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for selector, r := range m.remembered {
+		if !now.Before(r.expiresAt) {
+			delete(m.remembered, selector)
+			cleaned++
+		}
+	}
+	return
+}
+
+// CreateUser creates a new user, the password must be hashed already
+func (m *Memory) CreateUser(ctx context.Context, u *User) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.emailTaken(u.Email, 0) {
+		return ErrDuplicateEmail
+	}
+	m.lastUserId++
+	u.Id = m.lastUserId
+	u.CreatedAt = time.Now()
+	m.users[u.Id] = *u
+	return
+}
+
+// DeleteUser deletes user and all of its sessions
+func (m *Memory) DeleteUser(ctx context.Context, u *User) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.users, u.Id)
+	for uuid, session := range m.sessions {
+		if session.UserId == u.Id {
+			delete(m.sessions, uuid)
+		}
+	}
+	for hash, reset := range m.resets {
+		if reset.UserId == u.Id {
+			delete(m.resets, hash)
+		}
+	}
+	delete(m.totpSteps, u.Id)
+	delete(m.recoveryCodes, u.Id)
+	m.forgetUser(u.Id, 0)
+	for identity, userId := range m.identities {
+		if userId == u.Id {
+			delete(m.identities, identity)
+		}
+	}
+	return
+}
+
+// UpdateUser updates user information
+func (m *Memory) UpdateUser(ctx context.Context, u *User) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[u.Id]
+	if !ok {
+		return
+	}
+	if m.emailTaken(u.Email, u.Id) {
+		return ErrDuplicateEmail
+	}
+	user.Name, user.Email, user.Password, user.Role, user.Pending = u.Name, u.Email, u.Password, u.Role, u.Pending
+	user.EmailVerifiedAt, user.PendingEmail = u.EmailVerifiedAt, u.PendingEmail
+	m.users[u.Id] = user
+	return
+}
+
+// LoginFailed counts a failed login of the user, on reaching threshold failures
+// the account is locked for the lockout duration and the count starts over
+func (m *Memory) LoginFailed(ctx context.Context, u *User, threshold int, lockout time.Duration) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[u.Id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	user.FailedLogins++
+	if threshold > 0 && user.FailedLogins >= threshold {
+		user.FailedLogins, user.LockedUntil = 0, time.Now().Add(lockout)
+	}
+	m.users[u.Id] = user
+	u.FailedLogins, u.LockedUntil = user.FailedLogins, user.LockedUntil
+	return
+}
+
+// UnlockUser lifts the lockout of the user and resets its failed logins
+func (m *Memory) UnlockUser(ctx context.Context, u *User) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if user, ok := m.users[u.Id]; ok {
+		user.FailedLogins, user.LockedUntil = 0, time.Time{}
+		m.users[u.Id] = user
+	}
+	u.FailedLogins, u.LockedUntil = 0, time.Time{}
+	return
+}
+
+// UserSession gets the session for an existing user
+func (m *Memory) UserSession(ctx context.Context, u *User) (session Session, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	err = sql.ErrNoRows
+	for _, s := range m.sessions {
+		if s.UserId == u.Id && (err != nil || s.Id < session.Id) {
+			session, err = s, nil
+		}
+	}
+	return
+}
+
+// UserSessions gets all sessions of the user, most recently active first
+func (m *Memory) UserSessions(ctx context.Context, u *User) (sessions []Session, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, s := range m.sessions {
+		if s.UserId == u.Id {
+			sessions = append(sessions, s)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastActivity.After(sessions[j].LastActivity) })
+	return
+}
+
+// UserByEmail gets a single user by email
+func (m *Memory) UserByEmail(ctx context.Context, email string) (user User, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, u := range m.users {
+		if u.Email == email {
+			return u, nil
+		}
+	}
+	return User{}, sql.ErrNoRows
+}
+
+// UserById gets a single user by id
+func (m *Memory) UserById(ctx context.Context, id int) (user User, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	user, ok := m.users[id]
+	if !ok {
+		return User{}, sql.ErrNoRows
+	}
+	return
+}
+
+// IdentityUser gets the user linked to the subject of the provider
+func (m *Memory) IdentityUser(ctx context.Context, provider, subject string) (user User, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	user, ok := m.users[m.identities[memoryIdentity{provider, subject}]]
+	if !ok {
+		return User{}, sql.ErrNoRows
+	}
+	return
+}
+
+// LinkIdentity links the user to the subject of the provider
+func (m *Memory) LinkIdentity(ctx context.Context, u *User, provider, subject string) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[u.Id]; !ok {
+		return sql.ErrNoRows
+	}
+	identity := memoryIdentity{provider, subject}
+	if _, ok := m.identities[identity]; ok {
+		return ErrDuplicateIdentity
+	}
+	m.identities[identity] = u.Id
+	return
+}
+
+// Users gets all users ordered by creation
+func (m *Memory) Users(ctx context.Context) (users []User, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, u := range m.users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Id < users[j].Id })
+	return
+}
+
+// emailTaken reports if email belongs to a user other than the one with id,
+// the caller must hold the lock
+func (m *Memory) emailTaken(email string, id int) bool {
+	for _, u := range m.users {
+		if u.Email == email && u.Id != id {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateInvite creates an invite with a new token
+func (m *Memory) CreateInvite(ctx context.Context, inv *Invite) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if inv.Token, err = createUUID(); err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastInviteId++
+	inv.Id, inv.CreatedAt = m.lastInviteId, time.Now()
+	m.invites[inv.Token] = memoryInvite{Invite: *inv}
+	return
+}
+
+// Invites gets the invites which were not used yet, oldest first
+func (m *Memory) Invites(ctx context.Context) (invites []Invite, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, inv := range m.invites {
+		if inv.usedAt.IsZero() {
+			invites = append(invites, inv.Invite)
+		}
+	}
+	sort.Slice(invites, func(i, j int) bool { return invites[i].Id < invites[j].Id })
+	return
+}
+
+// CreateInvitedUser creates the user with the role of the invite with token and marks the invite used
+func (m *Memory) CreateInvitedUser(ctx context.Context, u *User, token string) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	inv, ok := m.invites[token]
+	now := time.Now()
+	if !ok || !inv.usedAt.IsZero() || !now.Before(inv.ExpiresAt) || (inv.Email != "" && !strings.EqualFold(inv.Email, u.Email)) {
+		return ErrInvalidInvite
+	}
+	if m.emailTaken(u.Email, 0) {
+		return ErrDuplicateEmail
+	}
+	inv.usedAt = now
+	m.invites[token] = inv
+	m.lastUserId++
+	u.Id, u.Role, u.CreatedAt = m.lastUserId, inv.Role, now
+	m.users[u.Id] = *u
+	return
+}
+
+// DeleteInvite deletes the invite by id
+func (m *Memory) DeleteInvite(ctx context.Context, id int) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for token, inv := range m.invites {
+		if inv.Id == id {
+			delete(m.invites, token)
+		}
+	}
+	return
+}
+
+// CreatePasswordReset returns a new password reset token for the user, its unused tokens are deleted
+func (m *Memory) CreatePasswordReset(ctx context.Context, u *User, expiresAt time.Time) (token string, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	token, hash, err := newToken()
+	if err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[u.Id]; !ok {
+		return "", sql.ErrNoRows
+	}
+	for h, r := range m.resets {
+		if r.UserId == u.Id && r.usedAt.IsZero() {
+			delete(m.resets, h)
+		}
+	}
+	m.lastResetId++
+	m.resets[hash] = memoryReset{PasswordReset: PasswordReset{
+		Id:        m.lastResetId,
+		UserId:    u.Id,
+		ExpiresAt: expiresAt,
+		CreatedAt: time.Now(),
+	}}
+	return
+}
+
+// PasswordReset gets the password reset of token if it can still be used
+func (m *Memory) PasswordReset(ctx context.Context, token string) (reset PasswordReset, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	r, ok := m.resets[hashToken(token)]
+	if !ok || !r.usedAt.IsZero() || !time.Now().Before(r.ExpiresAt) {
+		return PasswordReset{}, ErrInvalidToken
+	}
+	return r.PasswordReset, nil
+}
+
+// UsePasswordReset marks the password reset of token as used if it can still be used
+func (m *Memory) UsePasswordReset(ctx context.Context, token string) (reset PasswordReset, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hash, now := hashToken(token), time.Now()
+	r, ok := m.resets[hash]
+	if !ok || !r.usedAt.IsZero() || !now.Before(r.ExpiresAt) {
+		return PasswordReset{}, ErrInvalidToken
+	}
+	r.usedAt = now
+	m.resets[hash] = r
+	return r.PasswordReset, nil
+}
+
+// EnableTOTP sets the TOTP secret of the user and returns its new recovery
+// codes, ErrTwoFactorEnabled if the user has another secret than u
+func (m *Memory) EnableTOTP(ctx context.Context, u *User, secret string) (recoveryCodes []string, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[u.Id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	if user.TOTPSecret != u.TOTPSecret {
+		return nil, ErrTwoFactorEnabled
+	}
+	user.TOTPSecret = secret
+	m.users[u.Id] = user
+	m.totpSteps[u.Id] = 0
+	m.setRecoveryCodes(u.Id, hashes)
+	u.TOTPSecret = secret
+	return codes, nil
+}
+
+// DisableTOTP removes the TOTP secret and the recovery codes of the user
+func (m *Memory) DisableTOTP(ctx context.Context, u *User) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if user, ok := m.users[u.Id]; ok {
+		user.TOTPSecret = ""
+		m.users[u.Id] = user
+	}
+	delete(m.totpSteps, u.Id)
+	delete(m.recoveryCodes, u.Id)
+	u.TOTPSecret = ""
+	return
+}
+
+// UseTOTPStep records the time step of an accepted code, so that a code can't be used twice
+func (m *Memory) UseTOTPStep(ctx context.Context, u *User, step int64) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[u.Id]; !ok || step <= m.totpSteps[u.Id] {
+		return ErrInvalidToken
+	}
+	m.totpSteps[u.Id] = step
+	return
+}
+
+// CreateRecoveryCodes returns new recovery codes for the user, replacing its old ones
+func (m *Memory) CreateRecoveryCodes(ctx context.Context, u *User) (recoveryCodes []string, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[u.Id]; !ok {
+		return nil, sql.ErrNoRows
+	}
+	m.setRecoveryCodes(u.Id, hashes)
+	return codes, nil
+}
+
+// setRecoveryCodes replaces the recovery codes of the user, the caller must hold the lock
+func (m *Memory) setRecoveryCodes(userId int, hashes []string) {
+	codes := make(map[string]bool, len(hashes))
+	for _, hash := range hashes {
+		codes[hash] = true
+	}
+	m.recoveryCodes[userId] = codes
+}
+
+// UseRecoveryCode deletes the recovery code of the user
+func (m *Memory) UseRecoveryCode(ctx context.Context, u *User, code string) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hash := hashRecoveryCode(code)
+	if !m.recoveryCodes[u.Id][hash] {
+		return ErrInvalidToken
+	}
+	delete(m.recoveryCodes[u.Id], hash)
+	return
+}
+
+// RecoveryCodesLeft counts the unused recovery codes of the user
+func (m *Memory) RecoveryCodesLeft(ctx context.Context, u *User) (left int, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.recoveryCodes[u.Id]), nil
+}
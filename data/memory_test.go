@@ -0,0 +1,58 @@
+package data
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_MemoryConcurrentAccess(t *testing.T) {
+	m := NewMemory()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			u := User{Name: "User", Email: fmt.Sprintf("user%d@gmail.com", i), Password: "pass", Role: "user"}
+			if err := m.CreateUser(ctx, &u); err != nil {
+				t.Error(err, "Cannot create user.")
+				return
+			}
+			session, err := m.CreateSession(ctx, &u, Device{})
+			if err != nil {
+				t.Error(err, "Cannot create session")
+				return
+			}
+			if err = m.CheckSession(ctx, &session, SessionExpiry{}, time.Now()); err != nil {
+				t.Error(err, "Cannot check session")
+			}
+		}(i)
+	}
+	wg.Wait()
+	u, err := m.Users(ctx)
+	if err != nil {
+		t.Error(err, "Cannot retrieve users.")
+	}
+	if len(u) != 10 {
+		t.Errorf("Wrong number of users retrieved: %d", len(u))
+	}
+}
+
+func Test_LocalLocks(t *testing.T) {
+	m := NewMemory()
+	unlock, ok, err := m.TryLock(ctx, "job")
+	if err != nil || !ok {
+		t.Fatal(err, "Cannot take free lock")
+	}
+	if _, ok, _ = m.TryLock(ctx, "job"); ok {
+		t.Error("Lock taken twice")
+	}
+	if _, ok, _ = m.TryLock(ctx, "other job"); !ok {
+		t.Error("Cannot take lock with another name")
+	}
+	unlock()
+	if _, ok, _ = m.TryLock(ctx, "job"); !ok {
+		t.Error("Cannot take released lock")
+	}
+}
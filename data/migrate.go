@@ -0,0 +1,298 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+// migrationName matches files like 0001_init.up.sql
+var migrationName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is a numbered schema change with statements to apply and revert it
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus tells if a migration has been applied to the database
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// dialect holds the SQL that differs between database backends
+type dialect struct {
+	// statements guarding against concurrent migrations, empty if
+	// transactions already take an exclusive lock
+	lock, unlock  string
+	insertVersion string
+	deleteVersion string
+	selectVersion string
+	// statements switching the foreign keys off around the transaction of a
+	// migration and a query counting the rows violating them before it
+	// commits, empty if tables are changed in place
+	foreignKeysOff, foreignKeysOn string
+	countViolations               string
+}
+
+// migrationLockId is an arbitrary key for the Postgres advisory lock
+const migrationLockId = 4143057283
+
+var dialects = map[string]dialect{
+	"postgres": {
+		lock:          fmt.Sprintf("SELECT pg_advisory_lock(%d)", migrationLockId),
+		unlock:        fmt.Sprintf("SELECT pg_advisory_unlock(%d)", migrationLockId),
+		insertVersion: "INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)",
+		deleteVersion: "DELETE FROM schema_migrations WHERE version = $1",
+		selectVersion: "SELECT count(*) FROM schema_migrations WHERE version = $1",
+	},
+	// SQLite transactions are opened with BEGIN IMMEDIATE which locks the database for writing.
+	// Columns are dropped by rebuilding their table, as SQLite before 3.35 can't drop them,
+	// and dropping the old table would delete the rows referencing it if foreign keys were on.
+	"sqlite": {
+		insertVersion:   "INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+		deleteVersion:   "DELETE FROM schema_migrations WHERE version = ?",
+		selectVersion:   "SELECT count(*) FROM schema_migrations WHERE version = ?",
+		foreignKeysOff:  "PRAGMA foreign_keys = off",
+		foreignKeysOn:   "PRAGMA foreign_keys = on",
+		countViolations: "SELECT count(*) FROM pragma_foreign_key_check",
+	},
+}
+
+// Migrator applies and reverts the migrations embedded for a database dialect
+type Migrator struct {
+	db         *sql.DB
+	dialect    dialect
+	migrations []Migration
+}
+
+// NewMigrator loads the migrations embedded for the dialect
+func NewMigrator(db *sql.DB, dialectName string) (*Migrator, error) {
+	d, ok := dialects[dialectName]
+	if !ok {
+		return nil, fmt.Errorf("data: no migrations for dialect %q", dialectName)
+	}
+	migrations, err := loadMigrations(dialectName)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, dialect: d, migrations: migrations}, nil
+}
+
+// loadMigrations reads migrations of the dialect ordered by version
+func loadMigrations(dialectName string) (migrations []Migration, err error) {
+	dir := path.Join("migrations", dialectName)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return
+	}
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		match := migrationName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("data: unexpected migration file %s", entry.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("data: migration %d has different names %s and %s", version, m.Name, match[2])
+		}
+		bs, err := fs.ReadFile(migrationFiles, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if match[3] == "up" {
+			m.Up = string(bs)
+		} else {
+			m.Down = string(bs)
+		}
+	}
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("data: migration %04d_%s must have both up and down files", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return
+}
+
+// Up applies all pending migrations and returns the applied ones
+func (m *Migrator) Up(ctx context.Context) (applied []Migration, err error) {
+	err = m.locked(ctx, func(conn *sql.Conn) error {
+		for _, migration := range m.migrations {
+			ok, err := m.apply(ctx, conn, migration, true)
+			if err != nil {
+				return fmt.Errorf("migration %04d_%s: %s", migration.Version, migration.Name, err)
+			}
+			if ok {
+				applied = append(applied, migration)
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// Down reverts the given number of most recently applied migrations
+func (m *Migrator) Down(ctx context.Context, steps int) (reverted []Migration, err error) {
+	err = m.locked(ctx, func(conn *sql.Conn) error {
+		for i := len(m.migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+			migration := m.migrations[i]
+			ok, err := m.apply(ctx, conn, migration, false)
+			if err != nil {
+				return fmt.Errorf("migration %04d_%s: %s", migration.Version, migration.Name, err)
+			}
+			if ok {
+				reverted = append(reverted, migration)
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// Status lists all known migrations and whether they are applied
+func (m *Migrator) Status(ctx context.Context) (status []MigrationStatus, err error) {
+	if err = m.createVersionTable(ctx, m.db); err != nil {
+		return
+	}
+	rows, err := m.db.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	appliedAt := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err = rows.Scan(&version, &at); err != nil {
+			return
+		}
+		appliedAt[version] = at
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	for _, migration := range m.migrations {
+		at, ok := appliedAt[migration.Version]
+		status = append(status, MigrationStatus{Migration: migration, Applied: ok, AppliedAt: at})
+	}
+	return
+}
+
+// locked runs fn on a dedicated connection holding the migration lock
+func (m *Migrator) locked(ctx context.Context, fn func(conn *sql.Conn) error) (err error) {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	if m.dialect.lock != "" {
+		if _, err = conn.ExecContext(ctx, m.dialect.lock); err != nil {
+			return
+		}
+		defer func() {
+			if _, unlockErr := conn.ExecContext(context.Background(), m.dialect.unlock); err == nil {
+				err = unlockErr
+			}
+		}()
+	}
+	if err = m.createVersionTable(ctx, conn); err != nil {
+		return
+	}
+	return fn(conn)
+}
+
+// execer is implemented by *sql.DB, *sql.Conn and *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func (m *Migrator) createVersionTable(ctx context.Context, db execer) (err error) {
+	_, err = db.ExecContext(ctx, `create table if not exists schema_migrations (
+  version    integer primary key,
+  name       varchar(255) not null,
+  applied_at timestamp not null
+)`)
+	return
+}
+
+// apply runs the up or down statements of migration in a transaction, it reports
+// false if there was nothing to do because another instance has already done it
+func (m *Migrator) apply(ctx context.Context, conn *sql.Conn, migration Migration, up bool) (ok bool, err error) {
+	// foreign keys can't be switched inside a transaction
+	if m.dialect.foreignKeysOff != "" {
+		if _, err = conn.ExecContext(ctx, m.dialect.foreignKeysOff); err != nil {
+			return
+		}
+		defer func() {
+			if _, onErr := conn.ExecContext(context.Background(), m.dialect.foreignKeysOn); err == nil {
+				err = onErr
+			}
+		}()
+	}
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil || !ok {
+			tx.Rollback()
+		}
+	}()
+
+	// the check is done inside the transaction so it is not stale
+	var count int
+	if err = tx.QueryRowContext(ctx, m.dialect.selectVersion, migration.Version).Scan(&count); err != nil {
+		return
+	}
+	if applied := count > 0; applied == up {
+		return
+	}
+	if up {
+		if _, err = tx.ExecContext(ctx, migration.Up); err != nil {
+			return
+		}
+		_, err = tx.ExecContext(ctx, m.dialect.insertVersion, migration.Version, migration.Name, time.Now())
+	} else {
+		if _, err = tx.ExecContext(ctx, migration.Down); err != nil {
+			return
+		}
+		_, err = tx.ExecContext(ctx, m.dialect.deleteVersion, migration.Version)
+	}
+	if err != nil {
+		return
+	}
+	if m.dialect.countViolations != "" {
+		var violations int
+		if err = tx.QueryRowContext(ctx, m.dialect.countViolations).Scan(&violations); err != nil {
+			return
+		}
+		if violations > 0 {
+			return false, fmt.Errorf("%d row(s) violate foreign keys", violations)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	return true, nil
+}
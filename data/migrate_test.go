@@ -0,0 +1,154 @@
+package data
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func Test_LoadMigrations(t *testing.T) {
+	for _, dialect := range []string{"postgres", "sqlite"} {
+		migrations, err := loadMigrations(dialect)
+		if err != nil {
+			t.Error(err, "Cannot load migrations for", dialect)
+		}
+		if len(migrations) == 0 || migrations[0].Version != 1 {
+			t.Errorf("Migration 0001 missing for %s", dialect)
+		}
+	}
+}
+
+func Test_MigrateUpDown(t *testing.T) {
+	ctx := context.Background()
+	sq, err := NewSQLite(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err, "Cannot open database")
+	}
+	defer sq.Db.Close()
+	m, err := sq.Migrator()
+	if err != nil {
+		t.Fatal(err, "Cannot load migrations")
+	}
+
+	applied, err := m.Up(ctx)
+	if err != nil {
+		t.Fatal(err, "Cannot migrate up")
+	}
+	if len(applied) != len(m.migrations) {
+		t.Errorf("Applied %d migrations, want %d", len(applied), len(m.migrations))
+	}
+	if applied, _ = m.Up(ctx); len(applied) != 0 {
+		t.Errorf("Migrations applied twice")
+	}
+	status, err := m.Status(ctx)
+	if err != nil {
+		t.Error(err, "Cannot get status")
+	}
+	for _, s := range status {
+		if !s.Applied {
+			t.Errorf("Migration %d not applied", s.Version)
+		}
+	}
+
+	// tables rebuilt to drop columns keep their rows and the rows referencing them
+	user := User{Name: "Peter Jones", Email: "peter@gmail.com", Password: "hash", Role: "user"}
+	if err = sq.CreateUser(ctx, &user); err != nil {
+		t.Fatal(err, "Cannot create user")
+	}
+	if _, err = sq.CreateSession(ctx, &user, Device{}); err != nil {
+		t.Fatal(err, "Cannot create session")
+	}
+	reverted, err := m.Down(ctx, len(m.migrations)-1)
+	if err != nil {
+		t.Fatal(err, "Cannot migrate down")
+	}
+	var users, sessions int
+	sq.Db.QueryRow("SELECT count(*) FROM users").Scan(&users)
+	sq.Db.QueryRow("SELECT count(*) FROM sessions WHERE user_id = ?", user.Id).Scan(&sessions)
+	if users != 1 || sessions != 1 {
+		t.Errorf("%d user(s) and %d session(s) left after migrating down", users, sessions)
+	}
+	more, err := m.Down(ctx, 1)
+	if err != nil {
+		t.Fatal(err, "Cannot migrate down")
+	}
+	if reverted = append(reverted, more...); len(reverted) != len(m.migrations) {
+		t.Errorf("Reverted %d migrations, want %d", len(reverted), len(m.migrations))
+	}
+	if _, err = sq.Users(ctx); err == nil {
+		t.Error("Users table not dropped")
+	}
+}
+
+func Test_MigrateConcurrently(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.db")
+	var wg sync.WaitGroup
+	applied := make([]int, 2)
+	for i := range applied {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sq, err := NewSQLite(file)
+			if err != nil {
+				t.Error(err, "Cannot open database")
+				return
+			}
+			defer sq.Db.Close()
+			m, err := sq.Migrator()
+			if err != nil {
+				t.Error(err, "Cannot load migrations")
+				return
+			}
+			migrations, err := m.Up(context.Background())
+			if err != nil {
+				t.Error(err, "Cannot migrate up")
+			}
+			applied[i] = len(migrations)
+		}(i)
+	}
+	wg.Wait()
+	migrations, _ := loadMigrations("sqlite")
+	if applied[0]+applied[1] != len(migrations) {
+		t.Errorf("Applied %d migrations in total, want %d", applied[0]+applied[1], len(migrations))
+	}
+}
+
+func Test_MigrateExistingDatabase(t *testing.T) {
+	ctx := context.Background()
+	sq, err := NewSQLite(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err, "Cannot open database")
+	}
+	defer sq.Db.Close()
+	// the schema SQLite databases were created with before the migrations
+	_, err = sq.Db.Exec(`create table if not exists users (
+  id         integer primary key autoincrement,
+  name       varchar(255),
+  email      varchar(255) not null unique,
+  password   varchar(255) not null,
+  role       varchar(10) not null,
+  created_at timestamp not null
+);
+create table if not exists sessions (
+  id         integer primary key autoincrement,
+  uuid       varchar(64) not null unique,
+  user_id    integer references users(id) on delete cascade,
+  last_activity timestamp not null,
+  created_at timestamp not null
+);
+insert into users (name, email, password, role, created_at) values ('Peter Jones', 'peter@gmail.com', 'hash', 'user', current_timestamp);`)
+	if err != nil {
+		t.Fatal(err, "Cannot create former schema")
+	}
+	m, err := sq.Migrator()
+	if err != nil {
+		t.Fatal(err, "Cannot load migrations")
+	}
+	if _, err = m.Up(ctx); err != nil {
+		t.Fatal(err, "Cannot migrate existing database")
+	}
+	if u, err := sq.UserByEmail(ctx, "peter@gmail.com"); err != nil || u.FailedLogins != 0 {
+		t.Error(err, "- User not kept by the migrations")
+	}
+}
@@ -0,0 +1,21 @@
+create table if not exists users (
+  id         serial primary key,
+  name       varchar(255),
+  email      varchar(255) not null unique,
+  password   varchar(255) not null,
+  role       varchar(10) not null,
+  created_at timestamp not null   
+);
+
+create table if not exists sessions (
+  id         serial primary key,
+  uuid       varchar(64) not null unique,
+  user_id    integer references users(id) on delete cascade,
+  last_activity timestamp not null,
+  created_at timestamp not null   
+);
+
+-- databases created from the former setup.sql already have the tables, but
+-- without sessions cascading when their user is deleted
+alter table sessions drop constraint if exists sessions_user_id_fkey;
+alter table sessions add constraint sessions_user_id_fkey foreign key (user_id) references users(id) on delete cascade;
@@ -0,0 +1,5 @@
+drop index sessions_user_id_idx;
+
+alter table sessions drop column device;
+alter table sessions drop column ip_address;
+alter table sessions drop column user_agent;
@@ -0,0 +1,5 @@
+alter table sessions add column user_agent varchar(255) not null default '';
+alter table sessions add column ip_address varchar(45) not null default '';
+alter table sessions add column device varchar(255) not null default '';
+
+create index sessions_user_id_idx on sessions (user_id);
@@ -0,0 +1,3 @@
+drop table invites;
+
+alter table users drop column pending;
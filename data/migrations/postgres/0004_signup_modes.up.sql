@@ -0,0 +1,11 @@
+alter table users add column pending boolean not null default false;
+
+create table invites (
+  id         serial primary key,
+  token      varchar(64) not null unique,
+  email      varchar(255) not null default '',
+  role       varchar(10) not null,
+  expires_at timestamp not null,
+  used_at    timestamp,
+  created_at timestamp not null
+);
@@ -0,0 +1,2 @@
+alter table users drop column pending_email;
+alter table users drop column email_verified_at;
@@ -0,0 +1,10 @@
+alter table users add column totp_secret varchar(64) not null default '';
+alter table users add column totp_last_step bigint not null default 0;
+
+create table recovery_codes (
+  id         serial primary key,
+  user_id    integer not null references users(id) on delete cascade,
+  code_hash  varchar(64) not null,
+  created_at timestamp not null,
+  unique (user_id, code_hash)
+);
@@ -0,0 +1 @@
+drop table revoked_sessions;
@@ -0,0 +1,4 @@
+create table revoked_sessions (
+  uuid       varchar(64) primary key,
+  expires_at timestamp
+);
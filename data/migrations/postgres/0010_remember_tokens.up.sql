@@ -0,0 +1,11 @@
+create table remember_tokens (
+  id             serial primary key,
+  selector       varchar(32) not null unique,
+  validator_hash varchar(64) not null,
+  previous_hash  varchar(64) not null default '',
+  user_id        integer not null references users(id) on delete cascade,
+  session_id     integer not null default 0,
+  rotated_at     timestamp not null,
+  expires_at     timestamp not null,
+  created_at     timestamp not null
+);
@@ -0,0 +1,17 @@
+-- databases created by the former setup_sqlite.sql already have the tables
+create table if not exists users (
+  id         integer primary key autoincrement,
+  name       varchar(255),
+  email      varchar(255) not null unique,
+  password   varchar(255) not null,
+  role       varchar(10) not null,
+  created_at timestamp not null
+);
+
+create table if not exists sessions (
+  id         integer primary key autoincrement,
+  uuid       varchar(64) not null unique,
+  user_id    integer references users(id) on delete cascade,
+  last_activity timestamp not null,
+  created_at timestamp not null
+);
@@ -0,0 +1,11 @@
+create table sessions_new (
+  id         integer primary key autoincrement,
+  uuid       varchar(64) not null unique,
+  user_id    integer references users(id) on delete cascade,
+  last_activity timestamp not null,
+  created_at timestamp not null
+);
+insert into sessions_new (id, uuid, user_id, last_activity, created_at)
+  select id, uuid, user_id, last_activity, created_at from sessions;
+drop table sessions;
+alter table sessions_new rename to sessions;
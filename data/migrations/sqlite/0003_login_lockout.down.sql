@@ -0,0 +1,12 @@
+create table users_new (
+  id         integer primary key autoincrement,
+  name       varchar(255),
+  email      varchar(255) not null unique,
+  password   varchar(255) not null,
+  role       varchar(10) not null,
+  created_at timestamp not null
+);
+insert into users_new (id, name, email, password, role, created_at)
+  select id, name, email, password, role, created_at from users;
+drop table users;
+alter table users_new rename to users;
@@ -0,0 +1,16 @@
+drop table invites;
+
+create table users_new (
+  id         integer primary key autoincrement,
+  name       varchar(255),
+  email      varchar(255) not null unique,
+  password   varchar(255) not null,
+  role       varchar(10) not null,
+  created_at timestamp not null,
+  failed_logins integer not null default 0,
+  locked_until timestamp
+);
+insert into users_new (id, name, email, password, role, created_at, failed_logins, locked_until)
+  select id, name, email, password, role, created_at, failed_logins, locked_until from users;
+drop table users;
+alter table users_new rename to users;
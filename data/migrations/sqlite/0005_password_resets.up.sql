@@ -0,0 +1,8 @@
+create table password_resets (
+  id         integer primary key autoincrement,
+  user_id    integer not null references users(id) on delete cascade,
+  token_hash varchar(64) not null unique,
+  expires_at timestamp not null,
+  used_at    timestamp,
+  created_at timestamp not null
+);
@@ -0,0 +1,2 @@
+alter table users add column email_verified_at timestamp;
+alter table users add column pending_email varchar(255) not null default '';
@@ -0,0 +1,16 @@
+create table sessions_new (
+  id         integer primary key autoincrement,
+  uuid       varchar(64) not null unique,
+  user_id    integer references users(id) on delete cascade,
+  last_activity timestamp not null,
+  created_at timestamp not null,
+  user_agent varchar(255) not null default '',
+  ip_address varchar(45) not null default '',
+  device     varchar(255) not null default ''
+);
+insert into sessions_new (id, uuid, user_id, last_activity, created_at, user_agent, ip_address, device)
+  select id, uuid, user_id, last_activity, created_at, user_agent, ip_address, device from sessions;
+drop table sessions;
+alter table sessions_new rename to sessions;
+
+create index sessions_user_id_idx on sessions (user_id);
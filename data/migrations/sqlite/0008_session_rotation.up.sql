@@ -0,0 +1 @@
+alter table sessions add column rotate boolean not null default false;
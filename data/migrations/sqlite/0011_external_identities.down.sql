@@ -0,0 +1 @@
+drop table external_identities;
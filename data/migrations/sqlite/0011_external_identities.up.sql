@@ -0,0 +1,8 @@
+create table external_identities (
+  id         integer primary key autoincrement,
+  user_id    integer not null references users(id) on delete cascade,
+  provider   varchar(64) not null,
+  subject    varchar(255) not null,
+  created_at timestamp not null,
+  unique (provider, subject)
+);
@@ -0,0 +1,725 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// Postgres stores users and sessions in a PostgreSQL database
+type Postgres struct {
+	Db *sql.DB
+	// QueryTimeout limits every query unless it is zero
+	QueryTimeout time.Duration
+}
+
+// NewPostgres opens the PostgreSQL database described by dsn
+func NewPostgres(dsn string) (*Postgres, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &Postgres{Db: db}, nil
+}
+
+// Migrator returns the schema migrator for the database
+func (p *Postgres) Migrator() (*Migrator, error) {
+	return NewMigrator(p.Db, "postgres")
+}
+
+// CreateSession creates a new session for existing user
+func (p *Postgres) CreateSession(ctx context.Context, u *User, device Device) (session Session, err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	statement := "INSERT INTO sessions (uuid, user_id, user_agent, ip_address, device, last_activity, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING " + sessionColumns
+	stmt, err := p.Db.PrepareContext(ctx, statement)
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+
+	// use QueryRow to return a row and scan the returned id into the Session struct
+	uuid, err := createUUID()
+	if err != nil {
+		return
+	}
+	err = scanSession(stmt.QueryRowContext(ctx, uuid, u.Id, device.UserAgent, device.IPAddress, device.Label, time.Now(), time.Now()), &session)
+	return
+}
+
+// CheckSession checks if session is in the database and not expired at now
+func (p *Postgres) CheckSession(ctx context.Context, s *Session, expiry SessionExpiry, now time.Time) (err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	err = scanSession(p.Db.QueryRowContext(ctx, "SELECT "+sessionColumns+" FROM sessions WHERE uuid = $1", s.Uuid), s)
+	if err == nil && s.Expired(expiry, now) {
+		err = ErrSessionExpired
+	}
+	return
+}
+
+// TouchSession records activity on the session at now
+func (p *Postgres) TouchSession(ctx context.Context, s *Session, now time.Time) (err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	if _, err = p.Db.ExecContext(ctx, "UPDATE sessions SET last_activity = $2 WHERE uuid = $1", s.Uuid, now); err != nil {
+		return
+	}
+	s.LastActivity = now
+	return
+}
+
+// SessionUser gets the user from the session
+func (p *Postgres) SessionUser(ctx context.Context, s *Session) (user User, err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	if err = scanUser(p.Db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE id = $1", s.UserId), &user); err != nil {
+		return
+	}
+	// the handlers get the whole user but never need its password hash
+	user.Password = ""
+	return
+}
+
+// Sessions lists sessions with their users, of a single user unless userId is 0
+func (p *Postgres) Sessions(ctx context.Context, userId int) (sessions []UserSession, err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	rows, err := p.Db.QueryContext(ctx, userSessionQuery, userId)
+	if err != nil {
+		return
+	}
+	return scanUserSessions(rows)
+}
+
+// DeleteSessionByUUID deletes session from database
+func (p *Postgres) DeleteSessionByUUID(ctx context.Context, s *Session) (err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	statement := "DELETE FROM sessions WHERE uuid = $1"
+	stmt, err := p.Db.PrepareContext(ctx, statement)
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+
+	_, err = stmt.ExecContext(ctx, s.Uuid)
+	return
+}
+
+// DeleteUserSession deletes a session of the user by id
+func (p *Postgres) DeleteUserSession(ctx context.Context, u *User, id int) (err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	_, err = p.Db.ExecContext(ctx, "DELETE FROM sessions WHERE id = $1 AND user_id = $2", id, u.Id)
+	return
+}
+
+// DeleteUserSessions deletes all sessions of the user except the one with exceptUuid
+func (p *Postgres) DeleteUserSessions(ctx context.Context, u *User, exceptUuid string) (err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	_, err = p.Db.ExecContext(ctx, "DELETE FROM sessions WHERE user_id = $1 AND uuid <> $2", u.Id, exceptUuid)
+	return
+}
+
+// RotateSession replaces the uuid of the session and clears RotationDue
+func (p *Postgres) RotateSession(ctx context.Context, s *Session) (err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	uuid, err := createUUID()
+	if err != nil {
+		return
+	}
+	res, err := p.Db.ExecContext(ctx, "UPDATE sessions SET uuid = $2, rotate = false WHERE uuid = $1", s.Uuid, uuid)
+	if err != nil {
+		return
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	s.Uuid, s.RotationDue = uuid, false
+	return
+}
+
+// RotateUserSessions sets RotationDue on all sessions of the user
+func (p *Postgres) RotateUserSessions(ctx context.Context, u *User) (err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	_, err = p.Db.ExecContext(ctx, "UPDATE sessions SET rotate = true WHERE user_id = $1", u.Id)
+	return
+}
+
+// CleanSessions removes the sessions which expired at now from the database
+func (p *Postgres) CleanSessions(ctx context.Context, expiry SessionExpiry, now time.Time) (cleaned int64, err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	statement := "DELETE FROM sessions WHERE last_activity <= $1 OR created_at <= $2"
+	idleSince, createdBefore := expiry.cutoffs(now)
+	res, err := p.Db.ExecContext(ctx, statement, idleSince, createdBefore)
+	if err != nil {
+		return
+	}
+	return res.RowsAffected()
+}
+
+// RevokeSessions adds the uuids to the list until expiresAt, forever if it is zero
+func (p *Postgres) RevokeSessions(ctx context.Context, uuids []string, expiresAt time.Time) (err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	tx, err := p.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	for _, uuid := range uuids {
+		if _, err = tx.ExecContext(ctx, "INSERT INTO revoked_sessions (uuid, expires_at) VALUES ($1, $2) ON CONFLICT (uuid) DO NOTHING",
+			uuid, nullTime(expiresAt)); err != nil {
+			return
+		}
+	}
+	return tx.Commit()
+}
+
+// SessionRevoked reports whether the session uuid is in the list
+func (p *Postgres) SessionRevoked(ctx context.Context, uuid string) (revoked bool, err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	err = p.Db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM revoked_sessions WHERE uuid = $1)", uuid).Scan(&revoked)
+	return
+}
+
+// CleanRevocations removes the uuids which expired at now
+func (p *Postgres) CleanRevocations(ctx context.Context, now time.Time) (cleaned int64, err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	res, err := p.Db.ExecContext(ctx, "DELETE FROM revoked_sessions WHERE expires_at <= $1", now)
+	if err != nil {
+		return
+	}
+	return res.RowsAffected()
+}
+
+// CreateRememberToken returns a new token for the user of the session until expiresAt
+func (p *Postgres) CreateRememberToken(ctx context.Context, s *Session, expiresAt time.Time) (token string, err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	selector, err := newSelector()
+	if err != nil {
+		return
+	}
+	token, hash, err := newRememberToken(selector)
+	if err != nil {
+		return
+	}
+	_, err = p.Db.ExecContext(ctx, "INSERT INTO remember_tokens (selector, validator_hash, user_id, session_id, rotated_at, expires_at, created_at) VALUES ($1, $2, $3, $4, $5, $6, $5)",
+		selector, hash, s.UserId, s.Id, time.Now(), expiresAt)
+	return
+}
+
+// RestoreSession creates a session for the user of the token and replaces its
+// validator, a known selector with an unknown validator deletes all tokens of the user
+func (p *Postgres) RestoreSession(ctx context.Context, token string, device Device) (session Session, next string, err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	selector, hash, err := splitRememberToken(token)
+	if err != nil {
+		return
+	}
+	fresh, freshHash, err := newRememberToken(selector)
+	if err != nil {
+		return
+	}
+	tx, err := p.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	now := time.Now()
+	var userId int
+	var current, previous string
+	var rotatedAt time.Time
+	err = tx.QueryRowContext(ctx, "SELECT user_id, validator_hash, previous_hash, rotated_at FROM remember_tokens WHERE selector = $1 AND expires_at > $2 FOR UPDATE",
+		selector, now).Scan(&userId, &current, &previous, &rotatedAt)
+	if err == sql.ErrNoRows {
+		err = ErrInvalidToken
+	}
+	if err != nil {
+		return
+	}
+	valid, replaced := checkValidator(current, previous, hash, rotatedAt, now)
+	if !valid {
+		if _, err = tx.ExecContext(ctx, "DELETE FROM remember_tokens WHERE user_id = $1", userId); err != nil {
+			return
+		}
+		if err = tx.Commit(); err != nil {
+			return
+		}
+		return Session{UserId: userId}, "", ErrTokenTheft
+	}
+	uuid, err := createUUID()
+	if err != nil {
+		return
+	}
+	statement := "INSERT INTO sessions (uuid, user_id, user_agent, ip_address, device, last_activity, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING " + sessionColumns
+	if err = scanSession(tx.QueryRowContext(ctx, statement, uuid, userId, device.UserAgent, device.IPAddress, device.Label, now, now), &session); err != nil {
+		return
+	}
+	if replaced {
+		err = tx.Commit()
+		return
+	}
+	if _, err = tx.ExecContext(ctx, "UPDATE remember_tokens SET previous_hash = validator_hash, validator_hash = $2, rotated_at = $3, session_id = $4 WHERE selector = $1",
+		selector, freshHash, now, session.Id); err != nil {
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	next = fresh
+	return
+}
+
+// DeleteSessionRememberToken deletes the token which last restored the session
+func (p *Postgres) DeleteSessionRememberToken(ctx context.Context, s *Session) (err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	_, err = p.Db.ExecContext(ctx, "DELETE FROM remember_tokens WHERE session_id = $1 AND user_id = $2", s.Id, s.UserId)
+	return
+}
+
+// DeleteUserRememberTokens deletes all tokens of the user except the one of the session with exceptSessionId
+func (p *Postgres) DeleteUserRememberTokens(ctx context.Context, u *User, exceptSessionId int) (err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	_, err = p.Db.ExecContext(ctx, "DELETE FROM remember_tokens WHERE user_id = $1 AND session_id <> $2", u.Id, exceptSessionId)
+	return
+}
+
+// CleanRememberTokens removes the tokens which expired at now
+func (p *Postgres) CleanRememberTokens(ctx context.Context, now time.Time) (cleaned int64, err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	res, err := p.Db.ExecContext(ctx, "DELETE FROM remember_tokens WHERE expires_at <= $1", now)
+	if err != nil {
+		return
+	}
+	return res.RowsAffected()
+}
+
+// TryLock takes a Postgres advisory lock which is held by a dedicated connection
+// until unlock is called or the connection is lost
+func (p *Postgres) TryLock(ctx context.Context, name string) (unlock func(), ok bool, err error) {
+	conn, err := p.Db.Conn(ctx)
+	if err != nil {
+		return
+	}
+	key := lockKey(name)
+	if err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&ok); err != nil || !ok {
+		conn.Close()
+		return
+	}
+	unlock = func() {
+		conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", key)
+		conn.Close()
+	}
+	return
+}
+
+// CreateUser creates a new user, save user info into database. The password must be hashed already.
+func (p *Postgres) CreateUser(ctx context.Context, u *User) (err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	// Postgres does not automatically return the last insert id, because it would be wrong to assume
+	// you're always using a sequence.You need to use the RETURNING keyword in your insert to get this
+	// information from postgres.
+	statement := "INSERT INTO users (name, email, password, role, pending, email_verified_at, created_at) values ($1, $2, $3, $4, $5, $6, $7) RETURNING id, created_at"
+	stmt, err := p.Db.PrepareContext(ctx, statement)
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+
+	// use QueryRow to return a row and scan the returned id into the User struct
+	err = stmt.QueryRowContext(ctx, u.Name, u.Email, u.Password, u.Role, u.Pending, nullTime(u.EmailVerifiedAt), time.Now()).
+		Scan(&u.Id, &u.CreatedAt)
+	return
+}
+
+// DeleteUser deletes user from database
+func (p *Postgres) DeleteUser(ctx context.Context, u *User) (err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	statement := "delete from users where id = $1"
+	stmt, err := p.Db.PrepareContext(ctx, statement)
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+
+	_, err = stmt.ExecContext(ctx, u.Id)
+	return
+}
+
+// UpdateUser updates user information in the database
+func (p *Postgres) UpdateUser(ctx context.Context, u *User) (err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	statement := "update users set name = $2, email = $3, password = $4, role = $5, pending = $6, email_verified_at = $7, pending_email = $8 where id = $1"
+	stmt, err := p.Db.PrepareContext(ctx, statement)
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+
+	_, err = stmt.ExecContext(ctx, u.Id, u.Name, u.Email, u.Password, u.Role, u.Pending, nullTime(u.EmailVerifiedAt), u.PendingEmail)
+	return
+}
+
+// LoginFailed counts a failed login of the user, on reaching threshold failures
+// the account is locked for the lockout duration and the count starts over
+func (p *Postgres) LoginFailed(ctx context.Context, u *User, threshold int, lockout time.Duration) (err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	statement := `UPDATE users SET
+  failed_logins = CASE WHEN $2 > 0 AND failed_logins + 1 >= $2 THEN 0 ELSE failed_logins + 1 END,
+  locked_until = CASE WHEN $2 > 0 AND failed_logins + 1 >= $2 THEN $3 ELSE locked_until END
+WHERE id = $1 RETURNING failed_logins, locked_until`
+	var lockedUntil sql.NullTime
+	if err = p.Db.QueryRowContext(ctx, statement, u.Id, threshold, time.Now().Add(lockout)).Scan(&u.FailedLogins, &lockedUntil); err != nil {
+		return
+	}
+	u.LockedUntil = lockedUntil.Time
+	return
+}
+
+// UnlockUser lifts the lockout of the user and resets its failed logins
+func (p *Postgres) UnlockUser(ctx context.Context, u *User) (err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	if _, err = p.Db.ExecContext(ctx, "UPDATE users SET failed_logins = 0, locked_until = NULL WHERE id = $1", u.Id); err != nil {
+		return
+	}
+	u.FailedLogins, u.LockedUntil = 0, time.Time{}
+	return
+}
+
+// UserSession gets the session for an existing user
+func (p *Postgres) UserSession(ctx context.Context, u *User) (session Session, err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	session = Session{}
+	err = scanSession(p.Db.QueryRowContext(ctx, "SELECT "+sessionColumns+" FROM sessions WHERE user_id = $1", u.Id), &session)
+	return
+}
+
+// UserSessions gets all sessions of the user, most recently active first
+func (p *Postgres) UserSessions(ctx context.Context, u *User) (sessions []Session, err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	rows, err := p.Db.QueryContext(ctx, "SELECT "+sessionColumns+" FROM sessions WHERE user_id = $1 ORDER BY last_activity DESC", u.Id)
+	if err != nil {
+		return
+	}
+	return scanSessions(rows)
+}
+
+// UserByEmail gets a single user by email
+func (p *Postgres) UserByEmail(ctx context.Context, email string) (user User, err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	user = User{}
+	err = scanUser(p.Db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE email = $1", email), &user)
+	return
+}
+
+// UserById gets a single user by id
+func (p *Postgres) UserById(ctx context.Context, id int) (user User, err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	err = scanUser(p.Db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE id = $1", id), &user)
+	return
+}
+
+// IdentityUser gets the user linked to the subject of the provider
+func (p *Postgres) IdentityUser(ctx context.Context, provider, subject string) (user User, err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	statement := "SELECT " + userColumns + " FROM users WHERE id = (SELECT user_id FROM external_identities WHERE provider = $1 AND subject = $2)"
+	err = scanUser(p.Db.QueryRowContext(ctx, statement, provider, subject), &user)
+	return
+}
+
+// LinkIdentity links the user to the subject of the provider
+func (p *Postgres) LinkIdentity(ctx context.Context, u *User, provider, subject string) (err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	_, err = p.Db.ExecContext(ctx, "INSERT INTO external_identities (user_id, provider, subject, created_at) VALUES ($1, $2, $3, $4)",
+		u.Id, provider, subject, time.Now())
+	return
+}
+
+// Users gets all users in the database and returns it
+func (p *Postgres) Users(ctx context.Context) (users []User, err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	rows, err := p.Db.QueryContext(ctx, "SELECT "+userColumns+" FROM users")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		user := User{}
+		if err = scanUser(rows, &user); err != nil {
+			return
+		}
+		users = append(users, user)
+	}
+	err = rows.Err()
+	return
+}
+
+// CreateInvite creates an invite with a new token
+func (p *Postgres) CreateInvite(ctx context.Context, inv *Invite) (err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	if inv.Token, err = createUUID(); err != nil {
+		return
+	}
+	statement := "INSERT INTO invites (token, email, role, expires_at, created_at) VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at"
+	err = p.Db.QueryRowContext(ctx, statement, inv.Token, inv.Email, inv.Role, inv.ExpiresAt, time.Now()).
+		Scan(&inv.Id, &inv.CreatedAt)
+	return
+}
+
+// Invites gets the invites which were not used yet, oldest first
+func (p *Postgres) Invites(ctx context.Context) (invites []Invite, err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	rows, err := p.Db.QueryContext(ctx, "SELECT "+inviteColumns+" FROM invites WHERE used_at IS NULL ORDER BY created_at")
+	if err != nil {
+		return
+	}
+	return scanInvites(rows)
+}
+
+// CreateInvitedUser creates the user with the role of the invite with token and marks the invite used
+func (p *Postgres) CreateInvitedUser(ctx context.Context, u *User, token string) (err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	tx, err := p.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	statement := `UPDATE invites SET used_at = $3
+WHERE token = $1 AND used_at IS NULL AND expires_at > $3 AND (email = '' OR lower(email) = lower($2))
+RETURNING ` + inviteColumns
+	var invite Invite
+	err = scanInvite(tx.QueryRowContext(ctx, statement, token, u.Email, time.Now()), &invite)
+	if err == sql.ErrNoRows {
+		return ErrInvalidInvite
+	}
+	if err != nil {
+		return
+	}
+	var id int
+	var createdAt time.Time
+	err = tx.QueryRowContext(ctx, "INSERT INTO users (name, email, password, role, pending, email_verified_at, created_at) values ($1, $2, $3, $4, $5, $6, $7) RETURNING id, created_at",
+		u.Name, u.Email, u.Password, invite.Role, u.Pending, nullTime(u.EmailVerifiedAt), time.Now()).Scan(&id, &createdAt)
+	if err != nil {
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	u.Id, u.Role, u.CreatedAt = id, invite.Role, createdAt
+	return
+}
+
+// DeleteInvite deletes the invite by id
+func (p *Postgres) DeleteInvite(ctx context.Context, id int) (err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	_, err = p.Db.ExecContext(ctx, "DELETE FROM invites WHERE id = $1", id)
+	return
+}
+
+// CreatePasswordReset returns a new password reset token for the user, its unused tokens are deleted
+func (p *Postgres) CreatePasswordReset(ctx context.Context, u *User, expiresAt time.Time) (token string, err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	token, hash, err := newToken()
+	if err != nil {
+		return
+	}
+	tx, err := p.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	if _, err = tx.ExecContext(ctx, "DELETE FROM password_resets WHERE user_id = $1 AND used_at IS NULL", u.Id); err != nil {
+		return
+	}
+	if _, err = tx.ExecContext(ctx, "INSERT INTO password_resets (user_id, token_hash, expires_at, created_at) VALUES ($1, $2, $3, $4)",
+		u.Id, hash, expiresAt, time.Now()); err != nil {
+		return
+	}
+	err = tx.Commit()
+	return
+}
+
+// PasswordReset gets the password reset of token if it can still be used
+func (p *Postgres) PasswordReset(ctx context.Context, token string) (reset PasswordReset, err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	statement := "SELECT " + resetColumns + " FROM password_resets WHERE token_hash = $1 AND used_at IS NULL AND expires_at > $2"
+	err = scanReset(p.Db.QueryRowContext(ctx, statement, hashToken(token), time.Now()), &reset)
+	if err == sql.ErrNoRows {
+		err = ErrInvalidToken
+	}
+	return
+}
+
+// UsePasswordReset marks the password reset of token as used if it can still be used
+func (p *Postgres) UsePasswordReset(ctx context.Context, token string) (reset PasswordReset, err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	statement := "UPDATE password_resets SET used_at = $2 WHERE token_hash = $1 AND used_at IS NULL AND expires_at > $2 RETURNING " + resetColumns
+	err = scanReset(p.Db.QueryRowContext(ctx, statement, hashToken(token), time.Now()), &reset)
+	if err == sql.ErrNoRows {
+		err = ErrInvalidToken
+	}
+	return
+}
+
+// EnableTOTP sets the TOTP secret of the user and returns its new recovery
+// codes, ErrTwoFactorEnabled if the user has another secret than u
+func (p *Postgres) EnableTOTP(ctx context.Context, u *User, secret string) (recoveryCodes []string, err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	tx, err := p.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, "UPDATE users SET totp_secret = $2, totp_last_step = 0 WHERE id = $1 AND totp_secret = $3", u.Id, secret, u.TOTPSecret)
+	if err != nil {
+		return
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if n == 0 {
+		return nil, ErrTwoFactorEnabled
+	}
+	if recoveryCodes, err = p.replaceRecoveryCodes(ctx, tx, u); err != nil {
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	u.TOTPSecret = secret
+	return
+}
+
+// DisableTOTP removes the TOTP secret and the recovery codes of the user
+func (p *Postgres) DisableTOTP(ctx context.Context, u *User) (err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	tx, err := p.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	if _, err = tx.ExecContext(ctx, "UPDATE users SET totp_secret = '', totp_last_step = 0 WHERE id = $1", u.Id); err != nil {
+		return
+	}
+	if _, err = tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = $1", u.Id); err != nil {
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	u.TOTPSecret = ""
+	return
+}
+
+// UseTOTPStep records the time step of an accepted code, so that a code can't be used twice
+func (p *Postgres) UseTOTPStep(ctx context.Context, u *User, step int64) (err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	res, err := p.Db.ExecContext(ctx, "UPDATE users SET totp_last_step = $2 WHERE id = $1 AND totp_last_step < $2", u.Id, step)
+	if err != nil {
+		return
+	}
+	used, err := res.RowsAffected()
+	if err == nil && used == 0 {
+		err = ErrInvalidToken
+	}
+	return
+}
+
+// CreateRecoveryCodes returns new recovery codes for the user, replacing its old ones
+func (p *Postgres) CreateRecoveryCodes(ctx context.Context, u *User) (recoveryCodes []string, err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	tx, err := p.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	if recoveryCodes, err = p.replaceRecoveryCodes(ctx, tx, u); err != nil {
+		return
+	}
+	err = tx.Commit()
+	return
+}
+
+// replaceRecoveryCodes deletes the recovery codes of the user and creates new ones in tx
+func (p *Postgres) replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, u *User) (recoveryCodes []string, err error) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return
+	}
+	if _, err = tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = $1", u.Id); err != nil {
+		return
+	}
+	now := time.Now()
+	for _, hash := range hashes {
+		if _, err = tx.ExecContext(ctx, "INSERT INTO recovery_codes (user_id, code_hash, created_at) VALUES ($1, $2, $3)", u.Id, hash, now); err != nil {
+			return
+		}
+	}
+	return codes, nil
+}
+
+// UseRecoveryCode deletes the recovery code of the user
+func (p *Postgres) UseRecoveryCode(ctx context.Context, u *User, code string) (err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	res, err := p.Db.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = $1 AND code_hash = $2", u.Id, hashRecoveryCode(code))
+	if err != nil {
+		return
+	}
+	used, err := res.RowsAffected()
+	if err == nil && used == 0 {
+		err = ErrInvalidToken
+	}
+	return
+}
+
+// RecoveryCodesLeft counts the unused recovery codes of the user
+func (p *Postgres) RecoveryCodesLeft(ctx context.Context, u *User) (left int, err error) {
+	ctx, cancel := withTimeout(ctx, p.QueryTimeout)
+	defer cancel()
+	err = p.Db.QueryRowContext(ctx, "SELECT count(*) FROM recovery_codes WHERE user_id = $1", u.Id).Scan(&left)
+	return
+}
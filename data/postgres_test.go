@@ -0,0 +1,31 @@
+package data
+
+import (
+	"os"
+	"testing"
+)
+
+// newTestPostgres empties the database named by TEST_POSTGRES_DSN by
+// reverting and applying all migrations, the test is skipped without it
+func newTestPostgres(t *testing.T) *Postgres {
+	dsn := os.Getenv("TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("TEST_POSTGRES_DSN is not set")
+	}
+	p, err := NewPostgres(dsn)
+	if err != nil {
+		t.Fatal(err, "Cannot open database")
+	}
+	t.Cleanup(func() { p.Db.Close() })
+	m, err := p.Migrator()
+	if err != nil {
+		t.Fatal(err, "Cannot load migrations")
+	}
+	if _, err = m.Down(ctx, len(m.migrations)); err != nil {
+		t.Fatal(err, "Cannot revert migrations")
+	}
+	if _, err = m.Up(ctx); err != nil {
+		t.Fatal(err, "Cannot migrate database")
+	}
+	return p
+}
@@ -0,0 +1,754 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLite stores users and sessions in a SQLite database file
+type SQLite struct {
+	// a SQLite file is not shared between hosts, so locks are taken per process
+	localLocks
+	Db *sql.DB
+	// QueryTimeout limits every query unless it is zero
+	QueryTimeout time.Duration
+}
+
+// NewSQLite opens the SQLite database at path
+func NewSQLite(path string) (*SQLite, error) {
+	// foreign keys are off by default in SQLite, they are needed to cascade sessions;
+	// immediate transactions take the write lock at once, which migrations rely on
+	db, err := sql.Open("sqlite3", "file:"+path+"?_foreign_keys=on&_busy_timeout=5000&_txlock=immediate")
+	if err != nil {
+		return nil, err
+	}
+	return &SQLite{Db: db}, nil
+}
+
+// Migrator returns the schema migrator for the database
+func (sq *SQLite) Migrator() (*Migrator, error) {
+	return NewMigrator(sq.Db, "sqlite")
+}
+
+// CreateSession creates a new session for existing user
+func (sq *SQLite) CreateSession(ctx context.Context, u *User, device Device) (session Session, err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	uuid, err := createUUID()
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	res, err := sq.Db.ExecContext(ctx, "INSERT INTO sessions (uuid, user_id, user_agent, ip_address, device, last_activity, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		uuid, u.Id, device.UserAgent, device.IPAddress, device.Label, now, now)
+	if err != nil {
+		return
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return
+	}
+	session = Session{
+		Id:           int(id),
+		Uuid:         uuid,
+		UserId:       u.Id,
+		Device:       device,
+		LastActivity: now,
+		CreatedAt:    now,
+	}
+	return
+}
+
+// CheckSession checks if session is in the database and not expired at now
+func (sq *SQLite) CheckSession(ctx context.Context, s *Session, expiry SessionExpiry, now time.Time) (err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	err = scanSession(sq.Db.QueryRowContext(ctx, "SELECT "+sessionColumns+" FROM sessions WHERE uuid = ?", s.Uuid), s)
+	if err == nil && s.Expired(expiry, now) {
+		err = ErrSessionExpired
+	}
+	return
+}
+
+// TouchSession records activity on the session at now
+func (sq *SQLite) TouchSession(ctx context.Context, s *Session, now time.Time) (err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	if _, err = sq.Db.ExecContext(ctx, "UPDATE sessions SET last_activity = ? WHERE uuid = ?", now, s.Uuid); err != nil {
+		return
+	}
+	s.LastActivity = now
+	return
+}
+
+// SessionUser gets the user from the session
+func (sq *SQLite) SessionUser(ctx context.Context, s *Session) (user User, err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	if err = scanUser(sq.Db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE id = ?", s.UserId), &user); err != nil {
+		return
+	}
+	// the handlers get the whole user but never need its password hash
+	user.Password = ""
+	return
+}
+
+// Sessions lists sessions with their users, of a single user unless userId is 0
+func (sq *SQLite) Sessions(ctx context.Context, userId int) (sessions []UserSession, err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	rows, err := sq.Db.QueryContext(ctx, userSessionQuery, userId)
+	if err != nil {
+		return
+	}
+	return scanUserSessions(rows)
+}
+
+// DeleteSessionByUUID deletes session from database
+func (sq *SQLite) DeleteSessionByUUID(ctx context.Context, s *Session) (err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	_, err = sq.Db.ExecContext(ctx, "DELETE FROM sessions WHERE uuid = ?", s.Uuid)
+	return
+}
+
+// DeleteUserSession deletes a session of the user by id
+func (sq *SQLite) DeleteUserSession(ctx context.Context, u *User, id int) (err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	_, err = sq.Db.ExecContext(ctx, "DELETE FROM sessions WHERE id = ? AND user_id = ?", id, u.Id)
+	return
+}
+
+// DeleteUserSessions deletes all sessions of the user except the one with exceptUuid
+func (sq *SQLite) DeleteUserSessions(ctx context.Context, u *User, exceptUuid string) (err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	_, err = sq.Db.ExecContext(ctx, "DELETE FROM sessions WHERE user_id = ? AND uuid <> ?", u.Id, exceptUuid)
+	return
+}
+
+// RotateSession replaces the uuid of the session and clears RotationDue
+func (sq *SQLite) RotateSession(ctx context.Context, s *Session) (err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	uuid, err := createUUID()
+	if err != nil {
+		return
+	}
+	res, err := sq.Db.ExecContext(ctx, "UPDATE sessions SET uuid = ?, rotate = false WHERE uuid = ?", uuid, s.Uuid)
+	if err != nil {
+		return
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	s.Uuid, s.RotationDue = uuid, false
+	return
+}
+
+// RotateUserSessions sets RotationDue on all sessions of the user
+func (sq *SQLite) RotateUserSessions(ctx context.Context, u *User) (err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	_, err = sq.Db.ExecContext(ctx, "UPDATE sessions SET rotate = true WHERE user_id = ?", u.Id)
+	return
+}
+
+// CleanSessions removes the sessions which expired at now from the database
+func (sq *SQLite) CleanSessions(ctx context.Context, expiry SessionExpiry, now time.Time) (cleaned int64, err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	idleSince, createdBefore := expiry.cutoffs(now)
+	res, err := sq.Db.ExecContext(ctx, "DELETE FROM sessions WHERE last_activity <= ? OR created_at <= ?", idleSince, createdBefore)
+	if err != nil {
+		return
+	}
+	return res.RowsAffected()
+}
+
+// RevokeSessions adds the uuids to the list until expiresAt, forever if it is zero
+func (sq *SQLite) RevokeSessions(ctx context.Context, uuids []string, expiresAt time.Time) (err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	tx, err := sq.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	for _, uuid := range uuids {
+		if _, err = tx.ExecContext(ctx, "INSERT OR IGNORE INTO revoked_sessions (uuid, expires_at) VALUES (?, ?)",
+			uuid, nullTime(expiresAt)); err != nil {
+			return
+		}
+	}
+	return tx.Commit()
+}
+
+// SessionRevoked reports whether the session uuid is in the list
+func (sq *SQLite) SessionRevoked(ctx context.Context, uuid string) (revoked bool, err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	err = sq.Db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM revoked_sessions WHERE uuid = ?)", uuid).Scan(&revoked)
+	return
+}
+
+// CleanRevocations removes the uuids which expired at now
+func (sq *SQLite) CleanRevocations(ctx context.Context, now time.Time) (cleaned int64, err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	res, err := sq.Db.ExecContext(ctx, "DELETE FROM revoked_sessions WHERE expires_at <= ?", now)
+	if err != nil {
+		return
+	}
+	return res.RowsAffected()
+}
+
+// CreateRememberToken returns a new token for the user of the session until expiresAt
+func (sq *SQLite) CreateRememberToken(ctx context.Context, s *Session, expiresAt time.Time) (token string, err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	selector, err := newSelector()
+	if err != nil {
+		return
+	}
+	token, hash, err := newRememberToken(selector)
+	if err != nil {
+		return
+	}
+	_, err = sq.Db.ExecContext(ctx, "INSERT INTO remember_tokens (selector, validator_hash, user_id, session_id, rotated_at, expires_at, created_at) VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?5)",
+		selector, hash, s.UserId, s.Id, time.Now(), expiresAt)
+	return
+}
+
+// RestoreSession creates a session for the user of the token and replaces its
+// validator, a known selector with an unknown validator deletes all tokens of the user
+func (sq *SQLite) RestoreSession(ctx context.Context, token string, device Device) (session Session, next string, err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	selector, hash, err := splitRememberToken(token)
+	if err != nil {
+		return
+	}
+	fresh, freshHash, err := newRememberToken(selector)
+	if err != nil {
+		return
+	}
+	tx, err := sq.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	// transactions take the write lock at once, so uses of the same token are serialized
+	now := time.Now()
+	var userId int
+	var current, previous string
+	var rotatedAt time.Time
+	err = tx.QueryRowContext(ctx, "SELECT user_id, validator_hash, previous_hash, rotated_at FROM remember_tokens WHERE selector = ? AND expires_at > ?",
+		selector, now).Scan(&userId, &current, &previous, &rotatedAt)
+	if err == sql.ErrNoRows {
+		err = ErrInvalidToken
+	}
+	if err != nil {
+		return
+	}
+	valid, replaced := checkValidator(current, previous, hash, rotatedAt, now)
+	if !valid {
+		if _, err = tx.ExecContext(ctx, "DELETE FROM remember_tokens WHERE user_id = ?", userId); err != nil {
+			return
+		}
+		if err = tx.Commit(); err != nil {
+			return
+		}
+		return Session{UserId: userId}, "", ErrTokenTheft
+	}
+	uuid, err := createUUID()
+	if err != nil {
+		return
+	}
+	res, err := tx.ExecContext(ctx, "INSERT INTO sessions (uuid, user_id, user_agent, ip_address, device, last_activity, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		uuid, userId, device.UserAgent, device.IPAddress, device.Label, now, now)
+	if err != nil {
+		return
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return
+	}
+	session = Session{
+		Id:           int(id),
+		Uuid:         uuid,
+		UserId:       userId,
+		Device:       device,
+		LastActivity: now,
+		CreatedAt:    now,
+	}
+	if replaced {
+		err = tx.Commit()
+		return
+	}
+	if _, err = tx.ExecContext(ctx, "UPDATE remember_tokens SET previous_hash = validator_hash, validator_hash = ?2, rotated_at = ?3, session_id = ?4 WHERE selector = ?1",
+		selector, freshHash, now, session.Id); err != nil {
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	next = fresh
+	return
+}
+
+// DeleteSessionRememberToken deletes the token which last restored the session
+func (sq *SQLite) DeleteSessionRememberToken(ctx context.Context, s *Session) (err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	_, err = sq.Db.ExecContext(ctx, "DELETE FROM remember_tokens WHERE session_id = ? AND user_id = ?", s.Id, s.UserId)
+	return
+}
+
+// DeleteUserRememberTokens deletes all tokens of the user except the one of the session with exceptSessionId
+func (sq *SQLite) DeleteUserRememberTokens(ctx context.Context, u *User, exceptSessionId int) (err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	_, err = sq.Db.ExecContext(ctx, "DELETE FROM remember_tokens WHERE user_id = ? AND session_id <> ?", u.Id, exceptSessionId)
+	return
+}
+
+// CleanRememberTokens removes the tokens which expired at now
+func (sq *SQLite) CleanRememberTokens(ctx context.Context, now time.Time) (cleaned int64, err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	res, err := sq.Db.ExecContext(ctx, "DELETE FROM remember_tokens WHERE expires_at <= ?", now)
+	if err != nil {
+		return
+	}
+	return res.RowsAffected()
+}
+
+// CreateUser creates a new user, save user info into database. The password must be hashed already.
+func (sq *SQLite) CreateUser(ctx context.Context, u *User) (err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	// SQLite has no RETURNING clause, the id is taken from the result instead
+	now := time.Now()
+	res, err := sq.Db.ExecContext(ctx, "INSERT INTO users (name, email, password, role, pending, email_verified_at, created_at) values (?, ?, ?, ?, ?, ?, ?)",
+		u.Name, u.Email, u.Password, u.Role, u.Pending, nullTime(u.EmailVerifiedAt), now)
+	if err != nil {
+		return
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return
+	}
+	u.Id, u.CreatedAt = int(id), now
+	return
+}
+
+// DeleteUser deletes user from database
+func (sq *SQLite) DeleteUser(ctx context.Context, u *User) (err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	_, err = sq.Db.ExecContext(ctx, "delete from users where id = ?", u.Id)
+	return
+}
+
+// UpdateUser updates user information in the database
+func (sq *SQLite) UpdateUser(ctx context.Context, u *User) (err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	_, err = sq.Db.ExecContext(ctx, "update users set name = ?, email = ?, password = ?, role = ?, pending = ?, email_verified_at = ?, pending_email = ? where id = ?",
+		u.Name, u.Email, u.Password, u.Role, u.Pending, nullTime(u.EmailVerifiedAt), u.PendingEmail, u.Id)
+	return
+}
+
+// LoginFailed counts a failed login of the user, on reaching threshold failures
+// the account is locked for the lockout duration and the count starts over
+func (sq *SQLite) LoginFailed(ctx context.Context, u *User, threshold int, lockout time.Duration) (err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	// SQLite has no RETURNING clause, the new values are read back in the same transaction
+	tx, err := sq.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	statement := `UPDATE users SET
+  failed_logins = CASE WHEN ?2 > 0 AND failed_logins + 1 >= ?2 THEN 0 ELSE failed_logins + 1 END,
+  locked_until = CASE WHEN ?2 > 0 AND failed_logins + 1 >= ?2 THEN ?3 ELSE locked_until END
+WHERE id = ?1`
+	if _, err = tx.ExecContext(ctx, statement, u.Id, threshold, time.Now().Add(lockout)); err != nil {
+		return
+	}
+	var lockedUntil sql.NullTime
+	if err = tx.QueryRowContext(ctx, "SELECT failed_logins, locked_until FROM users WHERE id = ?", u.Id).Scan(&u.FailedLogins, &lockedUntil); err != nil {
+		return
+	}
+	u.LockedUntil = lockedUntil.Time
+	return tx.Commit()
+}
+
+// UnlockUser lifts the lockout of the user and resets its failed logins
+func (sq *SQLite) UnlockUser(ctx context.Context, u *User) (err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	if _, err = sq.Db.ExecContext(ctx, "UPDATE users SET failed_logins = 0, locked_until = NULL WHERE id = ?", u.Id); err != nil {
+		return
+	}
+	u.FailedLogins, u.LockedUntil = 0, time.Time{}
+	return
+}
+
+// UserSession gets the session for an existing user
+func (sq *SQLite) UserSession(ctx context.Context, u *User) (session Session, err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	session = Session{}
+	err = scanSession(sq.Db.QueryRowContext(ctx, "SELECT "+sessionColumns+" FROM sessions WHERE user_id = ?", u.Id), &session)
+	return
+}
+
+// UserSessions gets all sessions of the user, most recently active first
+func (sq *SQLite) UserSessions(ctx context.Context, u *User) (sessions []Session, err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	rows, err := sq.Db.QueryContext(ctx, "SELECT "+sessionColumns+" FROM sessions WHERE user_id = ? ORDER BY last_activity DESC", u.Id)
+	if err != nil {
+		return
+	}
+	return scanSessions(rows)
+}
+
+// UserByEmail gets a single user by email
+func (sq *SQLite) UserByEmail(ctx context.Context, email string) (user User, err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	user = User{}
+	err = scanUser(sq.Db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE email = ?", email), &user)
+	return
+}
+
+// UserById gets a single user by id
+func (sq *SQLite) UserById(ctx context.Context, id int) (user User, err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	err = scanUser(sq.Db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE id = ?", id), &user)
+	return
+}
+
+// IdentityUser gets the user linked to the subject of the provider
+func (sq *SQLite) IdentityUser(ctx context.Context, provider, subject string) (user User, err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	statement := "SELECT " + userColumns + " FROM users WHERE id = (SELECT user_id FROM external_identities WHERE provider = ? AND subject = ?)"
+	err = scanUser(sq.Db.QueryRowContext(ctx, statement, provider, subject), &user)
+	return
+}
+
+// LinkIdentity links the user to the subject of the provider
+func (sq *SQLite) LinkIdentity(ctx context.Context, u *User, provider, subject string) (err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	_, err = sq.Db.ExecContext(ctx, "INSERT INTO external_identities (user_id, provider, subject, created_at) VALUES (?, ?, ?, ?)",
+		u.Id, provider, subject, time.Now())
+	return
+}
+
+// Users gets all users in the database and returns it
+func (sq *SQLite) Users(ctx context.Context) (users []User, err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	rows, err := sq.Db.QueryContext(ctx, "SELECT "+userColumns+" FROM users")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		user := User{}
+		if err = scanUser(rows, &user); err != nil {
+			return
+		}
+		users = append(users, user)
+	}
+	err = rows.Err()
+	return
+}
+
+// CreateInvite creates an invite with a new token
+func (sq *SQLite) CreateInvite(ctx context.Context, inv *Invite) (err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	if inv.Token, err = createUUID(); err != nil {
+		return
+	}
+	now := time.Now()
+	res, err := sq.Db.ExecContext(ctx, "INSERT INTO invites (token, email, role, expires_at, created_at) VALUES (?, ?, ?, ?, ?)",
+		inv.Token, inv.Email, inv.Role, inv.ExpiresAt, now)
+	if err != nil {
+		return
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return
+	}
+	inv.Id, inv.CreatedAt = int(id), now
+	return
+}
+
+// Invites gets the invites which were not used yet, oldest first
+func (sq *SQLite) Invites(ctx context.Context) (invites []Invite, err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	rows, err := sq.Db.QueryContext(ctx, "SELECT "+inviteColumns+" FROM invites WHERE used_at IS NULL ORDER BY created_at")
+	if err != nil {
+		return
+	}
+	return scanInvites(rows)
+}
+
+// CreateInvitedUser creates the user with the role of the invite with token and marks the invite used
+func (sq *SQLite) CreateInvitedUser(ctx context.Context, u *User, token string) (err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	tx, err := sq.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	now := time.Now()
+	statement := `UPDATE invites SET used_at = ?3
+WHERE token = ?1 AND used_at IS NULL AND expires_at > ?3 AND (email = '' OR lower(email) = lower(?2))`
+	res, err := tx.ExecContext(ctx, statement, token, u.Email, now)
+	if err != nil {
+		return
+	}
+	used, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if used == 0 {
+		return ErrInvalidInvite
+	}
+	var invite Invite
+	if err = scanInvite(tx.QueryRowContext(ctx, "SELECT "+inviteColumns+" FROM invites WHERE token = ?", token), &invite); err != nil {
+		return
+	}
+	res, err = tx.ExecContext(ctx, "INSERT INTO users (name, email, password, role, pending, email_verified_at, created_at) values (?, ?, ?, ?, ?, ?, ?)",
+		u.Name, u.Email, u.Password, invite.Role, u.Pending, nullTime(u.EmailVerifiedAt), now)
+	if err != nil {
+		return
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	u.Id, u.Role, u.CreatedAt = int(id), invite.Role, now
+	return
+}
+
+// DeleteInvite deletes the invite by id
+func (sq *SQLite) DeleteInvite(ctx context.Context, id int) (err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	_, err = sq.Db.ExecContext(ctx, "DELETE FROM invites WHERE id = ?", id)
+	return
+}
+
+// CreatePasswordReset returns a new password reset token for the user, its unused tokens are deleted
+func (sq *SQLite) CreatePasswordReset(ctx context.Context, u *User, expiresAt time.Time) (token string, err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	token, hash, err := newToken()
+	if err != nil {
+		return
+	}
+	tx, err := sq.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	if _, err = tx.ExecContext(ctx, "DELETE FROM password_resets WHERE user_id = ? AND used_at IS NULL", u.Id); err != nil {
+		return
+	}
+	if _, err = tx.ExecContext(ctx, "INSERT INTO password_resets (user_id, token_hash, expires_at, created_at) VALUES (?, ?, ?, ?)",
+		u.Id, hash, expiresAt, time.Now()); err != nil {
+		return
+	}
+	err = tx.Commit()
+	return
+}
+
+// PasswordReset gets the password reset of token if it can still be used
+func (sq *SQLite) PasswordReset(ctx context.Context, token string) (reset PasswordReset, err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	statement := "SELECT " + resetColumns + " FROM password_resets WHERE token_hash = ? AND used_at IS NULL AND expires_at > ?"
+	err = scanReset(sq.Db.QueryRowContext(ctx, statement, hashToken(token), time.Now()), &reset)
+	if err == sql.ErrNoRows {
+		err = ErrInvalidToken
+	}
+	return
+}
+
+// UsePasswordReset marks the password reset of token as used if it can still be used
+func (sq *SQLite) UsePasswordReset(ctx context.Context, token string) (reset PasswordReset, err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	tx, err := sq.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	hash := hashToken(token)
+	res, err := tx.ExecContext(ctx, "UPDATE password_resets SET used_at = ?2 WHERE token_hash = ?1 AND used_at IS NULL AND expires_at > ?2", hash, time.Now())
+	if err != nil {
+		return
+	}
+	used, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if used == 0 {
+		err = ErrInvalidToken
+		return
+	}
+	if err = scanReset(tx.QueryRowContext(ctx, "SELECT "+resetColumns+" FROM password_resets WHERE token_hash = ?", hash), &reset); err != nil {
+		return
+	}
+	err = tx.Commit()
+	return
+}
+
+// EnableTOTP sets the TOTP secret of the user and returns its new recovery
+// codes, ErrTwoFactorEnabled if the user has another secret than u
+func (sq *SQLite) EnableTOTP(ctx context.Context, u *User, secret string) (recoveryCodes []string, err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	tx, err := sq.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, "UPDATE users SET totp_secret = ?, totp_last_step = 0 WHERE id = ? AND totp_secret = ?", secret, u.Id, u.TOTPSecret)
+	if err != nil {
+		return
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if n == 0 {
+		return nil, ErrTwoFactorEnabled
+	}
+	if recoveryCodes, err = sq.replaceRecoveryCodes(ctx, tx, u); err != nil {
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	u.TOTPSecret = secret
+	return
+}
+
+// DisableTOTP removes the TOTP secret and the recovery codes of the user
+func (sq *SQLite) DisableTOTP(ctx context.Context, u *User) (err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	tx, err := sq.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	if _, err = tx.ExecContext(ctx, "UPDATE users SET totp_secret = '', totp_last_step = 0 WHERE id = ?", u.Id); err != nil {
+		return
+	}
+	if _, err = tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = ?", u.Id); err != nil {
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	u.TOTPSecret = ""
+	return
+}
+
+// UseTOTPStep records the time step of an accepted code, so that a code can't be used twice
+func (sq *SQLite) UseTOTPStep(ctx context.Context, u *User, step int64) (err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	res, err := sq.Db.ExecContext(ctx, "UPDATE users SET totp_last_step = ?2 WHERE id = ?1 AND totp_last_step < ?2", u.Id, step)
+	if err != nil {
+		return
+	}
+	used, err := res.RowsAffected()
+	if err == nil && used == 0 {
+		err = ErrInvalidToken
+	}
+	return
+}
+
+// CreateRecoveryCodes returns new recovery codes for the user, replacing its old ones
+func (sq *SQLite) CreateRecoveryCodes(ctx context.Context, u *User) (recoveryCodes []string, err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	tx, err := sq.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	if recoveryCodes, err = sq.replaceRecoveryCodes(ctx, tx, u); err != nil {
+		return
+	}
+	err = tx.Commit()
+	return
+}
+
+// replaceRecoveryCodes deletes the recovery codes of the user and creates new ones in tx
+func (sq *SQLite) replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, u *User) (recoveryCodes []string, err error) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return
+	}
+	if _, err = tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = ?", u.Id); err != nil {
+		return
+	}
+	now := time.Now()
+	for _, hash := range hashes {
+		if _, err = tx.ExecContext(ctx, "INSERT INTO recovery_codes (user_id, code_hash, created_at) VALUES (?, ?, ?)", u.Id, hash, now); err != nil {
+			return
+		}
+	}
+	return codes, nil
+}
+
+// UseRecoveryCode deletes the recovery code of the user
+func (sq *SQLite) UseRecoveryCode(ctx context.Context, u *User, code string) (err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	res, err := sq.Db.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = ? AND code_hash = ?", u.Id, hashRecoveryCode(code))
+	if err != nil {
+		return
+	}
+	used, err := res.RowsAffected()
+	if err == nil && used == 0 {
+		err = ErrInvalidToken
+	}
+	return
+}
+
+// RecoveryCodesLeft counts the unused recovery codes of the user
+func (sq *SQLite) RecoveryCodesLeft(ctx context.Context, u *User) (left int, err error) {
+	ctx, cancel := withTimeout(ctx, sq.QueryTimeout)
+	defer cancel()
+	err = sq.Db.QueryRowContext(ctx, "SELECT count(*) FROM recovery_codes WHERE user_id = ?", u.Id).Scan(&left)
+	return
+}
@@ -0,0 +1,77 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestSQLite opens a migrated SQLite database in a temporary directory
+func newTestSQLite(t *testing.T) *SQLite {
+	sq, err := NewSQLite(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err, "Cannot open database")
+	}
+	t.Cleanup(func() { sq.Db.Close() })
+	m, err := sq.Migrator()
+	if err != nil {
+		t.Fatal(err, "Cannot load migrations")
+	}
+	if _, err = m.Up(context.Background()); err != nil {
+		t.Fatal(err, "Cannot migrate database")
+	}
+	return sq
+}
+
+func Test_SQLiteStore(t *testing.T) {
+	sq := newTestSQLite(t)
+
+	users := newTestUsers()
+	user := users[1]
+	if err := sq.CreateUser(ctx, &user); err != nil {
+		t.Error(err, "Cannot create user.")
+	}
+	if user.Id == 0 || user.CreatedAt.IsZero() {
+		t.Errorf("No id or created_at in user")
+	}
+	duplicate := users[0]
+	duplicate.Email = user.Email
+	if err := sq.CreateUser(ctx, &duplicate); err == nil {
+		t.Error("User with duplicate email created.")
+	}
+
+	session, err := sq.CreateSession(ctx, &user, Device{})
+	if err != nil {
+		t.Error(err, "Cannot create session")
+	}
+	s := Session{Uuid: session.Uuid}
+	if err = sq.CheckSession(ctx, &s, SessionExpiry{}, time.Now()); err != nil || s.UserId != user.Id {
+		t.Error(err, "Cannot check session")
+	}
+	u, err := sq.SessionUser(ctx, &s)
+	if err != nil || u.Email != user.Email {
+		t.Error(err, "Cannot get user from session")
+	}
+
+	if err = sq.DeleteUser(ctx, &user); err != nil {
+		t.Error(err, "- Cannot delete user")
+	}
+	if err = sq.CheckSession(ctx, &s, SessionExpiry{}, time.Now()); err != sql.ErrNoRows {
+		t.Error(err, "- Session not deleted with user.")
+	}
+}
+
+func Test_SQLiteCanceledContext(t *testing.T) {
+	sq := newTestSQLite(t)
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := sq.Users(canceled); err == nil {
+		t.Error("Query run with canceled context")
+	}
+	sq.QueryTimeout = time.Nanosecond
+	if _, err := sq.Users(ctx); err == nil {
+		t.Error("Query run after timeout")
+	}
+}
@@ -1,174 +1,144 @@
 package data
 
 import (
+	"errors"
 	"time"
-
-	"github.com/satori/go.uuid"
-	"golang.org/x/crypto/bcrypt"
 )
 
 type User struct {
-	Id        int
-	Name      string
-	Email     string
-	Password  string
-	Role      string
-	CreatedAt time.Time
+	Id       int
+	Name     string
+	Email    string
+	Password string
+	Role     string
+	// Pending accounts can't sign in until an admin approves them
+	Pending bool
+	// EmailVerifiedAt is when the owner of Email confirmed it, zero if never
+	EmailVerifiedAt time.Time
+	// PendingEmail replaces Email once its owner confirms it
+	PendingEmail string
+	// FailedLogins counts consecutive failed logins since the last success or lockout
+	FailedLogins int
+	// LockedUntil is when the account lockout ends, zero if it was never locked
+	LockedUntil time.Time
+	// TOTPSecret is the base32 secret of two-factor authentication, empty if it is disabled
+	TOTPSecret string
+	CreatedAt  time.Time
 }
 
-type Session struct {
-	Id           int
-	Uuid         string
-	UserId       int
-	LastActivity time.Time
-	CreatedAt    time.Time
+// EmailVerified reports whether the owner of the email address confirmed it
+func (u User) EmailVerified() bool {
+	return !u.EmailVerifiedAt.IsZero()
 }
 
-// CreateSession creates a new session for existing user
-func (u *User) CreateSession() (session Session, err error) {
-	statement := "INSERT INTO sessions (uuid, user_id, last_activity, created_at) VALUES ($1, $2, $3, $4) RETURNING id, uuid, user_id, last_activity, created_at"
-	stmt, err := Db.Prepare(statement)
-	if err != nil {
-		return
-	}
-	defer stmt.Close()
-
-	// use QueryRow to return a row and scan the returned id into the Session struct
-	uuidV4, err := uuid.NewV4()
-	if err != nil {
-		return
-	}
-	err = stmt.QueryRow(uuidV4, u.Id, time.Now(), time.Now()).Scan(&session.Id, &session.Uuid, &session.UserId, &session.LastActivity, &session.CreatedAt)
-	return
+// TwoFactorEnabled reports whether signing in needs a TOTP or recovery code
+func (u User) TwoFactorEnabled() bool {
+	return u.TOTPSecret != ""
 }
 
-// Check if session is valid in the database
-func (s *Session) Check() (err error) {
-	err = Db.QueryRow("SELECT id, uuid, user_id, last_activity, created_at FROM sessions WHERE uuid = $1", s.Uuid).
-		Scan(&s.Id, &s.Uuid, &s.UserId, &s.LastActivity, &s.CreatedAt)
-	return
+// Locked reports whether logins to the account are refused at now
+func (u User) Locked(now time.Time) bool {
+	return now.Before(u.LockedUntil)
 }
 
-// User gets the user from the session
-func (s *Session) User() (user User, err error) {
-	user = User{}
-	err = Db.QueryRow("SELECT id, name, email, role, created_at FROM users WHERE id = $1", s.UserId).
-		Scan(&user.Id, &user.Name, &user.Email, &user.Role, &user.CreatedAt)
-	return
+// Invite lets its holder sign up once before it expires
+type Invite struct {
+	Id    int
+	Token string
+	// Email restricts the invite to an address unless it is empty
+	Email     string
+	Role      string
+	ExpiresAt time.Time
+	CreatedAt time.Time
 }
 
-// DeleteByUUID deletes session for database
-func (s *Session) DeleteByUUID() (err error) {
-	statement := "DELETE FROM sessions WHERE uuid = $1"
-	stmt, err := Db.Prepare(statement)
-	if err != nil {
-		return
-	}
-	defer stmt.Close()
-
-	_, err = stmt.Exec(s.Uuid)
-	return
+// PasswordReset lets a user set a new password once before it expires,
+// only a hash of its token is stored
+type PasswordReset struct {
+	Id        int
+	UserId    int
+	ExpiresAt time.Time
+	CreatedAt time.Time
 }
 
-// Delete all sessions from database
-func SessionDeleteAll() (err error) {
-	statement := "delete from sessions"
-	_, err = Db.Exec(statement)
-	return
+type Session struct {
+	Id     int
+	Uuid   string
+	UserId int
+	Device
+	LastActivity time.Time
+	// RotationDue is set when the privileges of the user changed, the
+	// session gets a new id on its next request
+	RotationDue bool
+	CreatedAt   time.Time
 }
 
-// CleanSessions removes expired sessions from the database
-func CleanSessions(sessionLength int) (err error) {
-	statement := "DELETE FROM sessions WHERE last_activity < $1"
-	_, err = Db.Exec(statement, time.Now().Add(-time.Second*time.Duration(sessionLength)))
-	return
+// UserSession is a session together with the user owning it
+type UserSession struct {
+	Session
+	User User
 }
 
-// Delete all users from database
-func UserDeleteAll() (err error) {
-	statement := "delete from users"
-	_, err = Db.Exec(statement)
-	return
+// Device describes the client a session was created from
+type Device struct {
+	UserAgent string
+	IPAddress string
+	Label     string // friendly name like "Firefox on Linux"
 }
 
-// Create a new user, save user info into database
-func (u *User) Create() (err error) {
-	// Postgres does not automatically return the last insert id, because it would be wrong to assume
-	// you're always using a sequence.You need to use the RETURNING keyword in your insert to get this
-	// information from postgres.
-	statement := "INSERT INTO users (name, email, password, role, created_at) values ($1, $2, $3, $4, $5) RETURNING id, created_at"
-	stmt, err := Db.Prepare(statement)
-	if err != nil {
-		return
-	}
-	defer stmt.Close()
+// ErrInvalidInvite is returned when an invite does not exist, was used or has expired
+var ErrInvalidInvite = errors.New("data: invalid invite")
 
-	// generate hash for user password
-	bs, err := bcrypt.GenerateFromPassword([]byte(u.Password), bcrypt.MinCost)
-	if err != nil {
-		return
-	}
-	// use QueryRow to return a row and scan the returned id into the User struct
-	err = stmt.QueryRow(u.Name, u.Email, string(bs), u.Role, time.Now()).
-		Scan(&u.Id, &u.CreatedAt)
-	return
-}
+// ErrInvalidToken is returned when a token does not exist, was used or has expired
+var ErrInvalidToken = errors.New("data: invalid or expired token")
 
-// Delete user from database
-func (u *User) Delete() (err error) {
-	statement := "delete from users where id = $1"
-	stmt, err := Db.Prepare(statement)
-	if err != nil {
-		return
-	}
-	defer stmt.Close()
+// ErrTokenTheft is returned when a remember token is used with a validator
+// which was replaced, so either its owner or a thief used a copy of it
+var ErrTokenTheft = errors.New("data: remember token used with an outdated validator")
 
-	_, err = stmt.Exec(u.Id)
-	return
-}
+// ErrTwoFactorEnabled is returned when the TOTP secret of a user is not the
+// one it is supposed to replace
+var ErrTwoFactorEnabled = errors.New("data: two-factor authentication is enabled already")
 
-// Update user information in the database
-func (u *User) Update() (err error) {
-	statement := "update users set name = $2, email = $3, password = $4, role = $5 where id = $1"
-	stmt, err := Db.Prepare(statement)
-	if err != nil {
-		return
-	}
-	defer stmt.Close()
+// ErrSessionExpired is returned when checking a session that is past its idle timeout or lifetime
+var ErrSessionExpired = errors.New("data: session expired")
 
-	_, err = stmt.Exec(u.Id, u.Name, u.Email, u.Password, u.Role)
-	return
+// SessionExpiry sets when sessions expire, zero durations do not limit sessions
+type SessionExpiry struct {
+	// Idle is how long a session lives without activity
+	Idle time.Duration
+	// Lifetime is how long a session lives since it was created regardless of activity
+	Lifetime time.Duration
 }
 
-// Session gets the session for an existing user
-func (u *User) Session() (session Session, err error) {
-	session = Session{}
-	err = Db.QueryRow("SELECT id, uuid, user_id, last_activity, created_at FROM sessions WHERE user_id = $1", u.Id).
-		Scan(&session.Id, &session.Uuid, &session.UserId, &session.LastActivity, &session.CreatedAt)
+// ExpiresAt returns the time the session expires unless it is touched before
+func (s *Session) ExpiresAt(expiry SessionExpiry) (at time.Time) {
+	if expiry.Idle > 0 {
+		at = s.LastActivity.Add(expiry.Idle)
+	}
+	if expiry.Lifetime > 0 {
+		if end := s.CreatedAt.Add(expiry.Lifetime); at.IsZero() || end.Before(at) {
+			at = end
+		}
+	}
 	return
 }
 
-// UserByEmail gets a single user by email
-func UserByEmail(email string) (user User, err error) {
-	user = User{}
-	err = Db.QueryRow("SELECT id, name, email, password, role, created_at FROM users WHERE email = $1", email).
-		Scan(&user.Id, &user.Name, &user.Email, &user.Password, &user.Role, &user.CreatedAt)
-	return
+// Expired reports if the session is expired at the given time
+func (s *Session) Expired(expiry SessionExpiry, now time.Time) bool {
+	at := s.ExpiresAt(expiry)
+	return !at.IsZero() && !now.Before(at)
 }
 
-// Users gets all users in the database and returns it
-func Users() (users []User, err error) {
-	rows, err := Db.Query("SELECT id, name, email, password, role, created_at FROM users")
-	if err != nil {
-		return
+// cutoffs returns the times sessions idle since or created before are expired,
+// a zero duration gives a time before any session
+func (expiry SessionExpiry) cutoffs(now time.Time) (idleSince, createdBefore time.Time) {
+	idleSince, createdBefore = time.Unix(0, 0), time.Unix(0, 0)
+	if expiry.Idle > 0 {
+		idleSince = now.Add(-expiry.Idle)
 	}
-	defer rows.Close()
-	for rows.Next() {
-		user := User{}
-		if err = rows.Scan(&user.Id, &user.Name, &user.Email, &user.Password, &user.Role, &user.CreatedAt); err != nil {
-			return
-		}
-		users = append(users, user)
+	if expiry.Lifetime > 0 {
+		createdBefore = now.Add(-expiry.Lifetime)
 	}
 	return
 }
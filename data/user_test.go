@@ -2,159 +2,775 @@ package data
 
 import (
 	"database/sql"
+	"strings"
 	"testing"
+	"time"
 )
 
 func Test_UserCreate(t *testing.T) {
-	setup()
-	if err := users[0].Create(); err != nil {
-		t.Error(err, "Cannot create user.")
-	}
-	if users[0].Id == 0 {
-		t.Errorf("No id or created_at in user")
-	}
-	u, err := UserByEmail(users[0].Email)
-	if err != nil {
-		t.Error(err, "User not created.")
-	}
-	if users[0].Email != u.Email {
-		t.Errorf("User retrieved is not the same as the one created.")
-	}
+	eachStore(t, func(t *testing.T) {
+		if err := store.CreateUser(ctx, &users[0]); err != nil {
+			t.Error(err, "Cannot create user.")
+		}
+		if users[0].Id == 0 {
+			t.Errorf("No id or created_at in user")
+		}
+		u, err := store.UserByEmail(ctx, users[0].Email)
+		if err != nil {
+			t.Error(err, "User not created.")
+		}
+		if users[0].Email != u.Email {
+			t.Errorf("User retrieved is not the same as the one created.")
+		}
+	})
 }
 
 func Test_UserDelete(t *testing.T) {
-	setup()
-	if err := users[0].Create(); err != nil {
-		t.Error(err, "Cannot create user.")
-	}
-	if err := users[0].Delete(); err != nil {
-		t.Error(err, "- Cannot delete user")
-	}
-	_, err := UserByEmail(users[0].Email)
-	if err != sql.ErrNoRows {
-		t.Error(err, "- User not deleted.")
-	}
+	eachStore(t, func(t *testing.T) {
+		if err := store.CreateUser(ctx, &users[0]); err != nil {
+			t.Error(err, "Cannot create user.")
+		}
+		if err := store.DeleteUser(ctx, &users[0]); err != nil {
+			t.Error(err, "- Cannot delete user")
+		}
+		_, err := store.UserByEmail(ctx, users[0].Email)
+		if err != sql.ErrNoRows {
+			t.Error(err, "- User not deleted.")
+		}
+	})
+}
+
+func Test_UserCreateDuplicateEmail(t *testing.T) {
+	eachStore(t, func(t *testing.T) {
+		if err := store.CreateUser(ctx, &users[0]); err != nil {
+			t.Error(err, "Cannot create user.")
+		}
+		duplicate := users[1]
+		duplicate.Email = users[0].Email
+		if err := store.CreateUser(ctx, &duplicate); err == nil {
+			t.Error("User with duplicate email created.")
+		}
+	})
+}
+
+func Test_UserDeleteCascade(t *testing.T) {
+	eachStore(t, func(t *testing.T) {
+		if err := store.CreateUser(ctx, &users[0]); err != nil {
+			t.Error(err, "Cannot create user.")
+		}
+		session, err := store.CreateSession(ctx, &users[0], Device{})
+		if err != nil {
+			t.Error(err, "Cannot create session")
+		}
+		if err := store.DeleteUser(ctx, &users[0]); err != nil {
+			t.Error(err, "- Cannot delete user")
+		}
+		s := Session{Uuid: session.Uuid}
+		if err = store.CheckSession(ctx, &s, SessionExpiry{}, time.Now()); err != sql.ErrNoRows {
+			t.Error(err, "- Session not deleted with user.")
+		}
+	})
 }
 
 func Test_UserUpdate(t *testing.T) {
-	setup()
-	if err := users[0].Create(); err != nil {
-		t.Error(err, "Cannot create user.")
-	}
-	users[0].Name = "Random User"
-	users[0].Email = "random Email"
-	if err := users[0].Update(); err != nil {
-		t.Error(err, "- Cannot update user")
-	}
-	u, err := UserByEmail(users[0].Email)
-	if err != nil {
-		t.Error(err, "- Cannot get user")
-	}
-	if u.Name != "Random User" && u.Email != "Random Email" {
-		t.Error(err, "- User not updated")
-	}
+	eachStore(t, func(t *testing.T) {
+		if err := store.CreateUser(ctx, &users[0]); err != nil {
+			t.Error(err, "Cannot create user.")
+		}
+		users[0].Name = "Random User"
+		users[0].Email = "random Email"
+		if err := store.UpdateUser(ctx, &users[0]); err != nil {
+			t.Error(err, "- Cannot update user")
+		}
+		u, err := store.UserByEmail(ctx, users[0].Email)
+		if err != nil {
+			t.Error(err, "- Cannot get user")
+		}
+		if u.Name != "Random User" && u.Email != "Random Email" {
+			t.Error(err, "- User not updated")
+		}
+	})
 }
 
 func Test_Users(t *testing.T) {
-	setup()
-	for _, user := range users {
-		if err := user.Create(); err != nil {
-			t.Error(err, "Cannot create user.")
+	eachStore(t, func(t *testing.T) {
+		for _, user := range users {
+			if err := store.CreateUser(ctx, &user); err != nil {
+				t.Error(err, "Cannot create user.")
+			}
+		}
+		u, err := store.Users(ctx)
+		if err != nil {
+			t.Error(err, "Cannot retrieve users.")
 		}
-	}
-	u, err := Users()
-	if err != nil {
-		t.Error(err, "Cannot retrieve users.")
-	}
-	if len(u) != 2 {
-		t.Error(err, "Wrong number of users retrieved")
-	}
-	if u[0].Email != users[0].Email {
-		t.Error(u[0], users[0], "Wrong user retrieved")
-	}
+		if len(u) != 2 {
+			t.Error(err, "Wrong number of users retrieved")
+		}
+		if u[0].Email != users[0].Email {
+			t.Error(u[0], users[0], "Wrong user retrieved")
+		}
+	})
 }
 
 func Test_CreateSession(t *testing.T) {
-	setup()
-	if err := users[0].Create(); err != nil {
-		t.Error(err, "Cannot create user.")
-	}
-	session, err := users[0].CreateSession()
-	if err != nil {
-		t.Error(err, "Cannot create session")
-	}
-	if session.UserId != users[0].Id {
-		t.Error("User not linked with session")
-	}
+	eachStore(t, func(t *testing.T) {
+		if err := store.CreateUser(ctx, &users[0]); err != nil {
+			t.Error(err, "Cannot create user.")
+		}
+		session, err := store.CreateSession(ctx, &users[0], Device{})
+		if err != nil {
+			t.Error(err, "Cannot create session")
+		}
+		if session.UserId != users[0].Id {
+			t.Error("User not linked with session")
+		}
+	})
 }
 
 func Test_GetSession(t *testing.T) {
-	setup()
-	if err := users[0].Create(); err != nil {
-		t.Error(err, "Cannot create user.")
-	}
-	session, err := users[0].CreateSession()
-	if err != nil {
-		t.Error(err, "Cannot create session")
-	}
-
-	s, err := users[0].Session()
-	if err != nil {
-		t.Error(err, "Cannot get session")
-	}
-	if s.Id == 0 {
-		t.Error("No session retrieved")
-	}
-	if s.Id != session.Id {
-		t.Error("Different session retrieved")
-	}
+	eachStore(t, func(t *testing.T) {
+		if err := store.CreateUser(ctx, &users[0]); err != nil {
+			t.Error(err, "Cannot create user.")
+		}
+		session, err := store.CreateSession(ctx, &users[0], Device{})
+		if err != nil {
+			t.Error(err, "Cannot create session")
+		}
+
+		s, err := store.UserSession(ctx, &users[0])
+		if err != nil {
+			t.Error(err, "Cannot get session")
+		}
+		if s.Id == 0 {
+			t.Error("No session retrieved")
+		}
+		if s.Id != session.Id {
+			t.Error("Different session retrieved")
+		}
+	})
 }
 
 func Test_checkValidSession(t *testing.T) {
-	setup()
-	if err := users[0].Create(); err != nil {
-		t.Error(err, "Cannot create user.")
-	}
-	session, err := users[0].CreateSession()
-	if err != nil {
-		t.Error(err, "Cannot create session")
-	}
+	eachStore(t, func(t *testing.T) {
+		if err := store.CreateUser(ctx, &users[0]); err != nil {
+			t.Error(err, "Cannot create user.")
+		}
+		session, err := store.CreateSession(ctx, &users[0], Device{})
+		if err != nil {
+			t.Error(err, "Cannot create session")
+		}
 
-	uuid := session.Uuid
+		uuid := session.Uuid
 
-	s := Session{Uuid: uuid}
-	err = s.Check()
-	if err != nil {
-		t.Error(err, "Cannot check session")
-	}
+		s := Session{Uuid: uuid}
+		err = store.CheckSession(ctx, &s, SessionExpiry{}, time.Now())
+		if err != nil {
+			t.Error(err, "Cannot check session")
+		}
+	})
 }
 
 func Test_checkInvalidSession(t *testing.T) {
-	setup()
-	s := Session{Uuid: "123"}
-	err := s.Check()
-	if err == nil {
-		t.Error(err, "Session is not valid but is validated")
-	}
+	eachStore(t, func(t *testing.T) {
+		s := Session{Uuid: "123"}
+		err := store.CheckSession(ctx, &s, SessionExpiry{}, time.Now())
+		if err == nil {
+			t.Error(err, "Session is not valid but is validated")
+		}
+	})
 }
 
 func Test_DeleteSession(t *testing.T) {
-	setup()
-	if err := users[0].Create(); err != nil {
-		t.Error(err, "Cannot create user.")
-	}
-	session, err := users[0].CreateSession()
-	if err != nil {
-		t.Error(err, "Cannot create session")
-	}
-
-	err = session.DeleteByUUID()
-	if err != nil {
-		t.Error(err, "Cannot delete session")
-	}
-	s := Session{Uuid: session.Uuid}
-	err = s.Check()
-	if err == nil {
-		t.Error(err, "Session is not deleted")
-	}
+	eachStore(t, func(t *testing.T) {
+		if err := store.CreateUser(ctx, &users[0]); err != nil {
+			t.Error(err, "Cannot create user.")
+		}
+		session, err := store.CreateSession(ctx, &users[0], Device{})
+		if err != nil {
+			t.Error(err, "Cannot create session")
+		}
+
+		err = store.DeleteSessionByUUID(ctx, &session)
+		if err != nil {
+			t.Error(err, "Cannot delete session")
+		}
+		s := Session{Uuid: session.Uuid}
+		err = store.CheckSession(ctx, &s, SessionExpiry{}, time.Now())
+		if err == nil {
+			t.Error(err, "Session is not deleted")
+		}
+	})
+}
+
+func Test_RotateSession(t *testing.T) {
+	eachStore(t, func(t *testing.T) {
+		if err := store.CreateUser(ctx, &users[0]); err != nil {
+			t.Fatal(err, "Cannot create user.")
+		}
+		session, err := store.CreateSession(ctx, &users[0], Device{Label: "Firefox"})
+		if err != nil {
+			t.Fatal(err, "Cannot create session")
+		}
+		if err = store.RotateUserSessions(ctx, &users[0]); err != nil {
+			t.Fatal(err, "Cannot flag sessions")
+		}
+		flagged := Session{Uuid: session.Uuid}
+		if err = store.CheckSession(ctx, &flagged, SessionExpiry{}, time.Now()); err != nil || !flagged.RotationDue {
+			t.Fatalf("Session not due for rotation: %v", err)
+		}
+
+		rotated := flagged
+		if err = store.RotateSession(ctx, &rotated); err != nil {
+			t.Fatal(err, "Cannot rotate session")
+		}
+		if rotated.Uuid == session.Uuid || rotated.RotationDue {
+			t.Errorf("Session not rotated: %+v", rotated)
+		}
+		if err = store.CheckSession(ctx, &Session{Uuid: session.Uuid}, SessionExpiry{}, time.Now()); err == nil {
+			t.Error("Old session id still valid")
+		}
+		s := Session{Uuid: rotated.Uuid}
+		if err = store.CheckSession(ctx, &s, SessionExpiry{}, time.Now()); err != nil || s.Id != session.Id || s.Label != "Firefox" || s.RotationDue {
+			t.Errorf("Rotated session not kept: %+v, %v", s, err)
+		}
+		if err = store.RotateSession(ctx, &Session{Uuid: session.Uuid}); err == nil {
+			t.Error("Rotated an unknown session")
+		}
+	})
+}
+
+func Test_RevokeSessions(t *testing.T) {
+	eachStore(t, func(t *testing.T) {
+		now := time.Now()
+		if err := store.RevokeSessions(ctx, []string{"expiring", "lasting"}, now.Add(time.Hour)); err != nil {
+			t.Fatal(err, "Cannot revoke sessions")
+		}
+		// revoking again keeps the first expiry
+		if err := store.RevokeSessions(ctx, []string{"lasting"}, now.Add(3*time.Hour)); err != nil {
+			t.Fatal(err, "Cannot revoke sessions again")
+		}
+		if err := store.RevokeSessions(ctx, []string{"forever"}, time.Time{}); err != nil {
+			t.Fatal(err, "Cannot revoke session")
+		}
+		for uuid, want := range map[string]bool{"expiring": true, "lasting": true, "forever": true, "valid": false} {
+			if revoked, err := store.SessionRevoked(ctx, uuid); err != nil || revoked != want {
+				t.Errorf("Session %s revoked is %v, want %v: %v", uuid, revoked, want, err)
+			}
+		}
+
+		cleaned, err := store.CleanRevocations(ctx, now.Add(2*time.Hour))
+		if err != nil || cleaned != 2 {
+			t.Errorf("Cleaned %d revocations, want 2: %v", cleaned, err)
+		}
+		if revoked, _ := store.SessionRevoked(ctx, "lasting"); revoked {
+			t.Error("Expired revocation kept")
+		}
+		if revoked, _ := store.SessionRevoked(ctx, "forever"); !revoked {
+			t.Error("Revocation without expiry cleaned")
+		}
+	})
+}
+
+func Test_SessionExpired(t *testing.T) {
+	eachStore(t, func(t *testing.T) {
+		now := time.Now()
+		s := Session{LastActivity: now.Add(-time.Minute), CreatedAt: now.Add(-time.Hour)}
+		tests := []struct {
+			expiry  SessionExpiry
+			expired bool
+		}{
+			{SessionExpiry{}, false},
+			{SessionExpiry{Idle: 2 * time.Minute}, false},
+			{SessionExpiry{Idle: 30 * time.Second}, true},
+			{SessionExpiry{Idle: 2 * time.Minute, Lifetime: 2 * time.Hour}, false},
+			{SessionExpiry{Idle: 2 * time.Minute, Lifetime: 30 * time.Minute}, true},
+		}
+		for _, test := range tests {
+			if expired := s.Expired(test.expiry, now); expired != test.expired {
+				t.Errorf("Session expired is %v with %+v, want %v", expired, test.expiry, test.expired)
+			}
+		}
+	})
+}
+
+func Test_TouchSession(t *testing.T) {
+	eachStore(t, func(t *testing.T) {
+		if err := store.CreateUser(ctx, &users[0]); err != nil {
+			t.Error(err, "Cannot create user.")
+		}
+		session, err := store.CreateSession(ctx, &users[0], Device{})
+		if err != nil {
+			t.Error(err, "Cannot create session")
+		}
+		// the times are far enough apart for the precision of any database
+		expiry := SessionExpiry{Idle: time.Hour}
+		idle := session.LastActivity.Add(2 * time.Hour)
+		if err = store.CheckSession(ctx, &Session{Uuid: session.Uuid}, expiry, idle); err != ErrSessionExpired {
+			t.Error(err, "- Idle session is not expired")
+		}
+		if err = store.TouchSession(ctx, &session, idle.Add(-time.Minute)); err != nil {
+			t.Error(err, "Cannot touch session")
+		}
+		if err = store.CheckSession(ctx, &Session{Uuid: session.Uuid}, expiry, idle); err != nil {
+			t.Error(err, "- Touched session is expired")
+		}
+
+		if cleaned, err := store.CleanSessions(ctx, expiry, idle); err != nil || cleaned != 0 {
+			t.Errorf("Cleaned %d touched sessions, err %v", cleaned, err)
+		}
+		cleaned, err := store.CleanSessions(ctx, expiry, idle.Add(time.Hour))
+		if err != nil {
+			t.Error(err, "Cannot clean sessions")
+		}
+		if cleaned != 1 {
+			t.Errorf("Cleaned %d sessions, want 1", cleaned)
+		}
+		if err = store.CheckSession(ctx, &Session{Uuid: session.Uuid}, SessionExpiry{}, time.Now()); err != sql.ErrNoRows {
+			t.Error(err, "- Expired session is not cleaned")
+		}
+	})
+}
+
+func Test_UserSessions(t *testing.T) {
+	eachStore(t, func(t *testing.T) {
+		for i := range users {
+			if err := store.CreateUser(ctx, &users[i]); err != nil {
+				t.Error(err, "Cannot create user.")
+			}
+		}
+		device := Device{UserAgent: "curl/7.58.0", IPAddress: "127.0.0.1", Label: "Unknown device"}
+		first, _ := store.CreateSession(ctx, &users[0], device)
+		second, _ := store.CreateSession(ctx, &users[0], device)
+		third, _ := store.CreateSession(ctx, &users[0], device)
+		other, _ := store.CreateSession(ctx, &users[1], device)
+
+		sessions, err := store.UserSessions(ctx, &users[0])
+		if err != nil {
+			t.Error(err, "Cannot get sessions")
+		}
+		if len(sessions) != 3 {
+			t.Errorf("Retrieved %d sessions, want 3", len(sessions))
+		}
+		if sessions[0].Device != device {
+			t.Errorf("Device not stored with session: %+v", sessions[0].Device)
+		}
+
+		// sessions of other users are not deleted by id
+		if err = store.DeleteUserSession(ctx, &users[0], other.Id); err != nil {
+			t.Error(err, "Cannot delete session")
+		}
+		if err = store.CheckSession(ctx, &other, SessionExpiry{}, time.Now()); err != nil {
+			t.Error(err, "- Session of another user deleted")
+		}
+		if err = store.DeleteUserSession(ctx, &users[0], first.Id); err != nil {
+			t.Error(err, "Cannot delete session")
+		}
+		if err = store.CheckSession(ctx, &first, SessionExpiry{}, time.Now()); err != sql.ErrNoRows {
+			t.Error(err, "- Session not deleted")
+		}
+
+		if err = store.DeleteUserSessions(ctx, &users[0], second.Uuid); err != nil {
+			t.Error(err, "Cannot delete sessions")
+		}
+		if err = store.CheckSession(ctx, &third, SessionExpiry{}, time.Now()); err != sql.ErrNoRows {
+			t.Error(err, "- Session not deleted")
+		}
+		if err = store.CheckSession(ctx, &second, SessionExpiry{}, time.Now()); err != nil {
+			t.Error(err, "- Kept session deleted")
+		}
+		if err = store.CheckSession(ctx, &other, SessionExpiry{}, time.Now()); err != nil {
+			t.Error(err, "- Session of another user deleted")
+		}
+	})
+}
+
+func Test_Sessions(t *testing.T) {
+	eachStore(t, func(t *testing.T) {
+		for i := range users {
+			if err := store.CreateUser(ctx, &users[i]); err != nil {
+				t.Error(err, "Cannot create user.")
+			}
+			if _, err := store.CreateSession(ctx, &users[i], Device{}); err != nil {
+				t.Error(err, "Cannot create session")
+			}
+		}
+		sessions, err := store.Sessions(ctx, 0)
+		if err != nil {
+			t.Error(err, "Cannot get sessions")
+		}
+		if len(sessions) != 2 {
+			t.Errorf("Retrieved %d sessions, want 2", len(sessions))
+		}
+		sessions, err = store.Sessions(ctx, users[1].Id)
+		if err != nil {
+			t.Error(err, "Cannot get sessions")
+		}
+		if len(sessions) != 1 || sessions[0].User.Email != users[1].Email {
+			t.Errorf("Sessions not filtered by user: %+v", sessions)
+		}
+	})
+}
+
+func Test_LoginFailed(t *testing.T) {
+	eachStore(t, func(t *testing.T) {
+		if err := store.CreateUser(ctx, &users[0]); err != nil {
+			t.Error(err, "Cannot create user.")
+		}
+		for i := 1; i < 3; i++ {
+			if err := store.LoginFailed(ctx, &users[0], 3, time.Minute); err != nil {
+				t.Fatal(err, "Cannot record failed login")
+			}
+			if users[0].FailedLogins != i || users[0].Locked(time.Now()) {
+				t.Errorf("After %d failures: %d failed logins, locked until %v", i, users[0].FailedLogins, users[0].LockedUntil)
+			}
+		}
+		if err := store.LoginFailed(ctx, &users[0], 3, time.Minute); err != nil {
+			t.Fatal(err, "Cannot record failed login")
+		}
+		u, err := store.UserByEmail(ctx, users[0].Email)
+		if err != nil {
+			t.Fatal(err, "Cannot get user")
+		}
+		if !u.Locked(time.Now()) || u.Locked(time.Now().Add(2*time.Minute)) || u.FailedLogins != 0 {
+			t.Errorf("User not locked for a minute: %d failed logins, locked until %v", u.FailedLogins, u.LockedUntil)
+		}
+
+		if err = store.UnlockUser(ctx, &u); err != nil {
+			t.Fatal(err, "Cannot unlock user")
+		}
+		if u, _ = store.UserByEmail(ctx, users[0].Email); u.Locked(time.Now()) {
+			t.Error("User not unlocked")
+		}
+	})
+}
+
+func Test_UserPending(t *testing.T) {
+	eachStore(t, func(t *testing.T) {
+		users[0].Pending = true
+		defer func() { users[0].Pending = false }()
+		if err := store.CreateUser(ctx, &users[0]); err != nil {
+			t.Error(err, "Cannot create user.")
+		}
+		u, _ := store.UserByEmail(ctx, users[0].Email)
+		if !u.Pending {
+			t.Error("User is not pending")
+		}
+		u.Pending = false
+		if err := store.UpdateUser(ctx, &u); err != nil {
+			t.Error(err, "Cannot update user.")
+		}
+		if u, _ = store.UserByEmail(ctx, users[0].Email); u.Pending {
+			t.Error("User was not approved")
+		}
+	})
+}
+
+func Test_Invites(t *testing.T) {
+	eachStore(t, func(t *testing.T) {
+		anyone := Invite{Role: "user", ExpiresAt: time.Now().Add(time.Hour)}
+		bound := Invite{Email: "Peter@gmail.com", Role: "admin", ExpiresAt: time.Now().Add(time.Hour)}
+		expired := Invite{Role: "user", ExpiresAt: time.Now().Add(-time.Second)}
+		for _, inv := range []*Invite{&anyone, &bound, &expired} {
+			if err := store.CreateInvite(ctx, inv); err != nil {
+				t.Fatal(err, "Cannot create invite")
+			}
+			defer store.DeleteInvite(ctx, inv.Id)
+		}
+		if anyone.Token == "" || anyone.Token == bound.Token {
+			t.Error("Invites have no unique tokens")
+		}
+
+		invites, err := store.Invites(ctx)
+		if err != nil || len(invites) != 3 {
+			t.Errorf("%d invites listed, want 3: %v", len(invites), err)
+		}
+
+		john := User{Name: "John", Email: "john@gmail.com", Password: "pass", Role: "user"}
+		if err = store.CreateInvitedUser(ctx, &john, expired.Token); err != ErrInvalidInvite {
+			t.Error(err, "- Expired invite used")
+		}
+		if err = store.CreateInvitedUser(ctx, &john, bound.Token); err != ErrInvalidInvite {
+			t.Error(err, "- Invite used with another email")
+		}
+		peter := User{Name: "Peter", Email: "peter@gmail.com", Password: "pass", Role: "user"}
+		if err = store.CreateInvitedUser(ctx, &peter, bound.Token); err != nil || peter.Id == 0 || peter.Role != "admin" {
+			t.Error(err, "- Cannot use invite")
+		}
+		defer store.DeleteUser(ctx, &peter)
+		if created, err := store.UserByEmail(ctx, peter.Email); err != nil || created.Role != "admin" {
+			t.Error(err, "- User not created with the role of the invite")
+		}
+		other := User{Name: "Peter", Email: "peter@gmail.com", Password: "pass", Role: "user"}
+		if err = store.CreateInvitedUser(ctx, &other, bound.Token); err != ErrInvalidInvite {
+			t.Error(err, "- Invite used twice")
+		}
+
+		// the invite stays unused if the user can't be created
+		if err = store.CreateInvitedUser(ctx, &other, anyone.Token); err == nil {
+			t.Error("User created twice")
+		}
+		if invites, _ = store.Invites(ctx); len(invites) != 2 {
+			t.Errorf("Invite used by a failed signup: %v", invites)
+		}
+
+		if err = store.DeleteInvite(ctx, anyone.Id); err != nil {
+			t.Error(err, "Cannot delete invite")
+		}
+		if err = store.CreateInvitedUser(ctx, &john, anyone.Token); err != ErrInvalidInvite {
+			t.Error(err, "- Deleted invite used")
+		}
+		if invites, _ = store.Invites(ctx); len(invites) != 1 || invites[0].Id != expired.Id {
+			t.Errorf("Invites listed after use: %v", invites)
+		}
+	})
+}
+
+func Test_UserById(t *testing.T) {
+	eachStore(t, func(t *testing.T) {
+		if err := store.CreateUser(ctx, &users[0]); err != nil {
+			t.Error(err, "Cannot create user.")
+		}
+		u, err := store.UserById(ctx, users[0].Id)
+		if err != nil || u.Email != users[0].Email {
+			t.Error(err, "Cannot get user by id")
+		}
+		if _, err = store.UserById(ctx, users[0].Id+1000); err != sql.ErrNoRows {
+			t.Error(err, "- Missing user found")
+		}
+	})
+}
+
+func Test_PasswordReset(t *testing.T) {
+	eachStore(t, func(t *testing.T) {
+		if err := store.CreateUser(ctx, &users[0]); err != nil {
+			t.Error(err, "Cannot create user.")
+		}
+		replaced, err := store.CreatePasswordReset(ctx, &users[0], time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err, "Cannot create password reset")
+		}
+		token, err := store.CreatePasswordReset(ctx, &users[0], time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err, "Cannot create password reset")
+		}
+		if _, err = store.PasswordReset(ctx, replaced); err != ErrInvalidToken {
+			t.Error(err, "- Replaced token is valid")
+		}
+
+		reset, err := store.PasswordReset(ctx, token)
+		if err != nil || reset.UserId != users[0].Id {
+			t.Error(err, "Cannot check password reset")
+		}
+		if reset, err = store.UsePasswordReset(ctx, token); err != nil || reset.UserId != users[0].Id {
+			t.Error(err, "Cannot use password reset")
+		}
+		if _, err = store.UsePasswordReset(ctx, token); err != ErrInvalidToken {
+			t.Error(err, "- Token used twice")
+		}
+
+		expired, err := store.CreatePasswordReset(ctx, &users[0], time.Now().Add(-time.Second))
+		if err != nil {
+			t.Fatal(err, "Cannot create password reset")
+		}
+		if _, err = store.UsePasswordReset(ctx, expired); err != ErrInvalidToken {
+			t.Error(err, "- Expired token used")
+		}
+	})
+}
+
+func Test_RememberTokens(t *testing.T) {
+	eachStore(t, func(t *testing.T) {
+		if err := store.CreateUser(ctx, &users[0]); err != nil {
+			t.Error(err, "Cannot create user.")
+		}
+		session, err := store.CreateSession(ctx, &users[0], Device{})
+		if err != nil {
+			t.Fatal(err, "Cannot create session")
+		}
+		token, err := store.CreateRememberToken(ctx, &session, time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err, "Cannot create remember token")
+		}
+
+		restored, next, err := store.RestoreSession(ctx, token, Device{Label: "Firefox"})
+		if err != nil || restored.UserId != users[0].Id || restored.Uuid == session.Uuid || restored.Label != "Firefox" {
+			t.Fatal(err, "Cannot restore session")
+		}
+		if next == token || strings.Split(next, ".")[0] != strings.Split(token, ".")[0] {
+			t.Errorf("Token %s not rotated to a new validator: %s", token, next)
+		}
+		if err = store.CheckSession(ctx, &Session{Uuid: restored.Uuid}, SessionExpiry{}, time.Now()); err != nil {
+			t.Error(err, "Restored session not stored")
+		}
+
+		// concurrent requests may still send the replaced validator
+		concurrent, none, err := store.RestoreSession(ctx, token, Device{})
+		if err != nil || concurrent.UserId != users[0].Id || none != "" {
+			t.Errorf("Replaced token gave %v and token %q", err, none)
+		}
+
+		// a validator replaced before the last one gives the theft away and forgets the user everywhere
+		other, err := store.CreateRememberToken(ctx, &session, time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err, "Cannot create remember token")
+		}
+		_, last, err := store.RestoreSession(ctx, next, Device{})
+		if err != nil {
+			t.Fatal(err, "Cannot restore session again")
+		}
+		if stolen, _, err := store.RestoreSession(ctx, token, Device{}); err != ErrTokenTheft || stolen.UserId != users[0].Id {
+			t.Errorf("Replaced token gave %v for user %d, want theft of user %d", err, stolen.UserId, users[0].Id)
+		}
+		for _, tok := range []string{last, other} {
+			if _, _, err = store.RestoreSession(ctx, tok, Device{}); err != ErrInvalidToken {
+				t.Error(err, "- Token kept after theft")
+			}
+		}
+		for _, tok := range []string{"", "garbage", "unknown.validator"} {
+			if _, _, err = store.RestoreSession(ctx, tok, Device{}); err != ErrInvalidToken {
+				t.Errorf("Token %q gave %v", tok, err)
+			}
+		}
+
+		// tokens go with the session they restored
+		token, _ = store.CreateRememberToken(ctx, &session, time.Now().Add(time.Hour))
+		kept, _ := store.CreateRememberToken(ctx, &restored, time.Now().Add(time.Hour))
+		if err = store.DeleteSessionRememberToken(ctx, &session); err != nil {
+			t.Error(err, "Cannot delete remember token")
+		}
+		if _, _, err = store.RestoreSession(ctx, token, Device{}); err != ErrInvalidToken {
+			t.Error(err, "- Token of deleted session used")
+		}
+		dropped, _ := store.CreateRememberToken(ctx, &session, time.Now().Add(time.Hour))
+		if err = store.DeleteUserRememberTokens(ctx, &users[0], restored.Id); err != nil {
+			t.Error(err, "Cannot delete remember tokens")
+		}
+		if _, _, err = store.RestoreSession(ctx, dropped, Device{}); err != ErrInvalidToken {
+			t.Error(err, "- Token of other session used")
+		}
+		if _, _, err = store.RestoreSession(ctx, kept, Device{}); err != nil {
+			t.Error(err, "Token of excepted session deleted")
+		}
+
+		expired, _ := store.CreateRememberToken(ctx, &session, time.Now().Add(-time.Second))
+		if _, _, err = store.RestoreSession(ctx, expired, Device{}); err != ErrInvalidToken {
+			t.Error(err, "- Expired token used")
+		}
+		if cleaned, err := store.CleanRememberTokens(ctx, time.Now()); err != nil || cleaned != 1 {
+			t.Errorf("Cleaned %d remember tokens, want 1: %v", cleaned, err)
+		}
+	})
+}
+
+func Test_Identities(t *testing.T) {
+	eachStore(t, func(t *testing.T) {
+		if err := store.CreateUser(ctx, &users[0]); err != nil {
+			t.Error(err, "Cannot create user.")
+		}
+		if _, err := store.IdentityUser(ctx, "corp", "peter"); err != sql.ErrNoRows {
+			t.Error(err, "- Unlinked identity found")
+		}
+		if err := store.LinkIdentity(ctx, &users[0], "corp", "peter"); err != nil {
+			t.Fatal(err, "Cannot link identity")
+		}
+		if err := store.LinkIdentity(ctx, &users[0], "corp", "peter"); err == nil {
+			t.Error("Identity linked twice")
+		}
+		if user, err := store.IdentityUser(ctx, "corp", "peter"); err != nil || user.Email != users[0].Email {
+			t.Error(err, "Cannot find user of identity")
+		}
+		// subjects are unique per provider only
+		if _, err := store.IdentityUser(ctx, "other", "peter"); err != sql.ErrNoRows {
+			t.Error(err, "- Identity found at another provider")
+		}
+
+		if err := store.DeleteUser(ctx, &users[0]); err != nil {
+			t.Error(err, "Cannot delete user")
+		}
+		if _, err := store.IdentityUser(ctx, "corp", "peter"); err != sql.ErrNoRows {
+			t.Error(err, "- Identity not deleted with user")
+		}
+	})
+}
+
+func Test_UserEmailVerification(t *testing.T) {
+	eachStore(t, func(t *testing.T) {
+		if err := store.CreateUser(ctx, &users[0]); err != nil {
+			t.Error(err, "Cannot create user.")
+		}
+		u, _ := store.UserByEmail(ctx, users[0].Email)
+		if u.EmailVerified() || u.PendingEmail != "" {
+			t.Error("New user has a verified email")
+		}
+		u.EmailVerifiedAt, u.PendingEmail = time.Now(), "new@gmail.com"
+		if err := store.UpdateUser(ctx, &u); err != nil {
+			t.Error(err, "Cannot update user.")
+		}
+		if u, _ = store.UserByEmail(ctx, users[0].Email); !u.EmailVerified() || u.PendingEmail != "new@gmail.com" {
+			t.Errorf("Verification not stored: verified at %v, pending email %q", u.EmailVerifiedAt, u.PendingEmail)
+		}
+	})
+}
+
+func Test_TwoFactor(t *testing.T) {
+	eachStore(t, func(t *testing.T) {
+		if err := store.CreateUser(ctx, &users[0]); err != nil {
+			t.Error(err, "Cannot create user.")
+		}
+		codes, err := store.EnableTOTP(ctx, &users[0], "JBSWY3DPEHPK3PXP")
+		if err != nil || len(codes) != RecoveryCodeCount {
+			t.Fatal(err, "Cannot enable TOTP")
+		}
+		if u, _ := store.UserById(ctx, users[0].Id); !u.TwoFactorEnabled() || u.TOTPSecret != "JBSWY3DPEHPK3PXP" {
+			t.Errorf("TOTP secret is %q", u.TOTPSecret)
+		}
+		// a user read without the secret can't replace it
+		stale := users[0]
+		stale.TOTPSecret = ""
+		if _, err = store.EnableTOTP(ctx, &stale, "KRSXG5CTMVRXEZLU"); err != ErrTwoFactorEnabled {
+			t.Error(err, "- TOTP secret replaced without the current one")
+		}
+
+		if err = store.UseTOTPStep(ctx, &users[0], 100); err != nil {
+			t.Error(err, "Cannot use TOTP step")
+		}
+		for _, step := range []int64{100, 99} {
+			if err = store.UseTOTPStep(ctx, &users[0], step); err != ErrInvalidToken {
+				t.Error(err, "- TOTP step", step, "used after 100")
+			}
+		}
+
+		// codes are accepted in any case and without the dash
+		if err = store.UseRecoveryCode(ctx, &users[0], strings.ToUpper(strings.Replace(codes[0], "-", "", 1))); err != nil {
+			t.Error(err, "Cannot use recovery code")
+		}
+		if err = store.UseRecoveryCode(ctx, &users[0], codes[0]); err != ErrInvalidToken {
+			t.Error(err, "- Recovery code used twice")
+		}
+		if left, err := store.RecoveryCodesLeft(ctx, &users[0]); err != nil || left != RecoveryCodeCount-1 {
+			t.Error(err, "- Recovery codes left:", left)
+		}
+
+		replaced, err := store.CreateRecoveryCodes(ctx, &users[0])
+		if err != nil || len(replaced) != RecoveryCodeCount {
+			t.Fatal(err, "Cannot create recovery codes")
+		}
+		if err = store.UseRecoveryCode(ctx, &users[0], codes[1]); err != ErrInvalidToken {
+			t.Error(err, "- Replaced recovery code used")
+		}
+
+		if _, err = store.EnableTOTP(ctx, &users[0], "KRSXG5CTMVRXEZLU"); err != nil || users[0].TOTPSecret != "KRSXG5CTMVRXEZLU" {
+			t.Error(err, "Cannot replace TOTP secret")
+		}
+
+		if err = store.DisableTOTP(ctx, &users[0]); err != nil {
+			t.Error(err, "Cannot disable TOTP")
+		}
+		if u, _ := store.UserById(ctx, users[0].Id); u.TwoFactorEnabled() {
+			t.Error("TOTP still enabled")
+		}
+		if left, _ := store.RecoveryCodesLeft(ctx, &users[0]); left != 0 {
+			t.Error("Recovery codes left after disabling TOTP:", left)
+		}
+	})
 }
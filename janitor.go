@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/bakhtik/webapp_template/data"
+)
+
+// janitorLock makes a single instance of a cluster clean the sessions
+const janitorLock = "session-janitor"
+
+// startJanitor removes expired sessions every interval until ctx is canceled.
+// The returned channel is closed once the janitor has stopped.
+func (s *server) startJanitor(ctx context.Context, interval time.Duration) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var unlock func()
+		defer func() {
+			if unlock != nil {
+				unlock()
+			}
+		}()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if unlock == nil {
+					unlock = s.janitorLeader(ctx)
+					if unlock == nil {
+						continue
+					}
+				}
+				s.sweep(ctx)
+			}
+		}
+	}()
+	return done
+}
+
+// janitorLeader takes the janitor lock if the store supports it, the lock is
+// kept until shutdown so that the other instances skip their sweeps.
+// It returns nil if the lock is held by another instance.
+func (s *server) janitorLeader(ctx context.Context) (unlock func()) {
+	locker, ok := s.sessions.(data.Locker)
+	if !ok {
+		return func() {}
+	}
+	unlock, ok, err := locker.TryLock(ctx, janitorLock)
+	if err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot take session janitor lock")
+		return nil
+	}
+	if !ok {
+		return nil
+	}
+	logger.SetPrefix("INFO ")
+	logger.Println("Session janitor is running on this instance")
+	return unlock
+}
+
+// sweep cleans expired sessions and remember tokens once, a panic is logged instead of stopping the janitor
+func (s *server) sweep(ctx context.Context) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.SetPrefix("ERROR ")
+			logger.Println(fmt.Errorf("%v", r), "Session janitor panicked")
+		}
+	}()
+	cleaned, err := s.cleanSessions(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			logger.SetPrefix("ERROR ")
+			logger.Println(err, "Cannot clean sessions")
+		}
+		return
+	}
+	logger.SetPrefix("INFO ")
+	logger.Printf("Session janitor removed %d expired session(s)", cleaned)
+	if cleaned, err = s.remember.CleanRememberTokens(ctx, time.Now()); err != nil {
+		if ctx.Err() == nil {
+			logger.SetPrefix("ERROR ")
+			logger.Println(err, "Cannot clean remember tokens")
+		}
+		return
+	}
+	logger.SetPrefix("INFO ")
+	logger.Printf("Session janitor removed %d expired remember token(s)", cleaned)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bakhtik/webapp_template/data"
+)
+
+func TestJanitor(t *testing.T) {
+	defer func(c Configuration) { config = c }(config)
+	config.SessionLength, config.SessionLifetime = 1, 0
+
+	store := data.NewMemory()
+	s := &server{users: store, sessions: store, remember: store}
+	user := data.User{Name: "John Doe", Email: "john_doe@gmail.com", Password: "pass", Role: "user"}
+	if err := store.CreateUser(ctx, &user); err != nil {
+		t.Fatal(err, "Cannot create user")
+	}
+	session, err := store.CreateSession(ctx, &user, data.Device{})
+	if err != nil {
+		t.Fatal(err, "Cannot create session")
+	}
+
+	if _, err = store.CreateRememberToken(ctx, &session, time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err, "Cannot create remember token")
+	}
+
+	// a sweep which panics is logged, which mustn't happen here
+	var logged bytes.Buffer
+	defer logger.SetOutput(logger.Writer())
+	logger.SetOutput(&logged)
+
+	janitorCtx, cancel := context.WithCancel(ctx)
+	done := s.startJanitor(janitorCtx, 10*time.Millisecond)
+	time.Sleep(1200 * time.Millisecond)
+	cancel()
+	<-done
+
+	if err = store.CheckSession(ctx, &data.Session{Uuid: session.Uuid}, data.SessionExpiry{}, time.Now()); err != sql.ErrNoRows {
+		t.Error(err, "Expired session not cleaned")
+	}
+	if cleaned, err := store.CleanRememberTokens(ctx, time.Now()); err != nil || cleaned != 0 {
+		t.Error(err, "Expired remember token not cleaned")
+	}
+	for _, line := range strings.Split(logged.String(), "\n") {
+		if strings.Contains(line, "panicked") {
+			t.Errorf("Janitor panicked: %s", line)
+			break
+		}
+	}
+	// the janitor releases its lock on shutdown
+	if _, ok, _ := store.TryLock(ctx, janitorLock); !ok {
+		t.Error("Janitor lock not released")
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bakhtik/webapp_template/data"
+)
+
+// maxBuckets is the number of keys a limiter tracks before idle ones are pruned
+const maxBuckets = 10000
+
+// rateLimiter is a token bucket per key. Buckets are kept in memory so every
+// instance limits the requests it receives on its own.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64 // tokens added per second
+	burst   float64
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter allows perMinute requests per key with bursts of burst
+// requests, it returns nil which allows everything if perMinute is not positive
+func newRateLimiter(perMinute float64, burst int) *rateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    perMinute / 60,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// allow takes a token from the bucket of key, if it is empty it returns
+// how long to wait for the next token
+func (l *rateLimiter) allow(key string, now time.Time) (ok bool, retryAfter time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, found := l.buckets[key]
+	if !found {
+		if len(l.buckets) >= maxBuckets {
+			l.prune(now)
+		}
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// reset forgets the bucket of key so it is full again
+func (l *rateLimiter) reset(key string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.buckets, key)
+}
+
+// prune drops the buckets which have refilled since their last use
+func (l *rateLimiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// loginAllowed checks the login attempt against the limits of the client IP and of the target email
+func (s *server) loginAllowed(req *http.Request, email string, now time.Time) (ok bool, retryAfter time.Duration) {
+	if ok, retryAfter = s.ipLimiter.allow(clientIP(req), now); !ok {
+		logger.SetPrefix("WARNING ")
+		logger.Printf("Too many login attempts from %s", clientIP(req))
+		return
+	}
+	if ok, retryAfter = s.emailLimiter.allow(strings.ToLower(email), now); !ok {
+		logger.SetPrefix("WARNING ")
+		logger.Printf("Too many login attempts to %s from %s", email, clientIP(req))
+	}
+	return
+}
+
+// loginFailed counts the failed login of the user and locks the account after too many of them
+func (s *server) loginFailed(ctx context.Context, user *data.User) {
+	lockout := time.Duration(config.Login.LockoutDuration) * time.Second
+	if err := s.users.LoginFailed(ctx, user, config.Login.LockoutThreshold, lockout); err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot record failed login")
+		return
+	}
+	if user.Locked(time.Now()) {
+		logger.SetPrefix("WARNING ")
+		logger.Printf("User %s locked until %s after %d failed logins", user.Email, user.LockedUntil.Format(time.RFC3339), config.Login.LockoutThreshold)
+	}
+}
+
+// tooManyAttempts refuses a login until retryAfter has passed
+func tooManyAttempts(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, "Too many login attempts, please try again later", http.StatusTooManyRequests)
+}
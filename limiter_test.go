@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(60, 2)
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := limiter.allow("10.0.0.1", now); !ok {
+			t.Fatalf("Request %d within the burst refused", i+1)
+		}
+	}
+	ok, retryAfter := limiter.allow("10.0.0.1", now)
+	if ok || retryAfter <= 0 || retryAfter > time.Second {
+		t.Errorf("Request over the burst allowed %v, retry after %v", ok, retryAfter)
+	}
+	if ok, _ := limiter.allow("10.0.0.2", now); !ok {
+		t.Error("Request with another key refused")
+	}
+	if ok, _ := limiter.allow("10.0.0.1", now.Add(time.Second)); !ok {
+		t.Error("Request refused after the bucket refilled")
+	}
+
+	limiter.allow("10.0.0.1", now.Add(time.Second))
+	limiter.reset("10.0.0.1")
+	if ok, _ := limiter.allow("10.0.0.1", now.Add(time.Second)); !ok {
+		t.Error("Request refused after reset")
+	}
+
+	disabled := newRateLimiter(0, 0)
+	for i := 0; i < 100; i++ {
+		if ok, _ := disabled.allow("10.0.0.1", now); !ok {
+			t.Fatal("Disabled limiter refused a request")
+		}
+	}
+}
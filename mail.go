@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/bakhtik/webapp_template/mailer"
+)
+
+// openMailer creates the mailer with the configured transport
+func openMailer() (*mailer.Mailer, error) {
+	var transport mailer.Transport
+	switch config.Mail.Transport {
+	case "", "maildrop":
+		transport = &mailer.Maildrop{Dir: config.Mail.Dir}
+	case "smtp":
+		transport = &mailer.SMTP{
+			Host:     config.Mail.SMTP.Host,
+			Port:     config.Mail.SMTP.Port,
+			Username: config.Mail.SMTP.Username,
+			Password: config.Mail.SMTP.Password,
+		}
+	default:
+		return nil, fmt.Errorf("unknown mail transport %q", config.Mail.Transport)
+	}
+	return mailer.New(transport, config.Mail.From, config.Mail.Templates), nil
+}
+
+// sendMail sends the email called name, delivery is limited by the SMTP timeout
+func (s *server) sendMail(ctx context.Context, to, name string, data interface{}) (err error) {
+	if timeout := config.Mail.SMTP.Timeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+		defer cancel()
+	}
+	if err = s.mail.Send(ctx, to, name, data); err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Printf("%v: Cannot send %s email to %s", err, name, to)
+	}
+	return
+}
+
+// sendLater runs send in the background with a context of its own, as the
+// context of the request ends with the response. Handlers which must not
+// reveal whether there is an account for an email respond without waiting,
+// so that they take as long whether they send an email or not.
+func (s *server) sendLater(send func(ctx context.Context)) {
+	s.mailing.Add(1)
+	go func() {
+		defer s.mailing.Done()
+		send(context.Background())
+	}()
+}
@@ -0,0 +1,53 @@
+package mailer
+
+import (
+	"context"
+	"sync"
+)
+
+// Capture keeps the messages in memory instead of sending them, for tests.
+// It is safe for concurrent use.
+type Capture struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+// Send keeps a copy of the message after checking it can be formatted
+func (c *Capture) Send(ctx context.Context, msg *Message) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if _, err = msg.Bytes(); err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.messages = append(c.messages, *msg)
+	return
+}
+
+// Messages returns the captured messages, oldest first
+func (c *Capture) Messages() []Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Message(nil), c.messages...)
+}
+
+// Last returns the last message sent to the address
+func (c *Capture) Last(to string) (msg Message, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := len(c.messages) - 1; i >= 0; i-- {
+		if c.messages[i].To == to {
+			return c.messages[i], true
+		}
+	}
+	return
+}
+
+// Reset forgets the captured messages
+func (c *Capture) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.messages = nil
+}
@@ -0,0 +1,35 @@
+package mailer
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Maildrop writes every message as an .eml file to Dir instead of sending it,
+// for development without a mail server
+type Maildrop struct {
+	Dir string
+}
+
+// Send writes the message to a new file in the maildrop directory
+func (m *Maildrop) Send(ctx context.Context, msg *Message) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	body, err := msg.Bytes()
+	if err != nil {
+		return
+	}
+	if err = os.MkdirAll(m.Dir, 0700); err != nil {
+		return
+	}
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	name := time.Now().Format("20060102-150405.000000000") + "-" + hex.EncodeToString(suffix) + ".eml"
+	return ioutil.WriteFile(filepath.Join(m.Dir, name), body, 0600)
+}
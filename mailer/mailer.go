@@ -0,0 +1,78 @@
+// Package mailer renders emails from templates and delivers them through a
+// pluggable transport.
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	htmltemplate "html/template"
+	"os"
+	"path/filepath"
+	"text/template"
+)
+
+// Transport delivers messages
+type Transport interface {
+	Send(ctx context.Context, msg *Message) error
+}
+
+// Mailer renders emails from the templates in Dir and sends them From its
+// address through the Transport.
+//
+// An email called name is made of name.txt, which defines the "subject" and
+// the "text" body templates, and an optional name.html defining "content"
+// which is rendered into the "layout" of layout.html as the HTML body.
+type Mailer struct {
+	Transport Transport
+	From      string
+	Dir       string
+}
+
+// New creates a mailer
+func New(transport Transport, from, dir string) *Mailer {
+	return &Mailer{Transport: transport, From: from, Dir: dir}
+}
+
+// Render renders the subject and the bodies of the email called name
+func (m *Mailer) Render(name string, data interface{}) (msg Message, err error) {
+	text, err := template.ParseFiles(filepath.Join(m.Dir, name+".txt"))
+	if err != nil {
+		return
+	}
+	var buf bytes.Buffer
+	if err = text.ExecuteTemplate(&buf, "subject", data); err != nil {
+		return
+	}
+	msg.Subject = buf.String()
+	buf.Reset()
+	if err = text.ExecuteTemplate(&buf, "text", data); err != nil {
+		return
+	}
+	msg.Text = buf.String()
+
+	page := filepath.Join(m.Dir, name+".html")
+	if _, err = os.Stat(page); os.IsNotExist(err) {
+		return msg, nil
+	}
+	html, err := htmltemplate.ParseFiles(filepath.Join(m.Dir, "layout.html"), page)
+	if err != nil {
+		return
+	}
+	buf.Reset()
+	if err = html.ExecuteTemplate(&buf, "layout", data); err != nil {
+		return
+	}
+	msg.HTML = buf.String()
+	return
+}
+
+// Send renders the email called name and sends it to the address
+func (m *Mailer) Send(ctx context.Context, to, name string, data interface{}) (err error) {
+	msg, err := m.Render(name, data)
+	if err != nil {
+		return fmt.Errorf("mailer: cannot render %s: %w", name, err)
+	}
+	msg.From, msg.To = m.From, to
+	return m.Transport.Send(ctx, &msg)
+}
@@ -0,0 +1,95 @@
+package mailer
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var ctx = context.Background()
+
+func Test_Render(t *testing.T) {
+	m := New(&Capture{}, "WebApp <noreply@example.com>", "testdata")
+	msg, err := m.Render("welcome", struct{ Name string }{"<Peter>"})
+	if err != nil {
+		t.Fatal(err, "Cannot render email")
+	}
+	if msg.Subject != "Welcome <Peter>" || msg.Text != "Hello <Peter>, welcome aboard." {
+		t.Errorf("Text rendered as %q, %q", msg.Subject, msg.Text)
+	}
+	if msg.HTML != "<html><body><p>Hello &lt;Peter&gt;, welcome aboard.</p></body></html>" {
+		t.Errorf("HTML rendered as %q", msg.HTML)
+	}
+
+	if msg, err = m.Render("plain", nil); err != nil || msg.HTML != "" || msg.Text != "Just text." {
+		t.Errorf("Text only email rendered as %q, %q: %v", msg.Text, msg.HTML, err)
+	}
+	if _, err = m.Render("missing", nil); err == nil {
+		t.Error("Missing email rendered")
+	}
+}
+
+func Test_SendCapture(t *testing.T) {
+	capture := &Capture{}
+	m := New(capture, "WebApp <noreply@example.com>", "testdata")
+	if err := m.Send(ctx, "peter@example.com", "welcome", struct{ Name string }{"Peter"}); err != nil {
+		t.Fatal(err, "Cannot send email")
+	}
+	msg, ok := capture.Last("peter@example.com")
+	if !ok || msg.From != "WebApp <noreply@example.com>" || msg.Subject != "Welcome Peter" {
+		t.Errorf("Captured %+v", msg)
+	}
+	if err := m.Send(ctx, "peter@example.com\r\nBcc: eve@example.com", "welcome", struct{ Name string }{"Peter"}); err == nil {
+		t.Error("Email with injected header sent")
+	}
+	if len(capture.Messages()) != 1 {
+		t.Errorf("%d messages captured, want 1", len(capture.Messages()))
+	}
+	capture.Reset()
+	if _, ok = capture.Last("peter@example.com"); ok {
+		t.Error("Messages not reset")
+	}
+}
+
+func Test_MessageBytes(t *testing.T) {
+	msg := Message{
+		From:    "noreply@example.com",
+		To:      "Péter <peter@example.com>",
+		Subject: "Grüße\r\nBcc: eve@example.com",
+		Text:    "Hello",
+		HTML:    "<p>Hello</p>",
+	}
+	bs, err := msg.Bytes()
+	if err != nil {
+		t.Fatal(err, "Cannot format message")
+	}
+	body := string(bs)
+	for _, want := range []string{"Subject: =?utf-8?q?", "Content-Type: multipart/alternative", "text/plain", "text/html", "<p>Hello</p>"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Message does not contain %q", want)
+		}
+	}
+	if strings.Contains(body, "\r\nBcc:") {
+		t.Error("Header injected through the subject")
+	}
+}
+
+func Test_Maildrop(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "maildrop")
+	m := New(&Maildrop{Dir: dir}, "noreply@example.com", "testdata")
+	for i := 0; i < 2; i++ {
+		if err := m.Send(ctx, "peter@example.com", "plain", nil); err != nil {
+			t.Fatal(err, "Cannot send email")
+		}
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil || len(files) != 2 {
+		t.Fatalf("%d files in maildrop, want 2: %v", len(files), err)
+	}
+	bs, _ := ioutil.ReadFile(filepath.Join(dir, files[0].Name()))
+	if !strings.Contains(string(bs), "To: <peter@example.com>") || !strings.Contains(string(bs), "Just text.") {
+		t.Errorf("Unexpected message %q", bs)
+	}
+}
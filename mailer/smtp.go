@@ -0,0 +1,82 @@
+package mailer
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+)
+
+// SMTP delivers messages to an SMTP server. STARTTLS is used when the server
+// offers it, and the credentials are only sent over TLS or to localhost.
+type SMTP struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+}
+
+// Send delivers the message, ctx limits the whole SMTP conversation
+func (s *SMTP) Send(ctx context.Context, msg *Message) (err error) {
+	body, err := msg.Bytes()
+	if err != nil {
+		return
+	}
+	from, _ := mail.ParseAddress(msg.From)
+	to, _ := mail.ParseAddress(msg.To)
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(s.Host, strconv.Itoa(s.Port)))
+	if err != nil {
+		return
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// the connection is closed when ctx is canceled before the conversation ends
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	c, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: s.Host}); err != nil {
+			return
+		}
+	}
+	if s.Username != "" {
+		if err = c.Auth(smtp.PlainAuth("", s.Username, s.Password, s.Host)); err != nil {
+			return
+		}
+	}
+	if err = c.Mail(from.Address); err != nil {
+		return
+	}
+	if err = c.Rcpt(to.Address); err != nil {
+		return
+	}
+	w, err := c.Data()
+	if err != nil {
+		return
+	}
+	if _, err = w.Write(body); err != nil {
+		return
+	}
+	if err = w.Close(); err != nil {
+		return
+	}
+	return c.Quit()
+}
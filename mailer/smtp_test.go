@@ -0,0 +1,71 @@
+package mailer
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// fakeSMTP accepts a single SMTP conversation and returns the commands and the data it received
+func fakeSMTP(t *testing.T) (addr string, received chan []string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	received = make(chan []string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tp := textproto.NewConn(conn)
+		var lines []string
+		tp.PrintfLine("220 localhost ESMTP")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				break
+			}
+			lines = append(lines, line)
+			switch cmd := strings.ToUpper(strings.Fields(line + " ")[0]); cmd {
+			case "EHLO":
+				tp.PrintfLine("250-localhost")
+				tp.PrintfLine("250 8BITMIME")
+			case "DATA":
+				tp.PrintfLine("354 go ahead")
+				data, _ := tp.ReadDotLines()
+				lines = append(lines, data...)
+				tp.PrintfLine("250 queued")
+			case "QUIT":
+				tp.PrintfLine("221 bye")
+				received <- lines
+				return
+			default:
+				tp.PrintfLine("250 ok")
+			}
+		}
+		received <- lines
+	}()
+	return l.Addr().String(), received
+}
+
+func Test_SMTP(t *testing.T) {
+	addr, received := fakeSMTP(t)
+	host, port, _ := net.SplitHostPort(addr)
+	transport := &SMTP{Host: host}
+	transport.Port, _ = net.LookupPort("tcp", port)
+
+	m := New(transport, "WebApp <noreply@example.com>", "testdata")
+	if err := m.Send(ctx, "peter@example.com", "plain", nil); err != nil {
+		t.Fatal(err, "Cannot send email")
+	}
+	conversation := strings.Join(<-received, "\n")
+	for _, want := range []string{"MAIL FROM:<noreply@example.com>", "RCPT TO:<peter@example.com>", "Subject: Plain", "Just text."} {
+		if !strings.Contains(conversation, want) {
+			t.Errorf("Conversation does not contain %q:\n%s", want, conversation)
+		}
+	}
+}
@@ -1,38 +1,292 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bakhtik/webapp_template/data"
+	"github.com/bakhtik/webapp_template/mailer"
+	"github.com/bakhtik/webapp_template/password"
+	"golang.org/x/crypto/bcrypt"
 )
 
+// server holds the dependencies shared by the handlers
+type server struct {
+	users     data.UserStore
+	sessions  data.SessionStore
+	invites   data.InviteStore
+	resets    data.ResetStore
+	twoFactor data.TwoFactorStore
+	remember  data.RememberStore
+	tokens    sessionTokens
+	passwords *password.Hasher
+	policy    password.Policy
+	mail      *mailer.Mailer
+	mailing   *sync.WaitGroup // emails sent in the background by sendLater
+	csrfKey   []byte
+	// login attempts are limited per client IP and per email
+	ipLimiter    *rateLimiter
+	emailLimiter *rateLimiter
+	// users can sign in with their account at an identity provider
+	identities data.IdentityStore
+	providers  []*oidcProvider
+}
+
 func main() {
+	store, err := openStore()
+	if err != nil {
+		log.Fatalf("Cannot open %s store: %s", config.Store, err)
+	}
+	passwords, err := newPasswordHasher()
+	if err != nil {
+		log.Fatalln("Cannot hash passwords:", err)
+	}
+	policy, err := newPasswordPolicy()
+	if err != nil {
+		log.Fatalln("Cannot check passwords:", err)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err = runMigrate(os.Stdout, store, os.Args[2:]); err != nil {
+			log.Fatalln("Migration failed:", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "createadmin" {
+		if err = runCreateAdmin(os.Stdin, os.Stdout, store, passwords, os.Args[2:]); err != nil {
+			log.Fatalln("Cannot create admin:", err)
+		}
+		return
+	}
+	if !strSliceContains(signupModes, config.SignupMode) {
+		log.Fatalf("Unknown signup mode %q", config.SignupMode)
+	}
+	if err = config.Cookie.check(); err != nil {
+		log.Fatalln("Invalid cookie configuration:", err)
+	}
+	if config.AutoMigrate {
+		if err = autoMigrate(store); err != nil {
+			log.Fatalln("Migration failed:", err)
+		}
+	}
+	mail, err := openMailer()
+	if err != nil {
+		log.Fatalln("Cannot open mailer:", err)
+	}
+	s := &server{
+		users:        store,
+		sessions:     store,
+		invites:      store,
+		resets:       store,
+		twoFactor:    store,
+		remember:     store,
+		identities:   store,
+		passwords:    passwords,
+		policy:       policy,
+		mail:         mail,
+		mailing:      &sync.WaitGroup{},
+		csrfKey:      []byte(config.CSRFKey),
+		ipLimiter:    newRateLimiter(config.Login.IPRate, config.Login.IPBurst),
+		emailLimiter: newRateLimiter(config.Login.EmailRate, config.Login.EmailBurst),
+	}
+	if config.CSRFKey == "" {
+		// forms rendered, links sent and, without session keys, sessions
+		// started before a restart will be rejected
+		logger.SetPrefix("WARNING ")
+		logger.Println("CSRFKey is not configured, using a random key")
+		s.csrfKey = []byte(randomString(32))
+	}
+	if s.tokens, err = newSessionTokens(s.csrfKey); err != nil {
+		log.Fatalln("Cannot protect session cookies:", err)
+	}
+	if config.SessionToken.Stateless {
+		s.sessions = statelessSessions{store, store}
+	}
+	if s.providers, err = newOIDCProviders(config.OIDCProviders); err != nil {
+		log.Fatalln("Invalid identity provider configuration:", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var janitorDone <-chan struct{}
+	if config.SessionCleanInterval > 0 {
+		janitorDone = s.startJanitor(ctx, time.Duration(config.SessionCleanInterval)*time.Second)
+	}
+
+	httpServer := &http.Server{Addr: config.Address, Handler: s.routes()}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		httpServer.Shutdown(shutdownCtx)
+	}()
+
 	fmt.Println("Webapp template", version(), "started at", config.Address)
+	if err = httpServer.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	if janitorDone != nil {
+		<-janitorDone
+	}
+	s.mailing.Wait()
+	fmt.Println("Webapp template stopped")
+}
+
+// openStore opens the storage backend selected in configuration
+// and makes sure the database is reachable
+func openStore() (data.Store, error) {
+	switch config.Store {
+	case "", "postgres":
+		store, err := data.NewPostgres(config.Database.PostgresDSN())
+		if err != nil {
+			return nil, err
+		}
+		store.QueryTimeout = time.Duration(config.Database.QueryTimeout) * time.Second
+		return store, connectDB(store.Db)
+	case "sqlite":
+		store, err := data.NewSQLite(config.Database.File)
+		if err != nil {
+			return nil, err
+		}
+		store.QueryTimeout = time.Duration(config.Database.QueryTimeout) * time.Second
+		return store, connectDB(store.Db)
+	case "memory":
+		return data.NewMemory(), nil
+	default:
+		return nil, fmt.Errorf("unknown store %q", config.Store)
+	}
+}
+
+// newPasswordHasher creates the hasher with the configured algorithm
+func newPasswordHasher() (*password.Hasher, error) {
+	cfg := config.Password
+	switch cfg.Algorithm {
+	case "", "bcrypt":
+		if cfg.BcryptCost != 0 && (cfg.BcryptCost < bcrypt.MinCost || cfg.BcryptCost > bcrypt.MaxCost) {
+			return nil, fmt.Errorf("bcrypt cost %d is not between %d and %d", cfg.BcryptCost, bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		return password.NewHasher(password.Bcrypt{Cost: cfg.BcryptCost}), nil
+	case "argon2id":
+		if cfg.Argon2Memory < 0 || cfg.Argon2Iterations < 0 || cfg.Argon2Parallelism < 0 || cfg.Argon2Parallelism > 255 {
+			return nil, fmt.Errorf("invalid argon2id parameters")
+		}
+		return password.NewHasher(password.Argon2id{
+			Memory:      uint32(cfg.Argon2Memory),
+			Iterations:  uint32(cfg.Argon2Iterations),
+			Parallelism: uint8(cfg.Argon2Parallelism),
+		}), nil
+	default:
+		return nil, fmt.Errorf("unknown password hashing algorithm %q", cfg.Algorithm)
+	}
+}
+
+// newPasswordPolicy creates the configured policy for new passwords
+func newPasswordPolicy() (policy password.Policy, err error) {
+	cfg := config.Password
+	policy = password.Policy{
+		MinLength:     cfg.MinLength,
+		RequireUpper:  cfg.RequireUpper,
+		RequireLower:  cfg.RequireLower,
+		RequireDigit:  cfg.RequireDigit,
+		RequireSymbol: cfg.RequireSymbol,
+	}
+	if cfg.Algorithm == "" || cfg.Algorithm == "bcrypt" {
+		// longer passwords would fail to hash
+		policy.MaxBytes = password.BcryptMaxBytes
+	}
+	if cfg.BreachedList != "" {
+		if _, err = os.Stat(cfg.BreachedList); err != nil {
+			return
+		}
+		policy.Breached = password.BreachedFile{Path: cfg.BreachedList}
+	}
+	return
+}
+
+// connectDB configures the connection pool and waits for the database to answer
+func connectDB(db *sql.DB) error {
+	cfg := config.Database
+	data.PoolOptions{
+		MaxOpenConns:    cfg.MaxOpenConns,
+		MaxIdleConns:    cfg.MaxIdleConns,
+		ConnMaxLifetime: time.Duration(cfg.ConnMaxLifetime) * time.Second,
+	}.Apply(db)
+	attempts := cfg.ConnectAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	err := data.Connect(db, time.Duration(cfg.ConnectTimeout)*time.Second, attempts, time.Duration(cfg.RetryInterval)*time.Second)
+	if err != nil {
+		return fmt.Errorf("database is unreachable after %d attempt(s): %s", attempts, err)
+	}
+	return nil
+}
+
+// routes registers all handlers of the server
+func (s *server) routes() *http.ServeMux {
 	mux := http.NewServeMux()
 
 	// handle static assets
 	files := http.FileServer(http.Dir(config.Static))
 	mux.Handle("/static/", http.StripPrefix("/static/", files))
 
-	handlers := map[string]http.Handler{
-		"/":                     http.HandlerFunc(index),
-		"/favicon.ico":          http.NotFoundHandler(),
-		"/login":                http.HandlerFunc(login),
-		"/signup":               http.HandlerFunc(signup),
-		"/signup_account":       http.HandlerFunc(signupAccount),
-		"/authenticate":         http.HandlerFunc(authenticate),
-		"/logout":               authenticated(http.HandlerFunc(logout)),
-		"/profile":              authenticated(http.HandlerFunc(profile)),
-		"/change_account":       authenticated(http.HandlerFunc(changeAccount)),
-		"/admin":                authenticated(authorized(http.HandlerFunc(admin), "admin")),
-		"/admin/delete_user":    authenticated(authorized(http.HandlerFunc(deleteUser), "admin")),
-		"/admin/update_user":    authenticated(authorized(http.HandlerFunc(profileAdmin), "admin")),
-		"/admin/change_account": authenticated(authorized(http.HandlerFunc(changeAccountAdmin), "admin")),
-	}
+	user := func(h http.HandlerFunc) http.Handler { return s.authenticated(h) }
+	admin := func(h http.HandlerFunc) http.Handler { return s.authenticated(s.authorized(h, "admin")) }
+	const get, post, del = http.MethodGet, http.MethodPost, http.MethodDelete
 
-	for pattern, handler := range handlers {
-		mux.Handle(pattern, logged(handler))
+	// every route declares the methods it accepts, others get 405 Method Not Allowed
+	handlers := map[string]methods{
+		"/":                              {get: http.HandlerFunc(s.index)},
+		"/favicon.ico":                   {get: http.NotFoundHandler()},
+		"/login":                         {get: http.HandlerFunc(s.login)},
+		"/signup":                        {get: http.HandlerFunc(s.signup)},
+		"/signup_account":                {post: http.HandlerFunc(s.signupAccount)},
+		"/authenticate":                  {post: http.HandlerFunc(s.authenticate)},
+		"/oidc/login":                    {post: http.HandlerFunc(s.oidcLogin)},
+		"/oidc/callback":                 {get: http.HandlerFunc(s.oidcCallback)},
+		"/forgot_password":               {get: http.HandlerFunc(s.forgotPassword), post: http.HandlerFunc(s.requestPasswordReset)},
+		"/reset_password":                {get: http.HandlerFunc(s.resetPasswordForm), post: http.HandlerFunc(s.resetPassword)},
+		"/two_factor":                    {get: http.HandlerFunc(s.twoFactorForm), post: http.HandlerFunc(s.verifyTwoFactor)},
+		"/verify_email":                  {get: http.HandlerFunc(s.verifyEmail)},
+		"/resend_verification":           {post: http.HandlerFunc(s.resendVerification)},
+		"/logout":                        {post: user(s.logout)},
+		"/profile":                       {get: user(s.profile)},
+		"/change_account":                {post: user(s.changeAccount)},
+		"/profile/revoke_session":        {post: user(s.revokeSession)},
+		"/profile/revoke_other_sessions": {post: user(s.revokeOtherSessions)},
+		"/profile/two_factor":            {get: user(s.twoFactorSetup), post: user(s.enableTwoFactor)},
+		"/profile/disable_two_factor":    {post: user(s.disableTwoFactor)},
+		"/profile/recovery_codes":        {post: user(s.recoveryCodes)},
+		"/admin":                         {get: admin(s.admin)},
+		"/admin/delete_user":             {get: admin(s.confirmDeleteUser), post: admin(s.deleteUser), del: admin(s.deleteUser)},
+		"/admin/update_user":             {get: admin(s.profileAdmin)},
+		"/admin/change_account":          {post: admin(s.changeAccountAdmin)},
+		"/admin/unlock_user":             {post: admin(s.unlockUser)},
+		"/admin/reset_password":          {post: admin(s.adminResetPassword)},
+		"/admin/disable_two_factor":      {post: admin(s.adminDisableTwoFactor)},
+		"/admin/approve_user":            {post: admin(s.approveUser)},
+		"/admin/create_invite":           {post: admin(s.createInvite)},
+		"/admin/delete_invite":           {post: admin(s.deleteInvite)},
+		"/admin/sessions":                {get: admin(s.adminSessions)},
+		"/admin/revoke_session":          {post: admin(s.adminRevokeSession)},
+		"/admin/revoke_user_sessions":    {get: admin(s.confirmRevokeUserSessions), post: admin(s.adminRevokeUserSessions)},
 	}
 
-	log.Fatal(http.ListenAndServe(config.Address, mux))
+	// sessions are restored from remember cookies before the CSRF tokens are bound to them
+	for pattern, route := range handlers {
+		for method, handler := range route {
+			route[method] = s.csrf(handler)
+		}
+		mux.Handle(pattern, logged(s.restored(route)))
+	}
+	return mux
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/bakhtik/webapp_template/data"
+)
+
+const migrateUsage = "usage: webapp_template migrate up|down [steps]|status"
+
+// migratable is implemented by stores with a database schema
+type migratable interface {
+	Migrator() (*data.Migrator, error)
+}
+
+// runMigrate implements the migrate command
+func runMigrate(w io.Writer, store data.Store, args []string) (err error) {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+	db, ok := store.(migratable)
+	if !ok {
+		return fmt.Errorf("store %q has no schema to migrate", config.Store)
+	}
+	m, err := db.Migrator()
+	if err != nil {
+		return
+	}
+	ctx := context.Background()
+
+	switch args[0] {
+	case "up":
+		applied, err := m.Up(ctx)
+		for _, migration := range applied {
+			fmt.Fprintf(w, "applied %04d_%s\n", migration.Version, migration.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Fprintln(w, "no pending migrations")
+		}
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return errors.New(migrateUsage)
+			}
+		}
+		reverted, err := m.Down(ctx, steps)
+		for _, migration := range reverted {
+			fmt.Fprintf(w, "reverted %04d_%s\n", migration.Version, migration.Name)
+		}
+		return err
+	case "status":
+		status, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, s := range status {
+			state := "pending"
+			if s.Applied {
+				state = "applied at " + s.AppliedAt.Format(timeFMT)
+			}
+			fmt.Fprintf(w, "%04d_%s\t%s\n", s.Version, s.Name, state)
+		}
+		return nil
+	default:
+		return errors.New(migrateUsage)
+	}
+}
+
+// autoMigrate applies pending migrations on startup if the store has a schema
+func autoMigrate(store data.Store) (err error) {
+	db, ok := store.(migratable)
+	if !ok {
+		return
+	}
+	m, err := db.Migrator()
+	if err != nil {
+		return
+	}
+	applied, err := m.Up(context.Background())
+	for _, migration := range applied {
+		logger.SetPrefix("INFO ")
+		logger.Printf("Applied migration %04d_%s", migration.Version, migration.Name)
+	}
+	return
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bakhtik/webapp_template/data"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// oidcLoginPurpose is what the state of a login at an identity provider is signed for
+const oidcLoginPurpose = "oidc-login"
+
+// oidcCookie holds the state, nonce and PKCE verifier of a login until the
+// identity provider redirects back
+const oidcCookie = "oidc"
+
+// oidcLoginLifetime is how long the login at the identity provider can take
+const oidcLoginLifetime = 10 * time.Minute
+
+// oidcTimeout limits the requests to the identity providers
+const oidcTimeout = 10 * time.Second
+
+// errUnverifiedEmail is returned for identities without a verified email,
+// which can't be linked to a user as the address could be anyone's
+var errUnverifiedEmail = errors.New("identity has no verified email")
+
+// oidcProvider is an OpenID Connect identity provider. It is discovered on
+// its first use, so that an unreachable provider doesn't stop the server.
+type oidcProvider struct {
+	OIDCProviderConfiguration
+	client *http.Client
+
+	mu       sync.Mutex
+	oauth    *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// oidcIdentity holds the claims of an ID token which identify a user
+type oidcIdentity struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+}
+
+// newOIDCProviders checks the configured identity providers
+func newOIDCProviders(configs []OIDCProviderConfiguration) (providers []*oidcProvider, err error) {
+	names := make(map[string]bool)
+	for _, c := range configs {
+		if c.Name == "" || c.Issuer == "" || c.ClientID == "" {
+			return nil, fmt.Errorf("identity provider %q needs a name, an issuer and a client id", c.Name)
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("identity provider %q is configured twice", c.Name)
+		}
+		names[c.Name] = true
+		if c.Label == "" {
+			c.Label = c.Name
+		}
+		providers = append(providers, &oidcProvider{OIDCProviderConfiguration: c, client: &http.Client{Timeout: oidcTimeout}})
+	}
+	return
+}
+
+// discover fetches the endpoints of the provider, once it succeeded
+func (p *oidcProvider) discover(ctx context.Context) (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.oauth == nil {
+		provider, err := oidc.NewProvider(oidc.ClientContext(ctx, p.client), p.Issuer)
+		if err != nil {
+			return nil, nil, err
+		}
+		scopes := p.Scopes
+		if len(scopes) == 0 {
+			scopes = []string{"email", "profile"}
+		}
+		p.oauth = &oauth2.Config{
+			ClientID:     p.ClientID,
+			ClientSecret: p.ClientSecret,
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  strings.TrimRight(config.BaseURL, "/") + "/oidc/callback",
+			Scopes:       append([]string{oidc.ScopeOpenID}, scopes...),
+		}
+		p.verifier = provider.Verifier(&oidc.Config{ClientID: p.ClientID})
+	}
+	return p.oauth, p.verifier, nil
+}
+
+// identity exchanges the code for the tokens of the user and returns the
+// identity of the ID token, which must be valid and carry the nonce
+func (p *oidcProvider) identity(ctx context.Context, code, nonce, verifier string) (identity oidcIdentity, err error) {
+	oauth, idVerifier, err := p.discover(ctx)
+	if err != nil {
+		return
+	}
+	ctx = oidc.ClientContext(ctx, p.client)
+	token, err := oauth.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return
+	}
+	raw, ok := token.Extra("id_token").(string)
+	if !ok {
+		return identity, errors.New("no ID token in the token response")
+	}
+	idToken, err := idVerifier.Verify(ctx, raw)
+	if err != nil {
+		return
+	}
+	if !hmac.Equal([]byte(idToken.Nonce), []byte(nonce)) {
+		return identity, errors.New("ID token with another nonce")
+	}
+	if err = idToken.Claims(&identity); err != nil {
+		return
+	}
+	identity.Subject = idToken.Subject
+	return
+}
+
+// provider gets the identity provider with the name, nil if there is none
+func (s *server) provider(name string) *oidcProvider {
+	for _, p := range s.providers {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// POST /oidc/login
+// Send the user to sign in at the identity provider
+func (s *server) oidcLogin(w http.ResponseWriter, req *http.Request) {
+	provider := s.provider(req.PostFormValue("provider"))
+	if provider == nil {
+		http.Error(w, "Unknown identity provider", http.StatusNotFound)
+		return
+	}
+	oauth, _, err := provider.discover(req.Context())
+	if err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Printf("%v: Cannot discover identity provider %s", err, provider.Name)
+		http.Error(w, "The identity provider is unavailable", http.StatusBadGateway)
+		return
+	}
+	// the state binds the login to this browser, the nonce binds the ID
+	// token to the login and the verifier proves that the code was asked for here
+	state, nonce, verifier := randomString(32), randomString(32), oauth2.GenerateVerifier()
+	token := s.signToken(oidcLoginPurpose, time.Now().Add(oidcLoginLifetime), provider.Name, state, nonce, verifier)
+	http.SetCookie(w, newCallbackCookie(oidcCookie, token, int(oidcLoginLifetime/time.Second)))
+	http.Redirect(w, req, oauth.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)), http.StatusSeeOther)
+}
+
+// pendingOIDCLogin gets the provider, nonce and verifier of the login the
+// state of the callback belongs to
+func (s *server) pendingOIDCLogin(req *http.Request) (provider *oidcProvider, nonce, verifier string, err error) {
+	cookie, err := req.Cookie(cookieName(oidcCookie))
+	if err != nil {
+		return
+	}
+	fields, err := s.verifyToken(oidcLoginPurpose, cookie.Value, time.Now())
+	if err != nil || len(fields) != 4 || !hmac.Equal([]byte(fields[1]), []byte(req.FormValue("state"))) {
+		return nil, "", "", errInvalidToken
+	}
+	if provider = s.provider(fields[0]); provider == nil {
+		return nil, "", "", errInvalidToken
+	}
+	return provider, fields[2], fields[3], nil
+}
+
+// GET /oidc/callback
+// Sign in the user the identity provider redirected back
+func (s *server) oidcCallback(w http.ResponseWriter, req *http.Request) {
+	provider, nonce, verifier, err := s.pendingOIDCLogin(req)
+	http.SetCookie(w, newCallbackCookie(oidcCookie, "", -1))
+	if err != nil {
+		logger.SetPrefix("WARNING ")
+		logger.Printf("%v: Identity provider callback from %s", err, clientIP(req))
+		http.Redirect(w, req, "/login", http.StatusSeeOther)
+		return
+	}
+	if refused := req.FormValue("error"); refused != "" {
+		logger.SetPrefix("WARNING ")
+		logger.Printf("Login at identity provider %s failed: %s %s", provider.Name, refused, req.FormValue("error_description"))
+		http.Redirect(w, req, "/login", http.StatusSeeOther)
+		return
+	}
+	identity, err := provider.identity(req.Context(), req.FormValue("code"), nonce, verifier)
+	if err != nil {
+		logger.SetPrefix("WARNING ")
+		logger.Printf("%v: Cannot verify identity from %s", err, provider.Name)
+		http.Error(w, "Cannot sign in with the identity provider", http.StatusForbidden)
+		return
+	}
+	user, err := s.identityUser(req.Context(), provider, identity)
+	if err != nil {
+		logger.SetPrefix("WARNING ")
+		logger.Printf("%v: No user for identity %s of %s (%s)", err, identity.Subject, provider.Name, identity.Email)
+		http.Error(w, "There is no account for this identity", http.StatusForbidden)
+		return
+	}
+	if user.Pending {
+		w.WriteHeader(http.StatusForbidden)
+		generateHTML(w, req, nil, "layout", "public.navbar", "pending")
+		return
+	}
+	if user.TwoFactorEnabled() {
+		s.startTwoFactor(w, req, &user, false)
+		return
+	}
+	s.signIn(w, req, &user, false)
+}
+
+// identityUser gets the user linked to the identity. An identity seen for
+// the first time is linked to the user with its verified email, or to a new
+// user if the provider has a default role.
+func (s *server) identityUser(ctx context.Context, provider *oidcProvider, identity oidcIdentity) (user data.User, err error) {
+	if user, err = s.identities.IdentityUser(ctx, provider.Name, identity.Subject); err != sql.ErrNoRows {
+		return
+	}
+	if identity.Email == "" || !identity.EmailVerified {
+		return user, errUnverifiedEmail
+	}
+	user, err = s.users.UserByEmail(ctx, identity.Email)
+	switch {
+	case err == nil && !user.EmailVerified():
+		// the provider verified the address
+		user.EmailVerifiedAt = time.Now()
+		if err = s.users.UpdateUser(ctx, &user); err != nil {
+			return
+		}
+	case err == sql.ErrNoRows && provider.DefaultRole != "":
+		name := identity.Name
+		if name == "" {
+			name = identity.Email
+		}
+		// the user has no password and signs in at the provider only
+		user = data.User{Name: name, Email: identity.Email, Role: provider.DefaultRole, EmailVerifiedAt: time.Now()}
+		if err = s.users.CreateUser(ctx, &user); err != nil {
+			return
+		}
+		logger.SetPrefix("INFO ")
+		logger.Printf("User %s created at first login with %s", user.Email, provider.Name)
+	case err != nil:
+		return
+	}
+	if err = s.identities.LinkIdentity(ctx, &user, provider.Name, identity.Subject); err != nil {
+		return
+	}
+	logger.SetPrefix("INFO ")
+	logger.Printf("Identity %s of %s linked to user %s", identity.Subject, provider.Name, user.Email)
+	return
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubIdP is an identity provider which signs in whoever the test asks it to
+type stubIdP struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]stubCode
+}
+
+// stubCode is an authorization code with the PKCE challenge and the claims of its ID token
+type stubCode struct {
+	challenge string
+	claims    map[string]interface{}
+}
+
+// newStubIdP starts an identity provider and makes it the only one of testServer
+func newStubIdP(t *testing.T, defaultRole string) *stubIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err, "Cannot generate key")
+	}
+	idp := &stubIdP{key: key, codes: make(map[string]stubCode)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                idp.URL,
+			"authorization_endpoint":                idp.URL + "/authorize",
+			"token_endpoint":                        idp.URL + "/token",
+			"jwks_uri":                              idp.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, req *http.Request) {
+		encode := base64.RawURLEncoding.EncodeToString
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA", "alg": "RS256", "use": "sig", "kid": "test",
+			"n": encode(key.N.Bytes()), "e": encode(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", idp.token)
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+
+	providers, err := newOIDCProviders([]OIDCProviderConfiguration{{Name: "test", Issuer: idp.URL, ClientID: "webapp", ClientSecret: "secret", DefaultRole: defaultRole}})
+	if err != nil {
+		t.Fatal(err, "Invalid provider")
+	}
+	testServer.providers = providers
+	t.Cleanup(func() { testServer.providers = nil })
+	return idp
+}
+
+// token exchanges a code for an ID token if the PKCE verifier matches
+func (idp *stubIdP) token(w http.ResponseWriter, req *http.Request) {
+	idp.mu.Lock()
+	code, ok := idp.codes[req.PostFormValue("code")]
+	delete(idp.codes, req.PostFormValue("code"))
+	idp.mu.Unlock()
+	sum := sha256.Sum256([]byte(req.PostFormValue("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != code.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"access_token": "access", "token_type": "Bearer", "id_token": idp.sign(code.claims)})
+}
+
+// sign returns the claims as an ID token of the provider
+func (idp *stubIdP) sign(claims map[string]interface{}) string {
+	encode := func(v interface{}) string {
+		b, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	token := encode(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"}) + "." + encode(claims)
+	sum := sha256.Sum256([]byte(token))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, sum[:])
+	return token + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// authorize signs the subject in at the provider like the browser would after
+// the redirect to authURL and returns the callback query. The claims are added
+// to the ID token, the nonce of the request unless they have one.
+func (idp *stubIdP) authorize(t *testing.T, authURL, subject string, claims map[string]interface{}) url.Values {
+	u, err := url.Parse(authURL)
+	if err != nil || !strings.HasPrefix(authURL, idp.URL+"/authorize") {
+		t.Fatalf("Not redirected to the provider: %s", authURL)
+	}
+	query := u.Query()
+	if query.Get("code_challenge_method") != "S256" || !strings.Contains(query.Get("scope"), "openid") {
+		t.Fatalf("Authorization request without PKCE or openid scope: %s", authURL)
+	}
+	token := map[string]interface{}{
+		"iss": idp.URL, "aud": "webapp", "sub": subject, "nonce": query.Get("nonce"),
+		"iat": time.Now().Unix(), "exp": time.Now().Add(time.Minute).Unix(),
+	}
+	for k, v := range claims {
+		token[k] = v
+	}
+	code := randomString(16)
+	idp.mu.Lock()
+	idp.codes[code] = stubCode{query.Get("code_challenge"), token}
+	idp.mu.Unlock()
+	return url.Values{"code": {code}, "state": {query.Get("state")}}
+}
+
+// oidcSignIn starts a login at the provider and returns the response to the
+// callback, edit may change its query
+func oidcSignIn(t *testing.T, idp *stubIdP, subject string, claims map[string]interface{}, edit func(url.Values)) *http.Response {
+	form := url.Values{"provider": {"test"}}
+	req := httptest.NewRequest("POST", "/oidc/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	testServer.oidcLogin(w, req)
+	cookie := responseCookie(w.Result(), "oidc")
+	if w.Code != http.StatusSeeOther || cookie == nil {
+		t.Fatalf("Login not started, response code is %v", w.Code)
+	}
+
+	query := idp.authorize(t, w.Header().Get("Location"), subject, claims)
+	if edit != nil {
+		edit(query)
+	}
+	req = httptest.NewRequest("GET", "/oidc/callback?"+query.Encode(), nil)
+	req.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	testServer.oidcCallback(w, req)
+	return w.Result()
+}
+
+func TestOIDCLinksUserByVerifiedEmail(t *testing.T) {
+	idp := newStubIdP(t, "")
+	user := newTestUser(t, "peter@gmail.com", "user")
+
+	resp := oidcSignIn(t, idp, "peter-1", map[string]interface{}{"email": user.Email, "email_verified": false}, nil)
+	if resp.StatusCode != http.StatusForbidden || responseCookie(resp, "session") != nil {
+		t.Errorf("Unverified email signed in, response code is %v", resp.StatusCode)
+	}
+
+	resp = oidcSignIn(t, idp, "peter-1", map[string]interface{}{"email": user.Email, "email_verified": true}, nil)
+	if resp.StatusCode != http.StatusSeeOther || responseCookie(resp, "session") == nil {
+		t.Fatalf("User not signed in, response code is %v", resp.StatusCode)
+	}
+	if linked, err := store.IdentityUser(ctx, "test", "peter-1"); err != nil || linked.Id != user.Id {
+		t.Fatal(err, "- Identity not linked to the user")
+	}
+	if verified, _ := store.UserById(ctx, user.Id); !verified.EmailVerified() {
+		t.Error("Email verified by the provider not marked as verified")
+	}
+
+	// a linked identity is found by its subject even when its email changed
+	resp = oidcSignIn(t, idp, "peter-1", map[string]interface{}{"email": "peter@example.com"}, nil)
+	sess := responseCookie(resp, "session")
+	if sess == nil {
+		t.Fatalf("Linked identity not signed in, response code is %v", resp.StatusCode)
+	}
+	found := false
+	sessions, _ := store.UserSessions(ctx, &user)
+	for _, s := range sessions {
+		found = found || s.Uuid == cookieUuid(t, sess)
+	}
+	if !found {
+		t.Error("Linked identity not signed in as its user")
+	}
+
+	resp = oidcSignIn(t, idp, "mallory", map[string]interface{}{"email": "mallory@gmail.com", "email_verified": true}, nil)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Unknown user signed in without a default role, response code is %v", resp.StatusCode)
+	}
+}
+
+func TestOIDCProvisionsUser(t *testing.T) {
+	idp := newStubIdP(t, "user")
+	resp := oidcSignIn(t, idp, "eve-1", map[string]interface{}{"email": "eve@gmail.com", "email_verified": true, "name": "Eve"}, nil)
+	user, err := store.UserByEmail(ctx, "eve@gmail.com")
+	if err != nil {
+		t.Fatal(err, "- User not created")
+	}
+	t.Cleanup(func() { store.DeleteUser(ctx, &user) })
+	if resp.StatusCode != http.StatusSeeOther || responseCookie(resp, "session") == nil {
+		t.Errorf("New user not signed in, response code is %v", resp.StatusCode)
+	}
+	if user.Name != "Eve" || user.Role != "user" || !user.EmailVerified() || user.Password != "" {
+		t.Errorf("User created as %+v", user)
+	}
+	if linked, err := store.IdentityUser(ctx, "test", "eve-1"); err != nil || linked.Id != user.Id {
+		t.Error(err, "- Identity not linked to the new user")
+	}
+}
+
+func TestOIDCCallbackChecks(t *testing.T) {
+	idp := newStubIdP(t, "user")
+	claims := map[string]interface{}{"email": "eve@gmail.com", "email_verified": true}
+
+	resp := oidcSignIn(t, idp, "eve-1", claims, func(q url.Values) { q.Set("state", randomString(32)) })
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/login" || responseCookie(resp, "session") != nil {
+		t.Errorf("Callback with another state accepted, response code is %v", resp.StatusCode)
+	}
+
+	claims["nonce"] = randomString(32)
+	resp = oidcSignIn(t, idp, "eve-1", claims, nil)
+	if resp.StatusCode != http.StatusForbidden || responseCookie(resp, "session") != nil {
+		t.Errorf("ID token with another nonce accepted, response code is %v", resp.StatusCode)
+	}
+	delete(claims, "nonce")
+
+	// the code is only redeemed with the verifier of the login it was issued to
+	resp = oidcSignIn(t, idp, "eve-1", claims, func(q url.Values) {
+		code := idp.codes[q.Get("code")]
+		code.challenge = "other"
+		idp.codes[q.Get("code")] = code
+	})
+	if resp.StatusCode != http.StatusForbidden || responseCookie(resp, "session") != nil {
+		t.Errorf("Code redeemed without the PKCE verifier, response code is %v", resp.StatusCode)
+	}
+	if _, err := store.IdentityUser(ctx, "test", "eve-1"); err != sql.ErrNoRows {
+		t.Error(err, "- Identity linked by a refused callback")
+	}
+}
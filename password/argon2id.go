@@ -0,0 +1,109 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2id hashes with argon2id into the PHC string format
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>. Zero parameters take the
+// defaults recommended by RFC 9106 for memory constrained environments.
+type Argon2id struct {
+	// Memory is in KiB
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// argon2idPrefix starts every argon2id hash
+const argon2idPrefix = "$argon2id$"
+
+// withDefaults fills the zero parameters with their defaults
+func (a Argon2id) withDefaults() Argon2id {
+	if a.Memory == 0 {
+		a.Memory = 64 * 1024
+	}
+	if a.Iterations == 0 {
+		a.Iterations = 3
+	}
+	if a.Parallelism == 0 {
+		a.Parallelism = 4
+	}
+	if a.SaltLength == 0 {
+		a.SaltLength = 16
+	}
+	if a.KeyLength == 0 {
+		a.KeyLength = 32
+	}
+	return a
+}
+
+// Hash hashes the password with a new random salt
+func (a Argon2id) Hash(password string) (string, error) {
+	a = a.withDefaults()
+	salt := make([]byte, a.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, a.Iterations, a.Memory, a.Parallelism, a.KeyLength)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version, a.Memory, a.Iterations, a.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Identifies reports whether the hash is an argon2id hash
+func (a Argon2id) Identifies(hash string) bool {
+	return strings.HasPrefix(hash, argon2idPrefix)
+}
+
+// Compare checks the password against an argon2id hash of any parameters
+func (a Argon2id) Compare(hash, password string) error {
+	params, salt, key, err := parseArgon2id(hash)
+	if err != nil {
+		return err
+	}
+	other := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return ErrMismatch
+	}
+	return nil
+}
+
+// Outdated reports whether the hash was made with other parameters
+func (a Argon2id) Outdated(hash string) bool {
+	params, _, _, err := parseArgon2id(hash)
+	return err != nil || params != a.withDefaults()
+}
+
+// parseArgon2id splits an argon2id hash into its parameters, salt and key
+func parseArgon2id(hash string) (params Argon2id, salt, key []byte, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || "$"+parts[1]+"$" != argon2idPrefix {
+		return params, nil, nil, ErrUnknownHash
+	}
+	var version int
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("password: unsupported argon2 version %q", parts[2])
+	}
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, fmt.Errorf("password: invalid argon2 parameters %q", parts[3])
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return
+	}
+	// an empty key would match any password
+	if params.Memory == 0 || params.Iterations == 0 || params.Parallelism == 0 || len(key) == 0 {
+		return params, nil, nil, fmt.Errorf("password: invalid argon2 parameters %q", parts[3])
+	}
+	params.SaltLength, params.KeyLength = uint32(len(salt)), uint32(len(key))
+	return
+}
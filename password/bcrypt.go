@@ -0,0 +1,49 @@
+package password
+
+import (
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// BcryptMaxBytes is the length of the longest password bcrypt can hash
+const BcryptMaxBytes = 72
+
+// Bcrypt hashes with bcrypt, the hashes look like $2a$12$...
+type Bcrypt struct {
+	// Cost is the base-2 logarithm of the iterations, zero means bcrypt.DefaultCost
+	Cost int
+}
+
+func (b Bcrypt) cost() int {
+	if b.Cost == 0 {
+		return bcrypt.DefaultCost
+	}
+	return b.Cost
+}
+
+// Hash hashes the password with a new random salt
+func (b Bcrypt) Hash(password string) (string, error) {
+	bs, err := bcrypt.GenerateFromPassword([]byte(password), b.cost())
+	return string(bs), err
+}
+
+// Identifies reports whether the hash is a bcrypt hash
+func (b Bcrypt) Identifies(hash string) bool {
+	return strings.HasPrefix(hash, "$2")
+}
+
+// Compare checks the password against a bcrypt hash of any cost
+func (b Bcrypt) Compare(hash, password string) error {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return ErrMismatch
+	}
+	return err
+}
+
+// Outdated reports whether the hash was made with another cost
+func (b Bcrypt) Outdated(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != b.cost()
+}
@@ -0,0 +1,129 @@
+package password
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"os"
+	"strings"
+)
+
+// breachedPrefixLength is the length of the hash prefixes of the Pwned
+// Passwords range API, the lists are queried by prefix so that a remote list
+// would never learn the full hash
+const breachedPrefixLength = 5
+
+// BreachedList knows the SHA-1 hashes of passwords from data breaches
+type BreachedList interface {
+	// Range returns the upper case hex suffixes of the hashes starting with
+	// the upper case hex prefix
+	Range(prefix string) (suffixes []string, err error)
+}
+
+// Breached reports whether the password is in the list
+func Breached(list BreachedList, password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	suffixes, err := list.Range(hash[:breachedPrefixLength])
+	if err != nil {
+		return false, err
+	}
+	for _, suffix := range suffixes {
+		if suffix == hash[breachedPrefixLength:] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// BreachedFile is a file of upper case hex SHA-1 hashes sorted in ascending
+// order, one per line with an optional ":count" like the ordered downloads of
+// Pwned Passwords. The file is searched without loading it, so the whole
+// corpus can be used offline.
+type BreachedFile struct {
+	Path string
+}
+
+// Range returns the suffixes of the hashes in the file starting with prefix
+func (f BreachedFile) Range(prefix string) (suffixes []string, err error) {
+	file, err := os.Open(f.Path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return
+	}
+	size := info.Size()
+
+	// find the first line not before the prefix, a line is found from any
+	// offset inside the line before it
+	lo, hi := int64(0), size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		start, err := lineStart(file, mid, size)
+		if err != nil {
+			return nil, err
+		}
+		line, err := readLine(bufio.NewReader(io.NewSectionReader(file, start, size-start)))
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if line != "" && hashOf(line) < prefix {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+
+	start, err := lineStart(file, lo, size)
+	if err != nil {
+		return
+	}
+	r := bufio.NewReader(io.NewSectionReader(file, start, size-start))
+	for {
+		line, err := readLine(r)
+		if line != "" {
+			hash := hashOf(line)
+			if !strings.HasPrefix(hash, prefix) {
+				return suffixes, nil
+			}
+			suffixes = append(suffixes, hash[len(prefix):])
+		}
+		if err == io.EOF {
+			return suffixes, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// lineStart returns the offset of the first line starting at or after offset
+func lineStart(file *os.File, offset, size int64) (int64, error) {
+	if offset == 0 {
+		return 0, nil
+	}
+	r := bufio.NewReader(io.NewSectionReader(file, offset-1, size-offset+1))
+	skipped, err := r.ReadString('\n')
+	if err == io.EOF {
+		return size, nil
+	}
+	return offset - 1 + int64(len(skipped)), err
+}
+
+// readLine reads a line without its line ending
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+// hashOf returns the upper case hash of a line, without the count
+func hashOf(line string) string {
+	if colon := strings.IndexByte(line, ':'); colon >= 0 {
+		line = line[:colon]
+	}
+	return strings.ToUpper(strings.TrimSpace(line))
+}
@@ -0,0 +1,79 @@
+// Package password hashes passwords into strings which name their algorithm
+// and parameters, so that the configured algorithm can change while the
+// hashes made before keep working and are upgraded on the next login.
+package password
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrMismatch is returned when the password does not match the hash
+var ErrMismatch = errors.New("password: hash and password mismatch")
+
+// ErrUnknownHash is returned for hashes of no known algorithm
+var ErrUnknownHash = errors.New("password: unknown hash format")
+
+// Algorithm makes and checks the hashes of one format
+type Algorithm interface {
+	// Hash hashes the password with a new random salt
+	Hash(password string) (string, error)
+	// Identifies reports whether the hash is in the format of the algorithm
+	Identifies(hash string) bool
+	// Compare checks the password against a hash in the format of the
+	// algorithm, whatever parameters it was made with
+	Compare(hash, password string) error
+	// Outdated reports whether the hash was made with other parameters
+	Outdated(hash string) bool
+}
+
+// known are the algorithms whose hashes can be checked
+var known = []Algorithm{Bcrypt{}, Argon2id{}}
+
+// Hasher hashes new passwords with its algorithm and checks the hashes of
+// all known algorithms
+type Hasher struct {
+	algorithm Algorithm
+
+	// dummy is a hash made by algorithm for CompareDummy
+	dummyOnce sync.Once
+	dummy     string
+}
+
+// NewHasher creates a hasher making new hashes with algorithm
+func NewHasher(algorithm Algorithm) *Hasher {
+	return &Hasher{algorithm: algorithm}
+}
+
+// Hash hashes a new password for storage
+func (h *Hasher) Hash(password string) (string, error) {
+	return h.algorithm.Hash(password)
+}
+
+// Compare checks the password against the hash. If they match, rehash
+// reports whether the hash should be replaced by a new hash of the password
+// because it was made with another algorithm or other parameters.
+func (h *Hasher) Compare(hash, password string) (rehash bool, err error) {
+	for _, a := range known {
+		if !a.Identifies(hash) {
+			continue
+		}
+		if err = a.Compare(hash, password); err != nil {
+			return
+		}
+		return !h.algorithm.Identifies(hash) || h.algorithm.Outdated(hash), nil
+	}
+	return false, ErrUnknownHash
+}
+
+// CompareDummy checks the password against a hash made by the algorithm and
+// always returns ErrMismatch. It is for logins to unknown users, which then
+// take as long as a wrong password, so that the time taken doesn't reveal
+// which users exist.
+func (h *Hasher) CompareDummy(password string) error {
+	h.dummyOnce.Do(func() {
+		h.dummy, _ = h.algorithm.Hash("dummy password")
+	})
+	h.algorithm.Compare(h.dummy, password)
+	return ErrMismatch
+}
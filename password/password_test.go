@@ -0,0 +1,100 @@
+package password
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// fastArgon2id keeps the tests quick
+var fastArgon2id = Argon2id{Memory: 1024, Iterations: 1, Parallelism: 1}
+
+func TestHashCompare(t *testing.T) {
+	for _, a := range []Algorithm{Bcrypt{Cost: bcrypt.MinCost}, fastArgon2id} {
+		h := NewHasher(a)
+		hash, err := h.Hash("secret")
+		if err != nil {
+			t.Fatal(err, "Cannot hash password")
+		}
+		if rehash, err := h.Compare(hash, "secret"); err != nil || rehash {
+			t.Errorf("%s: rehash %v, err %v", hash, rehash, err)
+		}
+		if _, err := h.Compare(hash, "Secret"); err != ErrMismatch {
+			t.Errorf("%s: wrong password gives %v", hash, err)
+		}
+		if other, _ := h.Hash("secret"); other == hash {
+			t.Errorf("%s: hashes are not salted", hash)
+		}
+	}
+}
+
+// countingAlgorithm counts the comparisons of its hashes
+type countingAlgorithm struct {
+	Algorithm
+	compared *int
+}
+
+func (c countingAlgorithm) Compare(hash, password string) error {
+	if c.Identifies(hash) {
+		*c.compared++
+	}
+	return c.Algorithm.Compare(hash, password)
+}
+
+func TestCompareDummy(t *testing.T) {
+	var compared int
+	h := NewHasher(countingAlgorithm{Bcrypt{Cost: bcrypt.MinCost}, &compared})
+	for _, password := range []string{"secret", "dummy password", ""} {
+		if err := h.CompareDummy(password); err != ErrMismatch {
+			t.Errorf("%q: err %v", password, err)
+		}
+	}
+	// every password is checked against a real hash to take as long
+	if compared != 3 {
+		t.Errorf("%d of 3 passwords compared to a hash", compared)
+	}
+}
+
+func TestRehash(t *testing.T) {
+	weak, _ := Bcrypt{Cost: bcrypt.MinCost}.Hash("secret")
+	argon, _ := fastArgon2id.Hash("secret")
+	tests := []struct {
+		name   string
+		hasher *Hasher
+		hash   string
+		rehash bool
+	}{
+		{"bcrypt cost raised", NewHasher(Bcrypt{Cost: bcrypt.MinCost + 1}), weak, true},
+		{"bcrypt to argon2id", NewHasher(fastArgon2id), weak, true},
+		{"argon2id to bcrypt", NewHasher(Bcrypt{Cost: bcrypt.MinCost}), argon, true},
+		{"argon2id memory raised", NewHasher(Argon2id{Memory: 2048, Iterations: 1, Parallelism: 1}), argon, true},
+		{"argon2id current", NewHasher(fastArgon2id), argon, false},
+	}
+	for _, test := range tests {
+		if rehash, err := test.hasher.Compare(test.hash, "secret"); err != nil || rehash != test.rehash {
+			t.Errorf("%s: rehash %v, err %v", test.name, rehash, err)
+		}
+	}
+}
+
+func TestArgon2idFormat(t *testing.T) {
+	hash, _ := fastArgon2id.Hash("secret")
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Errorf("Hash is %s", hash)
+	}
+	// a hash made by the reference implementation
+	ref := "$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc"
+	if err := (Argon2id{}).Compare(ref, "password"); err != nil {
+		t.Error(err, "- Reference hash does not match")
+	}
+}
+
+func TestUnknownHash(t *testing.T) {
+	h := NewHasher(Bcrypt{})
+	for _, hash := range []string{"", "plain", "$argon2id$v=19$m=0,t=1,p=1$c29tZXNhbHQ$"} {
+		if _, err := h.Compare(hash, ""); err == nil {
+			t.Errorf("%q matches", hash)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package password
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Policy is what new passwords must satisfy, the zero value accepts any
+// password but an empty one
+type Policy struct {
+	MinLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	// MaxBytes limits the length of the UTF-8 encoded password unless it is
+	// zero, see BcryptMaxBytes
+	MaxBytes int
+	// Breached refuses passwords known from data breaches unless it is nil
+	Breached BreachedList
+}
+
+// minPersonalLength is the shortest name or email part a password may not contain,
+// shorter ones would refuse too many passwords
+const minPersonalLength = 3
+
+// Check returns the problems of the password, which must not contain any of
+// the personal strings like the name or the email of the user. The error is
+// only set if the breached list cannot be read, the other rules are checked
+// nonetheless.
+func (p Policy) Check(password string, personal ...string) (problems []string, err error) {
+	if password == "" {
+		problems = append(problems, "The password must not be empty")
+	} else if n := utf8.RuneCountInString(password); n < p.MinLength {
+		problems = append(problems, fmt.Sprintf("The password must be at least %d characters long", p.MinLength))
+	} else if p.MaxBytes > 0 && len(password) > p.MaxBytes {
+		problems = append(problems, fmt.Sprintf("The password must be at most %d bytes long, accented letters and other special characters count as several bytes", p.MaxBytes))
+	}
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	if p.RequireUpper && !upper {
+		problems = append(problems, "The password must contain an upper case letter")
+	}
+	if p.RequireLower && !lower {
+		problems = append(problems, "The password must contain a lower case letter")
+	}
+	if p.RequireDigit && !digit {
+		problems = append(problems, "The password must contain a digit")
+	}
+	if p.RequireSymbol && !symbol {
+		problems = append(problems, "The password must contain a symbol")
+	}
+	if containsPersonal(password, personal) {
+		problems = append(problems, "The password must not contain your name or email address")
+	}
+	if p.Breached != nil {
+		var breached bool
+		if breached, err = Breached(p.Breached, password); breached {
+			problems = append(problems, "The password has appeared in a data breach, please choose another one")
+		}
+	}
+	return
+}
+
+// containsPersonal reports whether the password contains one of the personal
+// strings, of emails the part before the @ counts as well
+func containsPersonal(password string, personal []string) bool {
+	password = strings.ToLower(password)
+	for _, s := range personal {
+		s = strings.ToLower(strings.TrimSpace(s))
+		parts := []string{s}
+		if at := strings.LastIndex(s, "@"); at > 0 {
+			parts = append(parts, s[:at])
+		}
+		for _, part := range parts {
+			if utf8.RuneCountInString(part) >= minPersonalLength && strings.Contains(password, part) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package password
+
+import (
+	"bufio"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPolicy(t *testing.T) {
+	policy := Policy{MinLength: 8, RequireUpper: true, RequireLower: true, RequireDigit: true, RequireSymbol: true}
+	tests := []struct {
+		password string
+		problems int
+	}{
+		{"Correct-h0rse", 0},
+		{"123", 4},
+		{"correct-h0rse", 1},
+		{"CORRECT-H0RSE", 1},
+		{"Correct-horse", 1},
+		{"Correcth0rse", 1},
+		{"Jöhn-D0e-99", 1},
+		{"Peter-2024-x", 1},
+		{"x-peter@gmail.com-1X", 1},
+	}
+	for _, test := range tests {
+		problems, err := policy.Check(test.password, "John Doe", "Jöhn-D0e", "peter@gmail.com")
+		if err != nil || len(problems) != test.problems {
+			t.Errorf("%s: %d problems %v, want %d", test.password, len(problems), problems, test.problems)
+		}
+	}
+	// bcrypt hashes up to 72 bytes, ö takes two of them
+	bcrypt := Policy{MinLength: 8, MaxBytes: BcryptMaxBytes}
+	if problems, _ := bcrypt.Check(strings.Repeat("x", BcryptMaxBytes)); problems != nil {
+		t.Errorf("Longest password refused: %v", problems)
+	}
+	if problems, _ := bcrypt.Check(strings.Repeat("ö", BcryptMaxBytes/2+1)); len(problems) != 1 || !strings.Contains(problems[0], "at most 72 bytes") {
+		t.Errorf("Too long password: problems %v", problems)
+	}
+	if problems, _ := (Policy{}).Check("1"); problems != nil {
+		t.Errorf("Zero policy refuses %v", problems)
+	}
+}
+
+func TestBreachedFile(t *testing.T) {
+	list := BreachedFile{"testdata/breached.txt"}
+	f, err := os.Open(list.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// every hash of the file is found by its prefix
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		hash := hashOf(scanner.Text())
+		suffixes, err := list.Range(hash[:breachedPrefixLength])
+		if err != nil || !strSliceContains(suffixes, hash[breachedPrefixLength:]) {
+			t.Errorf("%s: suffixes %v, err %v", hash, suffixes, err)
+		}
+	}
+
+	suffixes, err := list.Range("5BAA6")
+	if want := []string{"00000000000000000000000000000000000", "1E4C9B93F3F0682250B6CF8331B7EE68FD8"}; err != nil || !reflect.DeepEqual(suffixes, want) {
+		t.Errorf("Range 5BAA6 is %v, err %v", suffixes, err)
+	}
+	for _, prefix := range []string{"00000", "5BAA5", "FFFFF"} {
+		if suffixes, err := list.Range(prefix); err != nil || len(suffixes) != 0 {
+			t.Errorf("Range %s is %v, err %v", prefix, suffixes, err)
+		}
+	}
+
+	for password, want := range map[string]bool{"password": true, "sunshine": true, "Correct-h0rse": false} {
+		if breached, err := Breached(list, password); err != nil || breached != want {
+			t.Errorf("%s: breached %v, err %v", password, breached, err)
+		}
+	}
+	problems, err := Policy{Breached: list}.Check("letmein")
+	if err != nil || len(problems) != 1 || !strings.Contains(problems[0], "breach") {
+		t.Errorf("Problems %v, err %v", problems, err)
+	}
+	if _, err = (Policy{Breached: BreachedFile{"testdata/missing.txt"}}).Check("letmein"); err == nil {
+		t.Error("Missing list is not reported")
+	}
+}
+
+func strSliceContains(slice []string, s string) bool {
+	for _, v := range slice {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
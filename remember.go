@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/bakhtik/webapp_template/data"
+)
+
+// rememberCookieName is the cookie carrying the remember token of a login
+const rememberCookieName = "remember"
+
+// rememberEnabled reports whether users can choose to stay signed in
+func rememberEnabled() bool {
+	return config.RememberLifetime > 0
+}
+
+// rememberLogin issues a remember token for the new session, so that its
+// user is signed in again once the session expired
+func (s *server) rememberLogin(w http.ResponseWriter, req *http.Request, sess *data.Session) {
+	expiresAt := time.Now().Add(time.Duration(config.RememberLifetime) * time.Second)
+	token, err := s.remember.CreateRememberToken(req.Context(), sess, expiresAt)
+	if err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot create remember token")
+		return
+	}
+	http.SetCookie(w, newCookie(rememberCookieName, token, config.RememberLifetime))
+}
+
+// clearRememberCookie removes the remember cookie
+func clearRememberCookie(w http.ResponseWriter) {
+	http.SetCookie(w, newCookie(rememberCookieName, "", -1))
+}
+
+// restored signs the user of a remember cookie in again if the request has no
+// valid session, before the handlers look for the session. Every use of a
+// token replaces it, so it must run only once for a request.
+func (s *server) restored(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		cookie, err := req.Cookie(cookieName(rememberCookieName))
+		if err == nil && cookie.Value != "" {
+			if _, err = s.validSession(req); err != nil {
+				req = s.restoreSession(w, req, cookie.Value)
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// restoreSession creates a session from the remember token and returns the
+// request carrying it. A stolen token signs out all sessions of its user.
+func (s *server) restoreSession(w http.ResponseWriter, req *http.Request, token string) *http.Request {
+	sess, next, err := s.remember.RestoreSession(req.Context(), token, clientDevice(req))
+	switch err {
+	case nil:
+	case data.ErrTokenTheft:
+		logger.SetPrefix("WARNING ")
+		logger.Printf("Replaced remember token of user %d used from %s, signing out all sessions", sess.UserId, clientIP(req))
+		if err = s.sessions.DeleteUserSessions(req.Context(), &data.User{Id: sess.UserId}, ""); err != nil {
+			logger.SetPrefix("ERROR ")
+			logger.Println(err, "Cannot delete sessions")
+		}
+		clearRememberCookie(w)
+		return req
+	case data.ErrInvalidToken:
+		clearRememberCookie(w)
+		return req
+	default:
+		// keep the cookie, the token may work on the next request
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot restore session")
+		return req
+	}
+	s.setSessionCookie(w, sess)
+	// concurrent requests with the replaced token leave the new one alone
+	if next != "" {
+		http.SetCookie(w, newCookie(rememberCookieName, next, config.RememberLifetime))
+	}
+	logger.SetPrefix("INFO ")
+	logger.Printf("Session %d of user %d restored from remember token", sess.Id, sess.UserId)
+	return s.withSession(req, sess)
+}
+
+// forgetLogins deletes the remember tokens of the user, except the one of the
+// session with exceptSessionId, when its sessions are signed out
+func (s *server) forgetLogins(req *http.Request, user *data.User, exceptSessionId int) {
+	if err := s.remember.DeleteUserRememberTokens(req.Context(), user, exceptSessionId); err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot delete remember tokens")
+	}
+}
+
+// forgetLogin deletes the remember token of a session which is signed out
+func (s *server) forgetLogin(req *http.Request, sess *data.Session) {
+	if err := s.remember.DeleteSessionRememberToken(req.Context(), sess); err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot delete remember token")
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/bakhtik/webapp_template/data"
+)
+
+// rememberedLogin signs the user in with "remember me" and returns the cookies
+func rememberedLogin(t *testing.T, user data.User) (session, remember *http.Cookie) {
+	form := url.Values{"email": {user.Email}, "password": {"john_pass"}, "remember": {"1"}}
+	req := httptest.NewRequest("POST", "/authenticate", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	testServer.authenticate(w, req)
+	session, remember = responseCookie(w.Result(), "session"), responseCookie(w.Result(), "remember")
+	if session == nil || remember == nil || remember.MaxAge != config.RememberLifetime || !remember.HttpOnly {
+		t.Fatalf("Login not remembered: %v, %v", session, remember)
+	}
+	return
+}
+
+// restore sends a request with the cookies through the remember and
+// authentication middleware and returns the response and the request the
+// handler got, which is nil if it was refused
+func restore(cookies ...*http.Cookie) (w *httptest.ResponseRecorder, seen *http.Request) {
+	handler := testServer.restored(testServer.authenticated(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		seen = req
+	})))
+	req := httptest.NewRequest("GET", "/profile", nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return
+}
+
+func TestLoginNotRememberedByDefault(t *testing.T) {
+	user := newTestUser(t, "peter@gmail.com", "user")
+	form := url.Values{"email": {user.Email}, "password": {"john_pass"}}
+	req := httptest.NewRequest("POST", "/authenticate", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	testServer.authenticate(w, req)
+	if c := responseCookie(w.Result(), "remember"); c != nil {
+		t.Errorf("Login remembered without asking: %v", c)
+	}
+
+	w = httptest.NewRecorder()
+	testServer.login(w, httptest.NewRequest("GET", "/login", nil))
+	if !strings.Contains(w.Body.String(), `name="remember"`) {
+		t.Error("No remember me option on the login page")
+	}
+}
+
+func TestRememberRestoresSession(t *testing.T) {
+	user := newTestUser(t, "peter@gmail.com", "user")
+	session, remember := rememberedLogin(t, user)
+	expired := data.Session{Uuid: cookieUuid(t, session)}
+	store.DeleteSessionByUUID(ctx, &expired)
+
+	w, seen := restore(session, remember)
+	if seen == nil {
+		t.Fatalf("Remembered user refused, response code is %v", w.Code)
+	}
+	restored, rotated := responseCookie(w.Result(), "session"), responseCookie(w.Result(), "remember")
+	if restored == nil || cookieUuid(t, restored) == expired.Uuid {
+		t.Fatalf("No new session cookie: %v", restored)
+	}
+	if c, err := seen.Cookie("session"); err != nil || cookieUuid(t, c) != cookieUuid(t, restored) {
+		t.Error("Handler did not get the restored session")
+	}
+	if rotated == nil || rotated.Value == remember.Value {
+		t.Fatalf("Remember token not rotated: %v", rotated)
+	}
+
+	// without a session cookie at all, the rotated token works again
+	w, seen = restore(rotated)
+	latest := responseCookie(w.Result(), "remember")
+	if seen == nil || latest == nil {
+		t.Fatalf("Rotated token refused, response code is %v", w.Code)
+	}
+
+	// the first token was replaced twice, so a thief used it or its owner used a copy
+	w, seen = restore(remember)
+	if seen != nil {
+		t.Error("Stolen remember token accepted")
+	}
+	if c := responseCookie(w.Result(), "remember"); c == nil || c.MaxAge >= 0 {
+		t.Errorf("Remember cookie not cleared: %v", c)
+	}
+	if sessions, _ := store.UserSessions(ctx, &user); len(sessions) != 0 {
+		t.Errorf("%d session(s) of the robbed user kept", len(sessions))
+	}
+	if _, seen = restore(latest); seen != nil {
+		t.Error("Remember token of the robbed user kept")
+	}
+}
+
+func TestLogoutForgetsLogin(t *testing.T) {
+	user := newTestUser(t, "peter@gmail.com", "user")
+	session, remember := rememberedLogin(t, user)
+
+	req := httptest.NewRequest("POST", "/logout", nil)
+	req.AddCookie(session)
+	req.AddCookie(remember)
+	w := httptest.NewRecorder()
+	testServer.logout(w, req)
+	if c := responseCookie(w.Result(), "remember"); c == nil || c.MaxAge >= 0 {
+		t.Errorf("Remember cookie not cleared: %v", c)
+	}
+	if _, _, err := store.RestoreSession(ctx, remember.Value, data.Device{}); err != data.ErrInvalidToken {
+		t.Error(err, "- Remember token kept after logout")
+	}
+}
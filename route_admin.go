@@ -1,45 +1,61 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/bakhtik/webapp_template/data"
-	"golang.org/x/crypto/bcrypt"
 )
 
-func admin(w http.ResponseWriter, req *http.Request) {
-	sess, _ := session(w, req)
-	user, err := sess.User()
+func (s *server) admin(w http.ResponseWriter, req *http.Request) {
+	sess, _ := s.session(w, req)
+	user, err := s.sessions.SessionUser(req.Context(), &sess)
 	if err != nil {
 		logger.SetPrefix("ERROR ")
 		logger.Println(err, "Cannot fetch user")
 	}
-	users, err := data.Users()
+	users, err := s.users.Users(req.Context())
 	if err != nil {
 		logger.SetPrefix("ERROR ")
 		logger.Println(err, "Cannot fetch users")
 	}
+	invites, err := s.invites.Invites(req.Context())
+	if err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot fetch invites")
+	}
 	data := struct {
 		data.User
-		Users []data.User
+		Users      []data.User
+		Invites    []data.Invite
+		SignupMode string
+		Now        time.Time
 	}{
 		user,
 		users,
+		invites,
+		config.SignupMode,
+		time.Now(),
 	}
-	generateHTML(w, data, "layout", "private.navbar", "admin")
+	generateHTML(w, req, data, "layout", "private.navbar", "admin")
 
 }
 
 // POST /change_account_admin
 // changes user account (password)
-func changeAccountAdmin(w http.ResponseWriter, req *http.Request) {
+func (s *server) changeAccountAdmin(w http.ResponseWriter, req *http.Request) {
 	err := req.ParseForm()
 	if err != nil {
 		logger.SetPrefix("ERROR ")
 		logger.Println(err, "Cannot parse form")
 	}
 
-	user, err := data.UserByEmail(req.PostFormValue("origin_email"))
+	user, err := s.users.UserByEmail(req.Context(), req.PostFormValue("origin_email"))
 	if err != nil {
 		logger.SetPrefix("ERROR ")
 		logger.Println(err, "Cannot find user")
@@ -47,90 +63,420 @@ func changeAccountAdmin(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	user.Name = req.PostFormValue("name")
-	user.Email = req.PostFormValue("email")
-	user.Role = req.PostFormValue("role")
-
 	newPassword, confirmPassword := req.PostFormValue("new_password"), req.PostFormValue("confirm_password")
 	if newPassword != "" {
+		problems := s.passwordProblems(newPassword, user.Name, user.Email, req.PostFormValue("name"), req.PostFormValue("email"))
 		// check if provided passwords are the same
 		if newPassword != confirmPassword {
 			logger.SetPrefix("WARNING ")
 			logger.Printf("User %s: confirm password mismatch with new password", user.Name)
-			http.Error(w, "New passwords must match", http.StatusForbidden)
+			problems = append([]string{"New passwords must match"}, problems...)
+		}
+		if len(problems) > 0 {
+			s.renderProfileAdmin(w, req, http.StatusBadRequest, user, problems)
 			return
 		}
 
 		// generate hash for the provided password
-		bs, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.MinCost)
-		if err != nil {
+		if user.Password, err = s.passwords.Hash(newPassword); err != nil {
 			logger.SetPrefix("ERROR ")
 			logger.Println(err, "Cannot generate hash for new password")
 			http.Error(w, "Cannot generate hash for new password", http.StatusForbidden)
 			return
 		}
-		// store new password in the database
-		user.Password = string(bs)
+	}
+
+	roleChanged := user.Role != req.PostFormValue("role")
+	user.Name = req.PostFormValue("name")
+	user.Role = req.PostFormValue("role")
+	// a new email only replaces the old one once its owner confirms it
+	newEmail := req.PostFormValue("email")
+	emailChanged := !strings.EqualFold(newEmail, user.Email) && !strings.EqualFold(newEmail, user.PendingEmail)
+	if emailChanged {
+		if _, err = s.users.UserByEmail(req.Context(), newEmail); err == nil {
+			http.Error(w, "The email is used by another account", http.StatusConflict)
+			return
+		}
+		user.PendingEmail = newEmail
 	}
 	// update user
-	err = user.Update()
+	err = s.users.UpdateUser(req.Context(), &user)
 	if err != nil {
 		logger.SetPrefix("ERROR ")
 		logger.Println(err, "Cannot update user in the database")
 		http.Error(w, "Cannot generate hash for new password", http.StatusForbidden)
 		return
 	}
+	if emailChanged {
+		changed := user
+		s.sendLater(func(ctx context.Context) {
+			s.sendVerification(ctx, &changed, changed.PendingEmail)
+		})
+	}
+	// the new role applies to the live sessions at once as the role is read
+	// on every request, their ids are replaced on their next request
+	if roleChanged {
+		if err = s.sessions.RotateUserSessions(req.Context(), &user); err != nil {
+			logger.SetPrefix("ERROR ")
+			logger.Println(err, "Cannot rotate sessions")
+		}
+	}
+	if newPassword != "" {
+		s.credentialsChanged(w, req, &user)
+	}
 	http.Redirect(w, req, "/admin", http.StatusSeeOther)
 }
 
-// user delete
-func deleteUser(w http.ResponseWriter, req *http.Request) {
-	user, err := data.UserByEmail(req.FormValue("email"))
+// confirmation asks the admin to confirm a destructive action, the action
+// is only carried out when the form is posted back
+type confirmation struct {
+	data.User
+	Title   string
+	Message string
+	Action  string
+	Cancel  string
+	Fields  map[string]string
+}
+
+// confirm renders the confirmation page for the signed in admin
+func (s *server) confirm(w http.ResponseWriter, req *http.Request, c confirmation) {
+	sess, _ := s.session(w, req)
+	admin, err := s.sessions.SessionUser(req.Context(), &sess)
+	if err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot fetch user")
+	}
+	c.User = admin
+	generateHTML(w, req, c, "layout", "private.navbar", "confirm")
+}
+
+// GET /admin/delete_user
+// asks to confirm the deletion of a user
+func (s *server) confirmDeleteUser(w http.ResponseWriter, req *http.Request) {
+	user, err := s.users.UserByEmail(req.Context(), req.FormValue("email"))
+	if err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot find user")
+		http.Error(w, "Cannot find user", http.StatusNotFound)
+		return
+	}
+	s.confirm(w, req, confirmation{
+		Title:   "Delete user",
+		Message: fmt.Sprintf("Delete the account of %s (%s)? All of its sessions are signed out and this cannot be undone.", user.Name, user.Email),
+		Action:  "/admin/delete_user",
+		Cancel:  "/admin",
+		Fields:  map[string]string{"email": user.Email},
+	})
+}
+
+// POST, DELETE /admin/delete_user
+// deletes the user
+func (s *server) deleteUser(w http.ResponseWriter, req *http.Request) {
+	user, err := s.users.UserByEmail(req.Context(), req.FormValue("email"))
 	if err != nil {
 		logger.SetPrefix("ERROR ")
 		logger.Println(err, "Cannot find user")
 		http.Error(w, "Cannot find user", http.StatusForbidden)
 		return
 	}
-	err = user.Delete()
+	// stateless sessions are not deleted with the user but revoked
+	if err = s.sessions.DeleteUserSessions(req.Context(), &user, ""); err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot delete sessions")
+	}
+	err = s.users.DeleteUser(req.Context(), &user)
 	if err != nil {
 		logger.SetPrefix("ERROR ")
-		logger.Println(err, "Cannot delete user %s", user.Name)
+		logger.Printf("%v: Cannot delete user %s", err, user.Name)
 		http.Error(w, "Cannot delete user", http.StatusForbidden)
 		return
 	}
+	logger.SetPrefix("INFO ")
+	logger.Printf("User %s deleted", user.Email)
+	if req.Method == http.MethodDelete {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
 	http.Redirect(w, req, "/admin", http.StatusSeeOther)
 }
 
-// for updating users profiles (resetting passwords)
-func profileAdmin(w http.ResponseWriter, req *http.Request) {
-	sess, _ := session(w, req)
-	admin, err := sess.User()
+// POST /admin/unlock_user
+// lifts the login lockout of a user
+func (s *server) unlockUser(w http.ResponseWriter, req *http.Request) {
+	email := req.PostFormValue("email")
+	user, err := s.users.UserByEmail(req.Context(), email)
 	if err != nil {
 		logger.SetPrefix("ERROR ")
-		logger.Println(err, "Cannot fetch user")
+		logger.Println(err, "Cannot find user")
+		http.Error(w, "Cannot find user", http.StatusNotFound)
+		return
+	}
+	if err = s.users.UnlockUser(req.Context(), &user); err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot unlock user")
+		http.Error(w, "Cannot unlock user", http.StatusInternalServerError)
+		return
+	}
+	s.emailLimiter.reset(strings.ToLower(email))
+	logger.SetPrefix("INFO ")
+	logger.Printf("User %s unlocked", user.Email)
+	http.Redirect(w, req, "/admin", http.StatusSeeOther)
+}
+
+// POST /admin/reset_password
+// emails a password reset link to the user
+func (s *server) adminResetPassword(w http.ResponseWriter, req *http.Request) {
+	user, err := s.users.UserByEmail(req.Context(), req.PostFormValue("email"))
+	if err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot find user")
+		http.Error(w, "Cannot find user", http.StatusNotFound)
+		return
+	}
+	if err = s.sendPasswordReset(req.Context(), &user); err != nil {
+		http.Error(w, "Cannot send password reset email", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, req, "/admin/update_user?email="+url.QueryEscape(user.Email), http.StatusSeeOther)
+}
+
+// POST /admin/disable_two_factor
+// disables two-factor authentication of a user who lost the authenticator
+// app and the recovery codes
+func (s *server) adminDisableTwoFactor(w http.ResponseWriter, req *http.Request) {
+	user, err := s.users.UserByEmail(req.Context(), req.PostFormValue("email"))
+	if err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot find user")
+		http.Error(w, "Cannot find user", http.StatusNotFound)
+		return
+	}
+	if err = s.twoFactor.DisableTOTP(req.Context(), &user); err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot disable TOTP")
+		http.Error(w, "Cannot disable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	logger.SetPrefix("INFO ")
+	logger.Printf("Two-factor authentication of user %s disabled", user.Email)
+	if err = s.sessions.RotateUserSessions(req.Context(), &user); err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot rotate sessions")
+	}
+	http.Redirect(w, req, "/admin", http.StatusSeeOther)
+}
+
+// POST /admin/approve_user
+// lets a pending user sign in
+func (s *server) approveUser(w http.ResponseWriter, req *http.Request) {
+	user, err := s.users.UserByEmail(req.Context(), req.PostFormValue("email"))
+	if err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot find user")
+		http.Error(w, "Cannot find user", http.StatusNotFound)
+		return
+	}
+	user.Pending = false
+	if err = s.users.UpdateUser(req.Context(), &user); err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot approve user")
+		http.Error(w, "Cannot approve user", http.StatusInternalServerError)
+		return
+	}
+	logger.SetPrefix("INFO ")
+	logger.Printf("User %s approved", user.Email)
+	http.Redirect(w, req, "/admin", http.StatusSeeOther)
+}
+
+// POST /admin/create_invite
+// creates an invite for signing up with the given role, optionally bound to an email
+func (s *server) createInvite(w http.ResponseWriter, req *http.Request) {
+	invite := data.Invite{
+		Email:     req.PostFormValue("email"),
+		Role:      req.PostFormValue("role"),
+		ExpiresAt: time.Now().Add(time.Duration(config.InviteLifetime) * time.Second),
+	}
+	if !strSliceContains([]string{"user", "admin"}, invite.Role) {
+		http.Error(w, "Invalid role", http.StatusBadRequest)
+		return
+	}
+	if err := s.invites.CreateInvite(req.Context(), &invite); err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot create invite")
+		http.Error(w, "Cannot create invite", http.StatusInternalServerError)
+		return
+	}
+	logger.SetPrefix("INFO ")
+	logger.Printf("Invite %d for %q created with role %s", invite.Id, invite.Email, invite.Role)
+	http.Redirect(w, req, "/admin", http.StatusSeeOther)
+}
+
+// POST /admin/delete_invite
+// revokes an unused invite
+func (s *server) deleteInvite(w http.ResponseWriter, req *http.Request) {
+	id, err := strconv.Atoi(req.PostFormValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid invite", http.StatusBadRequest)
+		return
+	}
+	if err = s.invites.DeleteInvite(req.Context(), id); err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot delete invite")
+		http.Error(w, "Cannot delete invite", http.StatusInternalServerError)
+		return
 	}
+	http.Redirect(w, req, "/admin", http.StatusSeeOther)
+}
 
-	err = req.ParseForm()
+// for updating users profiles (resetting passwords)
+func (s *server) profileAdmin(w http.ResponseWriter, req *http.Request) {
+	err := req.ParseForm()
 	if err != nil {
 		logger.SetPrefix("ERROR ")
 		logger.Println(err, "Cannot parse form")
 	}
 
-	user, err := data.UserByEmail(req.FormValue("email"))
+	user, err := s.users.UserByEmail(req.Context(), req.FormValue("email"))
 	if err != nil {
 		logger.SetPrefix("ERROR ")
 		logger.Println(err, "Cannot find user")
 		http.Error(w, "Cannot find user", http.StatusForbidden)
 		return
 	}
+	s.renderProfileAdmin(w, req, http.StatusOK, user, nil)
+}
+
+// renderProfileAdmin shows the profile of the user to the admin with the
+// problems of a refused password change
+func (s *server) renderProfileAdmin(w http.ResponseWriter, req *http.Request, status int, user data.User, errors []string) {
+	sess, _ := s.session(w, req)
+	admin, err := s.sessions.SessionUser(req.Context(), &sess)
+	if err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot fetch user")
+	}
 
 	data := struct {
 		data.User
 		UserForUpdate data.User
+		Errors        []string
 	}{
 		admin,
 		user,
+		errors,
+	}
+	w.WriteHeader(status)
+	generateHTML(w, req, data, "layout", "private.navbar", "profile_admin")
+}
+
+// GET /admin/sessions
+// lists active sessions of all users or of the user with the given email
+func (s *server) adminSessions(w http.ResponseWriter, req *http.Request) {
+	sess, _ := s.session(w, req)
+	admin, err := s.sessions.SessionUser(req.Context(), &sess)
+	if err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot fetch user")
+	}
+
+	filter := data.User{Email: req.FormValue("email")}
+	if filter.Email != "" {
+		if filter, err = s.users.UserByEmail(req.Context(), filter.Email); err != nil {
+			logger.SetPrefix("ERROR ")
+			logger.Println(err, "Cannot find user")
+			http.Error(w, "Cannot find user", http.StatusNotFound)
+			return
+		}
+	}
+	sessions, err := s.sessions.Sessions(req.Context(), filter.Id)
+	if err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot fetch sessions")
+	}
+	// expired sessions are left until the janitor removes them
+	active := sessions[:0]
+	expiry, now := sessionExpiry(), time.Now()
+	for _, us := range sessions {
+		if !us.Expired(expiry, now) {
+			active = append(active, us)
+		}
+	}
+
+	data := struct {
+		data.User
+		Filter   data.User
+		Sessions []data.UserSession
+	}{
+		admin,
+		filter,
+		active,
+	}
+	generateHTML(w, req, data, "layout", "private.navbar", "admin_sessions")
+}
+
+// POST /admin/revoke_session
+// signs out a single session of a user
+func (s *server) adminRevokeSession(w http.ResponseWriter, req *http.Request) {
+	user, err := s.users.UserByEmail(req.Context(), req.PostFormValue("email"))
+	if err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot find user")
+		http.Error(w, "Cannot find user", http.StatusForbidden)
+		return
+	}
+	id, err := strconv.Atoi(req.PostFormValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid session", http.StatusBadRequest)
+		return
+	}
+	if err = s.sessions.DeleteUserSession(req.Context(), &user, id); err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot delete session")
+		http.Error(w, "Cannot delete session", http.StatusInternalServerError)
+		return
+	}
+	s.forgetLogin(req, &data.Session{Id: id, UserId: user.Id})
+	http.Redirect(w, req, "/admin/sessions?email="+url.QueryEscape(req.PostFormValue("filter")), http.StatusSeeOther)
+}
+
+// GET /admin/revoke_user_sessions
+// asks to confirm signing out all sessions of a user
+func (s *server) confirmRevokeUserSessions(w http.ResponseWriter, req *http.Request) {
+	user, err := s.users.UserByEmail(req.Context(), req.FormValue("email"))
+	if err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot find user")
+		http.Error(w, "Cannot find user", http.StatusNotFound)
+		return
+	}
+	filter := req.FormValue("filter")
+	s.confirm(w, req, confirmation{
+		Title:   "Revoke sessions",
+		Message: fmt.Sprintf("Sign out all sessions of %s (%s)?", user.Name, user.Email),
+		Action:  "/admin/revoke_user_sessions",
+		Cancel:  "/admin/sessions?email=" + url.QueryEscape(filter),
+		Fields:  map[string]string{"email": user.Email, "filter": filter},
+	})
+}
+
+// POST /admin/revoke_user_sessions
+// signs out all sessions of a user
+func (s *server) adminRevokeUserSessions(w http.ResponseWriter, req *http.Request) {
+	user, err := s.users.UserByEmail(req.Context(), req.PostFormValue("email"))
+	if err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot find user")
+		http.Error(w, "Cannot find user", http.StatusForbidden)
+		return
+	}
+	if err = s.sessions.DeleteUserSessions(req.Context(), &user, ""); err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot delete sessions")
+		http.Error(w, "Cannot delete sessions", http.StatusInternalServerError)
+		return
 	}
-	generateHTML(w, data, "layout", "private.navbar", "profile_admin")
+	s.forgetLogins(req, &user, 0)
+	logger.SetPrefix("INFO ")
+	logger.Printf("All sessions of user %s revoked", user.Email)
+	http.Redirect(w, req, "/admin/sessions?email="+url.QueryEscape(req.PostFormValue("filter")), http.StatusSeeOther)
 }
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bakhtik/webapp_template/data"
+)
+
+func TestAdminSessions(t *testing.T) {
+	admin := newTestUser(t, "john@gmail.com", "admin")
+	user := newTestUser(t, "peter@gmail.com", "user")
+	_, cookie := newTestSession(t, admin, data.Device{Label: "Firefox on Linux"})
+	newTestSession(t, user, data.Device{Label: "Safari on iPhone"})
+
+	req := httptest.NewRequest("GET", "/admin/sessions", nil)
+	req.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	testServer.adminSessions(w, req)
+	body := w.Body.String()
+	for _, want := range []string{"Firefox on Linux", "Safari on iPhone", user.Email} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Body does not contain %q", want)
+		}
+	}
+
+	req = httptest.NewRequest("GET", "/admin/sessions?email="+user.Email, nil)
+	req.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	testServer.adminSessions(w, req)
+	body = w.Body.String()
+	if strings.Contains(body, "Firefox on Linux") || !strings.Contains(body, "Safari on iPhone") {
+		t.Errorf("Sessions are not filtered by user")
+	}
+}
+
+func TestAdminRevokeSessions(t *testing.T) {
+	user := newTestUser(t, "peter@gmail.com", "user")
+	first, _ := newTestSession(t, user, data.Device{})
+	second, _ := newTestSession(t, user, data.Device{})
+	third, _ := newTestSession(t, user, data.Device{})
+
+	post := func(handler http.HandlerFunc, form string) {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if w.Code != http.StatusSeeOther {
+			t.Errorf("Response code is %v", w.Code)
+		}
+	}
+
+	post(testServer.adminRevokeSession, "email="+user.Email+"&id="+strconv.Itoa(first.Id))
+	sessions, _ := store.UserSessions(ctx, &user)
+	if len(sessions) != 2 {
+		t.Errorf("%d sessions left, want 2", len(sessions))
+	}
+	for _, s := range sessions {
+		if s.Id == first.Id {
+			t.Error("Session not revoked")
+		}
+	}
+
+	post(testServer.adminRevokeUserSessions, "email="+user.Email)
+	for _, s := range []data.Session{second, third} {
+		if err := store.CheckSession(ctx, &s, data.SessionExpiry{}, time.Now()); err == nil {
+			t.Error("Session not revoked")
+		}
+	}
+}
+
+func TestAdminDeleteUser(t *testing.T) {
+	admin := newTestUser(t, "john@gmail.com", "admin")
+	user := newTestUser(t, "peter@gmail.com", "user")
+	session, cookie := newTestSession(t, admin, data.Device{})
+	mux := testServer.routes()
+	token := testServer.csrfToken(session.Uuid)
+
+	// GET only asks for a confirmation
+	req := httptest.NewRequest("GET", "/admin/delete_user?email="+user.Email, nil)
+	req.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `action="/admin/delete_user"`) {
+		t.Errorf("Confirmation page not shown, response code is %v", w.Code)
+	}
+	if _, err := store.UserByEmail(ctx, user.Email); err != nil {
+		t.Error("User deleted without confirmation")
+	}
+
+	req = httptest.NewRequest("PUT", "/admin/delete_user?email="+user.Email, nil)
+	req.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "DELETE, GET, HEAD, OPTIONS, POST" {
+		t.Errorf("Response code is %v, Allow is %q", w.Code, w.Header().Get("Allow"))
+	}
+
+	req = httptest.NewRequest("DELETE", "/admin/delete_user?email="+user.Email, nil)
+	req.Header.Set(csrfHeaderName, token)
+	req.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Response code is %v", w.Code)
+	}
+	if _, err := store.UserByEmail(ctx, user.Email); err == nil {
+		t.Error("User not deleted")
+	}
+}
@@ -1,138 +1,363 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/bakhtik/webapp_template/data"
-	"golang.org/x/crypto/bcrypt"
 )
 
+// signup modes, the role of a new user is never taken from the signup form
+const (
+	// signupOpen lets anyone sign up as a user
+	signupOpen = "open"
+	// signupInvite lets only the holders of an invite sign up, with the role of the invite
+	signupInvite = "invite"
+	// signupApproval lets anyone sign up but the account stays pending until an admin approves it
+	signupApproval = "approval"
+)
+
+var signupModes = []string{"", signupOpen, signupInvite, signupApproval}
+
+// signupPage is the data of the signup template, a refused signup keeps the
+// name and email entered
+type signupPage struct {
+	Mode   string
+	Invite string
+	Name   string
+	Email  string
+	Errors []string
+}
+
+// loginPage is the data of the login template
+type loginPage struct {
+	Remember  bool
+	Providers []*oidcProvider
+}
+
 // GET /login
 // Show the login page
-func login(w http.ResponseWriter, req *http.Request) {
-	if _, err := session(w, req); err == nil { // user already logged in
+func (s *server) login(w http.ResponseWriter, req *http.Request) {
+	if _, err := s.session(w, req); err == nil { // user already logged in
 		http.Redirect(w, req, "/", http.StatusSeeOther)
 		return
 	}
-	generateHTML(w, nil, "layout", "public.navbar", "login")
+	generateHTML(w, req, loginPage{rememberEnabled(), s.providers}, "layout", "public.navbar", "login")
 }
 
 // GET /signup
 // Show the signup page
-func signup(w http.ResponseWriter, req *http.Request) {
-	if _, err := session(w, req); err == nil { // user already logged in
+func (s *server) signup(w http.ResponseWriter, req *http.Request) {
+	if _, err := s.session(w, req); err == nil { // user already logged in
 		http.Redirect(w, req, "/", http.StatusSeeOther)
 		return
 	}
-	generateHTML(w, nil, "layout", "public.navbar", "signup")
+	data := signupPage{Mode: config.SignupMode, Invite: req.FormValue("invite")}
+	generateHTML(w, req, data, "layout", "public.navbar", "signup")
 }
 
 // POST /singup_account
 // Create the user account
-func signupAccount(w http.ResponseWriter, req *http.Request) {
+func (s *server) signupAccount(w http.ResponseWriter, req *http.Request) {
 	err := req.ParseForm()
 	if err != nil {
 		logger.SetPrefix("ERROR ")
 		logger.Println(err, "Cannot parse form")
 	}
 	user := data.User{
-		Name:     req.PostFormValue("name"),
-		Email:    req.PostFormValue("email"),
-		Password: req.PostFormValue("password"),
-		Role:     req.PostFormValue("role"),
+		Name:  req.PostFormValue("name"),
+		Email: req.PostFormValue("email"),
+		Role:  "user",
+	}
+	// refuse the password before an invite is spent
+	if problems := s.passwordProblems(req.PostFormValue("password"), user.Name, user.Email); len(problems) > 0 {
+		data := signupPage{config.SignupMode, req.PostFormValue("invite"), user.Name, user.Email, problems}
+		w.WriteHeader(http.StatusBadRequest)
+		generateHTML(w, req, data, "layout", "public.navbar", "signup")
+		return
+	}
+	if user.Password, err = s.passwords.Hash(req.PostFormValue("password")); err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot generate hash for password")
+		http.Error(w, "Cannot create account", http.StatusInternalServerError)
+		return
 	}
-	if err = user.Create(); err != nil {
+	user.Pending = config.SignupMode == signupApproval
+	if config.SignupMode == signupInvite {
+		// the invite is only used up once the user is created
+		err = s.invites.CreateInvitedUser(req.Context(), &user, req.PostFormValue("invite"))
+		if err == data.ErrInvalidInvite {
+			logger.SetPrefix("WARNING ")
+			logger.Println(err, "Cannot use invite")
+			http.Error(w, "The invite is invalid or has expired", http.StatusForbidden)
+			return
+		}
+	} else {
+		err = s.users.CreateUser(req.Context(), &user)
+	}
+	if err != nil {
 		logger.SetPrefix("ERROR ")
 		logger.Println(err, "Cannot create user")
+		http.Redirect(w, req, "/login", http.StatusSeeOther)
+		return
+	}
+	s.sendLater(func(ctx context.Context) {
+		s.sendVerification(ctx, &user, user.Email)
+	})
+	if user.Pending {
+		generateHTML(w, req, nil, "layout", "public.navbar", "pending")
+		return
 	}
 	http.Redirect(w, req, "/login", http.StatusSeeOther)
 }
 
 // POST /authenticate
 // Authenticate the user given the email and password
-func authenticate(w http.ResponseWriter, req *http.Request) {
+func (s *server) authenticate(w http.ResponseWriter, req *http.Request) {
 	err := req.ParseForm()
 	if err != nil {
 		logger.SetPrefix("ERROR ")
 		logger.Println(err, "Cannot parse form")
 	}
-	user, err := data.UserByEmail(req.PostFormValue("email"))
-	if err != nil {
+	email, now := req.PostFormValue("email"), time.Now()
+	if ok, retryAfter := s.loginAllowed(req, email, now); !ok {
+		tooManyAttempts(w, retryAfter)
+		return
+	}
+	user, err := s.users.UserByEmail(req.Context(), email)
+	if err != nil && err != sql.ErrNoRows {
 		logger.SetPrefix("ERROR ")
 		logger.Println(err, "Cannot find user")
 	}
+	// a locked account refuses logins without checking the password
+	if user.Locked(now) {
+		logger.SetPrefix("WARNING ")
+		logger.Printf("Login to locked account %s from %s", user.Email, clientIP(req))
+		tooManyAttempts(w, user.LockedUntil.Sub(now))
+		return
+	}
 
-	// does the entered password match the stored password?
-	if err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.PostFormValue("password"))); err == nil {
-		session, err := user.CreateSession()
-		if err != nil {
-			logger.SetPrefix("ERROR ")
-			logger.Println(err, "Cannot create session")
+	// does the entered password match the stored password? Without a user
+	// or password it takes as long to find out, so that the time taken
+	// doesn't reveal which emails are registered.
+	var rehash bool
+	if user.Password == "" {
+		err = s.passwords.CompareDummy(req.PostFormValue("password"))
+	} else {
+		rehash, err = s.passwords.Compare(user.Password, req.PostFormValue("password"))
+	}
+	if err == nil {
+		if rehash {
+			s.rehashPassword(req.Context(), &user, req.PostFormValue("password"))
 		}
-		cookie := http.Cookie{
-			Name:     "session",
-			Value:    session.Uuid,
-			HttpOnly: true,
+		if user.Pending {
+			w.WriteHeader(http.StatusForbidden)
+			generateHTML(w, req, nil, "layout", "public.navbar", "pending")
+			return
 		}
-		http.SetCookie(w, &cookie)
-		http.Redirect(w, req, "/", http.StatusSeeOther)
+		if config.RequireEmailVerification && !user.EmailVerified() {
+			w.WriteHeader(http.StatusForbidden)
+			generateHTML(w, req, verifyEmailPage{Email: user.Email}, "layout", "public.navbar", "verify_email")
+			return
+		}
+		remember := rememberEnabled() && req.PostFormValue("remember") != ""
+		// failed logins are only reset once the second step succeeds too
+		if user.TwoFactorEnabled() {
+			s.startTwoFactor(w, req, &user, remember)
+			return
+		}
+		s.signIn(w, req, &user, remember)
 	} else {
+		if user.Id != 0 {
+			s.loginFailed(req.Context(), &user)
+		}
 		http.Redirect(w, req, "/login", http.StatusSeeOther)
 	}
 }
 
-// GET /logout
+// signIn creates a session for the user who proved who they are and
+// resets the failed logins, remember keeps them signed in after the session
+func (s *server) signIn(w http.ResponseWriter, req *http.Request, user *data.User, remember bool) {
+	if user.FailedLogins > 0 {
+		if err := s.users.UnlockUser(req.Context(), user); err != nil {
+			logger.SetPrefix("ERROR ")
+			logger.Println(err, "Cannot reset failed logins")
+		}
+	}
+	// a session id from before the login, maybe planted by someone else, must not stay valid
+	if cookie, err := req.Cookie(cookieName(sessionCookieName)); err == nil {
+		if old, err := s.tokens.parse(cookie.Value); err == nil {
+			if err = s.sessions.DeleteSessionByUUID(req.Context(), &old); err != nil {
+				logger.SetPrefix("WARNING ")
+				logger.Println(err, "Cannot delete previous session")
+			}
+		}
+	}
+	session, err := s.users.CreateSession(req.Context(), user, clientDevice(req))
+	if err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot create session")
+	}
+	s.setSessionCookie(w, session)
+	if remember && err == nil {
+		s.rememberLogin(w, req, &session)
+	} else if _, err = req.Cookie(cookieName(rememberCookieName)); err == nil {
+		// the login of someone else must not be restored later
+		clearRememberCookie(w)
+	}
+	http.Redirect(w, req, "/", http.StatusSeeOther)
+}
+
+// rehashPassword replaces the hash of the user's password made with an
+// outdated algorithm or parameters, a failure keeps the old hash
+func (s *server) rehashPassword(ctx context.Context, user *data.User, password string) {
+	hash, err := s.passwords.Hash(password)
+	if err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot generate hash for password")
+		return
+	}
+	user.Password = hash
+	if err = s.users.UpdateUser(ctx, user); err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot update password hash")
+		return
+	}
+	logger.SetPrefix("INFO ")
+	logger.Printf("Password hash of user %s upgraded", user.Email)
+}
+
+// passwordProblems checks a new password against the policy, personal are
+// the name and emails of its user. A breached list which cannot be read is
+// logged and doesn't refuse the password.
+func (s *server) passwordProblems(password string, personal ...string) []string {
+	problems, err := s.policy.Check(password, personal...)
+	if err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot check breached passwords")
+	}
+	return problems
+}
+
+// POST /logout
 // Logs the user out
-func logout(w http.ResponseWriter, req *http.Request) {
+func (s *server) logout(w http.ResponseWriter, req *http.Request) {
 
-	sess, err := session(w, req)
+	sess, err := s.session(w, req)
 	// delete the session
-	if err = sess.DeleteByUUID(); err != nil {
+	if err = s.sessions.DeleteSessionByUUID(req.Context(), &sess); err != nil {
 		logger.SetPrefix("WARNING ")
 		logger.Println(err, "Failed to delete sesssion")
 	}
-	// remove the cookie
-	cookie := &http.Cookie{
-		Name:   "session",
-		Value:  "",
-		MaxAge: -1,
-	}
-	http.SetCookie(w, cookie)
-
-	// Clean up sessions
-	if time.Now().Sub(sessionsCleaned) > (time.Second * time.Duration(config.SessionLength)) {
-		go data.CleanSessions(config.SessionLength)
-	}
+	s.forgetLogin(req, &sess)
+	// remove the cookies
+	clearSessionCookie(w)
+	clearRememberCookie(w)
 
 	http.Redirect(w, req, "/", http.StatusSeeOther)
 }
 
 // GET /profile
 // Show the profile page
-func profile(w http.ResponseWriter, req *http.Request) {
-	sess, _ := session(w, req)
-	user, err := sess.User()
+func (s *server) profile(w http.ResponseWriter, req *http.Request) {
+	s.renderProfile(w, req, http.StatusOK, nil)
+}
+
+// renderProfile shows the profile page with the problems of a refused password change
+func (s *server) renderProfile(w http.ResponseWriter, req *http.Request, status int, errors []string) {
+	sess, _ := s.session(w, req)
+	user, err := s.sessions.SessionUser(req.Context(), &sess)
 	if err != nil {
 		logger.SetPrefix("ERROR ")
 		logger.Println(err, "Cannot fetch user")
 	}
+	sessions, err := s.users.UserSessions(req.Context(), &user)
+	if err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot fetch sessions")
+	}
+	left, err := s.twoFactor.RecoveryCodesLeft(req.Context(), &user)
+	if err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot count recovery codes")
+	}
 	data := struct {
 		data.User
-	}{user}
-	generateHTML(w, data, "layout", "private.navbar", "profile")
+		Sessions          []data.Session
+		CurrentSession    data.Session
+		RecoveryCodesLeft int
+		TwoFactorRequired bool
+		Errors            []string
+	}{user, sessions, sess, left, twoFactorRequired(user), errors}
+	w.WriteHeader(status)
+	generateHTML(w, req, data, "layout", "private.navbar", "profile")
+}
+
+// POST /profile/revoke_session
+// Signs out one of the user's sessions
+func (s *server) revokeSession(w http.ResponseWriter, req *http.Request) {
+	sess, _ := s.session(w, req)
+	user, err := s.sessions.SessionUser(req.Context(), &sess)
+	if err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot fetch user")
+		http.Error(w, "Cannot find user", http.StatusForbidden)
+		return
+	}
+	id, err := strconv.Atoi(req.PostFormValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid session", http.StatusBadRequest)
+		return
+	}
+	// the store only deletes the session if it belongs to the user
+	if err = s.sessions.DeleteUserSession(req.Context(), &user, id); err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot delete session")
+		http.Error(w, "Cannot delete session", http.StatusInternalServerError)
+		return
+	}
+	s.forgetLogin(req, &data.Session{Id: id, UserId: user.Id})
+	http.Redirect(w, req, "/profile", http.StatusSeeOther)
+}
+
+// POST /profile/revoke_other_sessions
+// Signs out all sessions of the user except the current one
+func (s *server) revokeOtherSessions(w http.ResponseWriter, req *http.Request) {
+	sess, _ := s.session(w, req)
+	user, err := s.sessions.SessionUser(req.Context(), &sess)
+	if err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot fetch user")
+		http.Error(w, "Cannot find user", http.StatusForbidden)
+		return
+	}
+	if err = s.sessions.DeleteUserSessions(req.Context(), &user, sess.Uuid); err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot delete sessions")
+		http.Error(w, "Cannot delete sessions", http.StatusInternalServerError)
+		return
+	}
+	s.forgetLogins(req, &user, sess.Id)
+	http.Redirect(w, req, "/profile", http.StatusSeeOther)
 }
 
 // POST /change_account
 // changes user account (password)
-func changeAccount(w http.ResponseWriter, req *http.Request) {
+func (s *server) changeAccount(w http.ResponseWriter, req *http.Request) {
 	err := req.ParseForm()
 	if err != nil {
 		logger.SetPrefix("ERROR ")
 		logger.Println(err, "Cannot parse form")
 	}
 
-	user, err := data.UserByEmail(req.PostFormValue("email"))
+	// the account is the one signed in, whatever email was posted
+	sess, _ := s.session(w, req)
+	user, err := s.users.UserById(req.Context(), sess.UserId)
 	if err != nil {
 		logger.SetPrefix("ERROR ")
 		logger.Println(err, "Cannot find user")
@@ -140,42 +365,282 @@ func changeAccount(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// check if old password matches with existing one
+	// the old password is guessed no faster than at the login
+	now := time.Now()
+	if ok, retryAfter := s.loginAllowed(req, user.Email, now); !ok {
+		tooManyAttempts(w, retryAfter)
+		return
+	}
+	if user.Locked(now) {
+		logger.SetPrefix("WARNING ")
+		logger.Printf("Password change of locked account %s from %s", user.Email, clientIP(req))
+		tooManyAttempts(w, user.LockedUntil.Sub(now))
+		return
+	}
 	// does the entered password match the stored password?
-	if err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.PostFormValue("old_password"))); err != nil {
+	if _, err = s.passwords.Compare(user.Password, req.PostFormValue("old_password")); err != nil {
 		logger.SetPrefix("ERROR ")
 		logger.Println(err, "Old passwords invalid")
+		s.loginFailed(req.Context(), &user)
 		http.Error(w, "Old password invalid", http.StatusForbidden)
 		return
 	}
 
 	newPassword, confirmPassword := req.PostFormValue("new_password"), req.PostFormValue("confirm_password")
+	problems := s.passwordProblems(newPassword, user.Name, user.Email)
 	// check if provided passwords are the same
 	if newPassword != confirmPassword {
 		logger.SetPrefix("WARNING ")
 		logger.Printf("User %s: confirm password mismatch with new password", user.Name)
-		http.Error(w, "New passwords must match", http.StatusForbidden)
+		problems = append([]string{"New passwords must match"}, problems...)
+	}
+	if len(problems) > 0 {
+		s.renderProfile(w, req, http.StatusBadRequest, problems)
 		return
 	}
 
 	// generate hash for the provided password
-	bs, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.MinCost)
-	if err != nil {
+	if user.Password, err = s.passwords.Hash(newPassword); err != nil {
 		logger.SetPrefix("ERROR ")
 		logger.Println(err, "Cannot generate hash for new password")
 		http.Error(w, "Cannot generate hash for new password", http.StatusForbidden)
 		return
 	}
-	// store new password in the database
-	user.Password = string(bs)
 
 	// update user
-	err = user.Update()
+	err = s.users.UpdateUser(req.Context(), &user)
 	if err != nil {
 		logger.SetPrefix("ERROR ")
 		logger.Println(err, "Cannot update user in the database")
 		http.Error(w, "Cannot generate hash for new password", http.StatusForbidden)
 		return
 	}
+	s.credentialsChanged(w, req, &user)
 	http.Redirect(w, req, "/", http.StatusSeeOther)
 }
+
+// GET /forgot_password
+// Show the page to request a password reset link
+func (s *server) forgotPassword(w http.ResponseWriter, req *http.Request) {
+	generateHTML(w, req, struct{ Sent bool }{}, "layout", "public.navbar", "forgot_password")
+}
+
+// POST /forgot_password
+// Send a password reset link to the email, the response is the same whether
+// the email is registered or not
+func (s *server) requestPasswordReset(w http.ResponseWriter, req *http.Request) {
+	email := req.PostFormValue("email")
+	if ok, retryAfter := s.loginAllowed(req, email, time.Now()); !ok {
+		tooManyAttempts(w, retryAfter)
+		return
+	}
+	ip := clientIP(req)
+	s.sendLater(func(ctx context.Context) {
+		user, err := s.users.UserByEmail(ctx, email)
+		if err != nil {
+			logger.SetPrefix("WARNING ")
+			logger.Printf("Password reset requested for unknown email %s from %s", email, ip)
+			return
+		}
+		s.sendPasswordReset(ctx, &user)
+	})
+	generateHTML(w, req, struct{ Sent bool }{true}, "layout", "public.navbar", "forgot_password")
+}
+
+// sendPasswordReset emails a password reset link to the user
+func (s *server) sendPasswordReset(ctx context.Context, user *data.User) (err error) {
+	expiresAt := time.Now().Add(time.Duration(config.PasswordResetLifetime) * time.Second)
+	token, err := s.resets.CreatePasswordReset(ctx, user, expiresAt)
+	if err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot create password reset")
+		return
+	}
+	link := strings.TrimRight(config.BaseURL, "/") + "/reset_password?token=" + url.QueryEscape(token)
+	data := struct {
+		Name      string
+		Link      string
+		ExpiresAt time.Time
+	}{user.Name, link, expiresAt}
+	return s.sendMail(ctx, user.Email, "password_reset", data)
+}
+
+// resetPasswordPage is the data of the reset_password template
+type resetPasswordPage struct {
+	Token   string
+	Invalid bool
+	Errors  []string
+}
+
+// GET /reset_password
+// Show the form for a new password if the reset link is valid
+func (s *server) resetPasswordForm(w http.ResponseWriter, req *http.Request) {
+	token := req.FormValue("token")
+	data := resetPasswordPage{Token: token}
+	if _, err := s.resets.PasswordReset(req.Context(), token); err != nil {
+		data.Invalid = true
+		w.WriteHeader(http.StatusForbidden)
+	}
+	generateHTML(w, req, data, "layout", "public.navbar", "reset_password")
+}
+
+// POST /reset_password
+// Set the new password and sign out all sessions of the user
+func (s *server) resetPassword(w http.ResponseWriter, req *http.Request) {
+	token := req.PostFormValue("token")
+	invalid := func(err error) {
+		logger.SetPrefix("WARNING ")
+		logger.Printf("%v: Password reset from %s", err, clientIP(req))
+		w.WriteHeader(http.StatusForbidden)
+		generateHTML(w, req, resetPasswordPage{Invalid: true}, "layout", "public.navbar", "reset_password")
+	}
+	// the token is only spent once the password is accepted
+	reset, err := s.resets.PasswordReset(req.Context(), token)
+	if err != nil {
+		invalid(err)
+		return
+	}
+	user, err := s.users.UserById(req.Context(), reset.UserId)
+	if err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot find user")
+		http.Error(w, "Cannot find user", http.StatusNotFound)
+		return
+	}
+	newPassword, confirmPassword := req.PostFormValue("new_password"), req.PostFormValue("confirm_password")
+	problems := s.passwordProblems(newPassword, user.Name, user.Email)
+	if newPassword != confirmPassword {
+		problems = append([]string{"New passwords must match"}, problems...)
+	}
+	if len(problems) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		generateHTML(w, req, resetPasswordPage{Token: token, Errors: problems}, "layout", "public.navbar", "reset_password")
+		return
+	}
+	if _, err = s.resets.UsePasswordReset(req.Context(), token); err != nil {
+		invalid(err)
+		return
+	}
+
+	// generate hash for the provided password
+	if user.Password, err = s.passwords.Hash(newPassword); err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot generate hash for new password")
+		http.Error(w, "Cannot generate hash for new password", http.StatusInternalServerError)
+		return
+	}
+	if err = s.users.UpdateUser(req.Context(), &user); err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot update user in the database")
+		http.Error(w, "Cannot update password", http.StatusInternalServerError)
+		return
+	}
+	// whoever knew the old password must not stay signed in
+	if err = s.sessions.DeleteUserSessions(req.Context(), &user, ""); err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot delete sessions")
+	}
+	s.forgetLogins(req, &user, 0)
+	// the owner of the email proved who they are, the lockout no longer protects anything
+	if err = s.users.UnlockUser(req.Context(), &user); err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot unlock user")
+	}
+	s.emailLimiter.reset(strings.ToLower(user.Email))
+	logger.SetPrefix("INFO ")
+	logger.Printf("Password of user %s reset", user.Email)
+	http.Redirect(w, req, "/login", http.StatusSeeOther)
+}
+
+// verifyEmailPurpose is what email verification tokens are signed for
+const verifyEmailPurpose = "verify-email"
+
+// verifyEmailPage is the data of the verify_email template
+type verifyEmailPage struct {
+	Email    string
+	Verified bool
+	Invalid  bool
+	Sent     bool
+}
+
+// sendVerification emails a link confirming the address to the user, the
+// address is either the email of the user or the one replacing it
+func (s *server) sendVerification(ctx context.Context, user *data.User, email string) (err error) {
+	expiresAt := time.Now().Add(time.Duration(config.EmailVerificationLifetime) * time.Second)
+	token := s.signToken(verifyEmailPurpose, expiresAt, strconv.Itoa(user.Id), email)
+	data := struct {
+		Name      string
+		Email     string
+		Link      string
+		ExpiresAt time.Time
+	}{user.Name, email, strings.TrimRight(config.BaseURL, "/") + "/verify_email?token=" + url.QueryEscape(token), expiresAt}
+	return s.sendMail(ctx, email, "verify_email", data)
+}
+
+// GET /verify_email
+// Confirm the email address of the link, a pending email replaces the old one
+func (s *server) verifyEmail(w http.ResponseWriter, req *http.Request) {
+	invalid := func() {
+		w.WriteHeader(http.StatusForbidden)
+		generateHTML(w, req, verifyEmailPage{Invalid: true}, "layout", "public.navbar", "verify_email")
+	}
+	fields, err := s.verifyToken(verifyEmailPurpose, req.FormValue("token"), time.Now())
+	if err != nil || len(fields) != 2 {
+		logger.SetPrefix("WARNING ")
+		logger.Printf("%v: Email verification from %s", err, clientIP(req))
+		invalid()
+		return
+	}
+	id, err := strconv.Atoi(fields[0])
+	if err != nil {
+		invalid()
+		return
+	}
+	user, err := s.users.UserById(req.Context(), id)
+	if err != nil {
+		logger.SetPrefix("WARNING ")
+		logger.Println(err, "Cannot find user to verify")
+		invalid()
+		return
+	}
+
+	email := fields[1]
+	switch {
+	case user.PendingEmail != "" && strings.EqualFold(user.PendingEmail, email):
+		user.Email, user.PendingEmail, user.EmailVerifiedAt = user.PendingEmail, "", time.Now()
+	case strings.EqualFold(user.Email, email):
+		if !user.EmailVerified() {
+			user.EmailVerifiedAt = time.Now()
+		}
+	default:
+		// the link is for an address the user no longer has or is changing to
+		invalid()
+		return
+	}
+	if err = s.users.UpdateUser(req.Context(), &user); err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot verify email")
+		http.Error(w, "Cannot verify email, it may be used by another account", http.StatusConflict)
+		return
+	}
+	logger.SetPrefix("INFO ")
+	logger.Printf("User %d verified email %s", user.Id, user.Email)
+	generateHTML(w, req, verifyEmailPage{Email: user.Email, Verified: true}, "layout", "public.navbar", "verify_email")
+}
+
+// POST /resend_verification
+// Send a new verification link, the response is the same whether the email
+// is registered or not
+func (s *server) resendVerification(w http.ResponseWriter, req *http.Request) {
+	email := req.PostFormValue("email")
+	if ok, retryAfter := s.loginAllowed(req, email, time.Now()); !ok {
+		tooManyAttempts(w, retryAfter)
+		return
+	}
+	s.sendLater(func(ctx context.Context) {
+		if user, err := s.users.UserByEmail(ctx, email); err == nil && !user.EmailVerified() {
+			s.sendVerification(ctx, &user, user.Email)
+		}
+	})
+	generateHTML(w, req, verifyEmailPage{Email: email, Sent: true}, "layout", "public.navbar", "verify_email")
+}
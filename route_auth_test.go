@@ -1,19 +1,29 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/bakhtik/webapp_template/data"
+	"github.com/bakhtik/webapp_template/mailer"
+	"github.com/bakhtik/webapp_template/password"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestGetLogin(t *testing.T) {
 	req := httptest.NewRequest("GET", "/login", nil)
 	w := httptest.NewRecorder()
-	login(w, req)
+	testServer.login(w, req)
 
 	resp := w.Result()
 	body, _ := ioutil.ReadAll(resp.Body)
@@ -29,7 +39,7 @@ func TestGetLogin(t *testing.T) {
 func TestGetSignup(t *testing.T) {
 	req := httptest.NewRequest("GET", "/signup", nil)
 	w := httptest.NewRecorder()
-	signup(w, req)
+	testServer.signup(w, req)
 
 	resp := w.Result()
 	body, _ := ioutil.ReadAll(resp.Body)
@@ -44,15 +54,15 @@ func TestGetSignup(t *testing.T) {
 }
 
 func TestSignupAccount(t *testing.T) {
-	defer data.UserDeleteAll()
+	defer deleteAllUsers()
 	req := httptest.NewRequest("POST", "/signup_account", nil)
 	req.ParseForm()
 	req.PostForm.Add("name", "John Doe")
 	req.PostForm.Add("email", "john_doe@gmail.com")
-	req.PostForm.Add("password", "123")
+	req.PostForm.Add("password", "s3cret-pass")
 	req.PostForm.Add("role", "user")
 	w := httptest.NewRecorder()
-	signupAccount(w, req)
+	testServer.signupAccount(w, req)
 
 	resp := w.Result()
 	// body, _ := ioutil.ReadAll(resp.Body)
@@ -61,5 +71,533 @@ func TestSignupAccount(t *testing.T) {
 		t.Errorf("Response code is %v", resp.StatusCode)
 	}
 
-	// TODO check if user is in the database
+	if _, err := store.UserByEmail(ctx, "john_doe@gmail.com"); err != nil {
+		t.Error(err, "User not created.")
+	}
+}
+
+func TestProfileSessions(t *testing.T) {
+	user := newTestUser(t, "john_doe@gmail.com", "user")
+	_, cookie := newTestSession(t, user, data.Device{Label: "Firefox on Linux"})
+	newTestSession(t, user, data.Device{Label: "Safari on iPhone"})
+
+	req := httptest.NewRequest("GET", "/profile", nil)
+	req.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	testServer.profile(w, req)
+
+	body := w.Body.String()
+	for _, want := range []string{"Firefox on Linux", "Safari on iPhone", "This device", "Sign out everywhere else"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Body does not contain %q", want)
+		}
+	}
+}
+
+func TestRevokeSession(t *testing.T) {
+	user := newTestUser(t, "john_doe@gmail.com", "user")
+	other := newTestUser(t, "peter@gmail.com", "user")
+	_, cookie := newTestSession(t, user, data.Device{})
+	revoked, _ := newTestSession(t, user, data.Device{})
+	othersSession, _ := newTestSession(t, other, data.Device{})
+
+	for _, id := range []int{revoked.Id, othersSession.Id} {
+		req := httptest.NewRequest("POST", "/profile/revoke_session", strings.NewReader("id="+strconv.Itoa(id)))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		testServer.revokeSession(w, req)
+		if w.Code != http.StatusSeeOther {
+			t.Errorf("Response code is %v", w.Code)
+		}
+	}
+
+	if err := store.CheckSession(ctx, &data.Session{Uuid: revoked.Uuid}, data.SessionExpiry{}, time.Now()); err == nil {
+		t.Error("Session not revoked")
+	}
+	if err := store.CheckSession(ctx, &data.Session{Uuid: othersSession.Uuid}, data.SessionExpiry{}, time.Now()); err != nil {
+		t.Error(err, "Session of another user revoked")
+	}
+}
+
+func TestRevokeOtherSessions(t *testing.T) {
+	user := newTestUser(t, "john_doe@gmail.com", "user")
+	current, cookie := newTestSession(t, user, data.Device{})
+	newTestSession(t, user, data.Device{})
+	newTestSession(t, user, data.Device{})
+
+	req := httptest.NewRequest("POST", "/profile/revoke_other_sessions", nil)
+	req.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	testServer.revokeOtherSessions(w, req)
+
+	sessions, err := store.UserSessions(ctx, &user)
+	if err != nil {
+		t.Fatal(err, "Cannot get sessions")
+	}
+	if len(sessions) != 1 || sessions[0].Uuid != current.Uuid {
+		t.Errorf("Sessions left: %v, want only the current one", sessions)
+	}
+}
+
+// postLogin posts the login form to the server and returns the response
+func postLogin(s *server, email, password string) *http.Response {
+	form := url.Values{"email": {email}, "password": {password}}
+	req := httptest.NewRequest("POST", "/authenticate", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	s.authenticate(w, req)
+	return w.Result()
+}
+
+func TestAuthenticateRateLimit(t *testing.T) {
+	user := newTestUser(t, "peter@gmail.com", "user")
+	s := *testServer
+	s.emailLimiter = newRateLimiter(1, 2)
+
+	for i := 0; i < 2; i++ {
+		if resp := postLogin(&s, user.Email, "wrong"); resp.StatusCode != http.StatusSeeOther {
+			t.Errorf("Response code is %v", resp.StatusCode)
+		}
+	}
+	resp := postLogin(&s, strings.ToUpper(user.Email), "john_pass")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("Response code is %v, Retry-After is %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+}
+
+func TestAuthenticateLockout(t *testing.T) {
+	saved := config.Login
+	defer func() { config.Login = saved }()
+	config.Login.LockoutThreshold, config.Login.LockoutDuration = 3, 60
+
+	user := newTestUser(t, "peter@gmail.com", "user")
+	for i := 0; i < 3; i++ {
+		postLogin(testServer, user.Email, "wrong")
+	}
+	// the right password is refused while the account is locked
+	resp := postLogin(testServer, user.Email, "john_pass")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Response code is %v", resp.StatusCode)
+	}
+	if retryAfter, _ := strconv.Atoi(resp.Header.Get("Retry-After")); retryAfter < 59 || retryAfter > 60 {
+		t.Errorf("Retry-After is %q", resp.Header.Get("Retry-After"))
+	}
+
+	req := httptest.NewRequest("POST", "/admin/unlock_user", strings.NewReader("email="+user.Email))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	testServer.unlockUser(httptest.NewRecorder(), req)
+
+	resp = postLogin(testServer, user.Email, "john_pass")
+	if resp.StatusCode != http.StatusSeeOther || len(resp.Cookies()) == 0 {
+		t.Errorf("Login after unlock failed, response code is %v", resp.StatusCode)
+	}
+}
+
+func TestChangeAccountGuesses(t *testing.T) {
+	saved := config.Login
+	defer func() { config.Login = saved }()
+	config.Login.LockoutThreshold, config.Login.LockoutDuration = 3, 60
+
+	user := newTestUser(t, "peter@gmail.com", "user")
+	other := newTestUser(t, "john@gmail.com", "user")
+	_, cookie := newTestSession(t, user, data.Device{})
+	change := func(email, oldPassword string) int {
+		form := url.Values{"email": {email}, "old_password": {oldPassword}, "new_password": {"n3w_Passw0rd"}, "confirm_password": {"n3w_Passw0rd"}}
+		req := httptest.NewRequest("POST", "/change_account", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		testServer.changeAccount(w, req)
+		return w.Code
+	}
+
+	// the posted email does not pick the account to check the password of
+	for i := 0; i < 3; i++ {
+		if code := change(other.Email, "wrong"); code != http.StatusForbidden {
+			t.Errorf("Wrong old password: response code is %v", code)
+		}
+	}
+	if u, _ := store.UserById(ctx, other.Id); u.FailedLogins != 0 || u.Locked(time.Now()) {
+		t.Error("Password of another user was checked")
+	}
+	if code := change(user.Email, "john_pass"); code != http.StatusTooManyRequests {
+		t.Errorf("Password changed on a locked account, response code is %v", code)
+	}
+	if u, _ := store.UserById(ctx, user.Id); u.Password != user.Password {
+		t.Error("Password changed on a locked account")
+	}
+}
+
+func TestAuthenticateRehash(t *testing.T) {
+	user := newTestUser(t, "peter@gmail.com", "user")
+	s := *testServer
+	s.passwords = password.NewHasher(password.Argon2id{Memory: 1024, Iterations: 1, Parallelism: 1})
+
+	if resp := postLogin(&s, user.Email, "wrong"); resp.StatusCode != http.StatusSeeOther || len(resp.Cookies()) != 0 {
+		t.Errorf("Wrong password: response code is %v", resp.StatusCode)
+	}
+	if u, _ := store.UserById(ctx, user.Id); u.Password != user.Password {
+		t.Error("Hash upgraded by a wrong password")
+	}
+
+	if resp := postLogin(&s, user.Email, "john_pass"); resp.StatusCode != http.StatusSeeOther || len(resp.Cookies()) == 0 {
+		t.Errorf("Response code is %v", resp.StatusCode)
+	}
+	u, _ := store.UserById(ctx, user.Id)
+	if !strings.HasPrefix(u.Password, "$argon2id$") {
+		t.Errorf("Hash is not upgraded: %s", u.Password)
+	}
+	if resp := postLogin(&s, user.Email, "john_pass"); len(resp.Cookies()) == 0 {
+		t.Error("Cannot log in with the upgraded hash")
+	}
+}
+
+// countingBcrypt counts the passwords compared to one of its hashes
+type countingBcrypt struct {
+	password.Bcrypt
+	compared *int
+}
+
+func (c countingBcrypt) Compare(hash, pw string) error {
+	if c.Identifies(hash) {
+		*c.compared++
+	}
+	return c.Bcrypt.Compare(hash, pw)
+}
+
+func TestAuthenticateUnknownEmail(t *testing.T) {
+	user := newTestUser(t, "peter@gmail.com", "user")
+	var compared int
+	s := *testServer
+	s.passwords = password.NewHasher(countingBcrypt{password.Bcrypt{Cost: bcrypt.MinCost}, &compared})
+	var logged bytes.Buffer
+	defer logger.SetOutput(logger.Writer())
+	logger.SetOutput(&logged)
+
+	// an unknown email checks the password against a hash like a known one
+	if resp := postLogin(&s, "nobody@gmail.com", "john_pass"); resp.StatusCode != http.StatusSeeOther || len(resp.Cookies()) != 0 {
+		t.Errorf("Unknown email: response code is %v", resp.StatusCode)
+	}
+	if compared != 1 {
+		t.Errorf("Password of unknown email compared to %d hashes", compared)
+	}
+	// so does a user without a password, who signs in at an identity provider
+	compared, user.Password = 0, ""
+	if err := store.UpdateUser(ctx, &user); err != nil {
+		t.Fatal(err, "Cannot update user")
+	}
+	if resp := postLogin(&s, user.Email, ""); resp.StatusCode != http.StatusSeeOther || len(resp.Cookies()) != 0 {
+		t.Errorf("User without password: response code is %v", resp.StatusCode)
+	}
+	if compared != 1 {
+		t.Errorf("Password of user without password compared to %d hashes", compared)
+	}
+	if strings.Contains(logged.String(), "ERROR") {
+		t.Errorf("Unknown email logged as error: %s", logged.String())
+	}
+}
+
+// postSignup posts the signup form to the server and returns the response code
+func postSignup(form url.Values) int {
+	req := httptest.NewRequest("POST", "/signup_account", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	testServer.signupAccount(w, req)
+	return w.Code
+}
+
+func TestSignupIgnoresRole(t *testing.T) {
+	defer deleteAllUsers()
+	postSignup(url.Values{"name": {"Eve"}, "email": {"eve@gmail.com"}, "password": {"s3cret-pass"}, "role": {"admin"}})
+	user, err := store.UserByEmail(ctx, "eve@gmail.com")
+	if err != nil {
+		t.Fatal(err, "User not created.")
+	}
+	if user.Role != "user" || user.Pending {
+		t.Errorf("User signed up with role %q, pending %v", user.Role, user.Pending)
+	}
+}
+
+func TestSignupPasswordPolicy(t *testing.T) {
+	defer deleteAllUsers()
+	for _, pw := range []string{"short", "peter-the-great"} {
+		form := url.Values{"name": {"Peter"}, "email": {"peter@gmail.com"}, "password": {pw}}
+		req := httptest.NewRequest("POST", "/signup_account", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		testServer.signupAccount(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Signup with password %q: response code is %v", pw, w.Code)
+		}
+		if body := w.Body.String(); !strings.Contains(body, "The password must") || !strings.Contains(body, `value="peter@gmail.com"`) {
+			t.Errorf("Signup with password %q: problems not rendered into the form", pw)
+		}
+	}
+	if _, err := store.UserByEmail(ctx, "peter@gmail.com"); err == nil {
+		t.Error("User created with a refused password")
+	}
+}
+
+func TestSignupInvite(t *testing.T) {
+	saved := config.SignupMode
+	defer func() { config.SignupMode = saved }()
+	config.SignupMode = signupInvite
+	defer deleteAllUsers()
+
+	form := url.Values{"name": {"Peter"}, "email": {"peter@gmail.com"}, "password": {"s3cret-pass"}}
+	if code := postSignup(form); code != http.StatusForbidden {
+		t.Errorf("Signup without invite: response code is %v", code)
+	}
+
+	invite := data.Invite{Role: "admin", ExpiresAt: time.Now().Add(time.Hour)}
+	if err := store.CreateInvite(ctx, &invite); err != nil {
+		t.Fatal(err, "Cannot create invite")
+	}
+	defer store.DeleteInvite(ctx, invite.Id)
+	form.Set("invite", invite.Token)
+
+	// a signup which fails doesn't use up the invite
+	form.Set("email", newTestUser(t, "john@gmail.com", "user").Email)
+	if code := postSignup(form); code != http.StatusSeeOther {
+		t.Errorf("Signup with registered email: response code is %v", code)
+	}
+	form.Set("email", "peter@gmail.com")
+	if code := postSignup(form); code != http.StatusSeeOther {
+		t.Errorf("Signup with invite: response code is %v", code)
+	}
+	if user, err := store.UserByEmail(ctx, "peter@gmail.com"); err != nil || user.Role != "admin" {
+		t.Errorf("User not created with the role of the invite: %v", err)
+	}
+
+	form.Set("email", "paul@gmail.com")
+	if code := postSignup(form); code != http.StatusForbidden {
+		t.Errorf("Signup with used invite: response code is %v", code)
+	}
+}
+
+func TestSignupApproval(t *testing.T) {
+	saved := config.SignupMode
+	defer func() { config.SignupMode = saved }()
+	config.SignupMode = signupApproval
+	defer deleteAllUsers()
+
+	if code := postSignup(url.Values{"name": {"Peter"}, "email": {"peter@gmail.com"}, "password": {"s3cret-pass"}}); code != http.StatusOK {
+		t.Errorf("Response code is %v", code)
+	}
+	if resp := postLogin(testServer, "peter@gmail.com", "s3cret-pass"); resp.StatusCode != http.StatusForbidden || len(resp.Cookies()) != 0 {
+		t.Errorf("Pending user signed in, response code is %v", resp.StatusCode)
+	}
+
+	req := httptest.NewRequest("POST", "/admin/approve_user", strings.NewReader("email=peter@gmail.com"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	testServer.approveUser(httptest.NewRecorder(), req)
+
+	if resp := postLogin(testServer, "peter@gmail.com", "s3cret-pass"); resp.StatusCode != http.StatusSeeOther || len(resp.Cookies()) == 0 {
+		t.Errorf("Approved user cannot sign in, response code is %v", resp.StatusCode)
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	user := newTestUser(t, "peter@gmail.com", "user")
+	session, _ := newTestSession(t, user, data.Device{})
+
+	post := func(handler http.HandlerFunc, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	w := post(testServer.requestPasswordReset, url.Values{"email": {"nobody@gmail.com"}})
+	testServer.mailing.Wait()
+	if _, sent := testMail.Last("nobody@gmail.com"); w.Code != http.StatusOK || sent {
+		t.Errorf("Reset for unknown email: response code is %v", w.Code)
+	}
+	post(testServer.requestPasswordReset, url.Values{"email": {user.Email}})
+	testServer.mailing.Wait()
+	email, _ := testMail.Last(user.Email)
+	match := regexp.MustCompile(`/reset_password\?token=(\S+)`).FindStringSubmatch(email.Text)
+	if match == nil || !strings.Contains(email.HTML, "Choose a new password") {
+		t.Fatal("No reset link sent")
+	}
+	token, _ := url.QueryUnescape(match[1])
+
+	req := httptest.NewRequest("GET", "/reset_password?token="+url.QueryEscape(token), nil)
+	w = httptest.NewRecorder()
+	testServer.resetPasswordForm(w, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Choose a new password") {
+		t.Errorf("Reset form: response code is %v", w.Code)
+	}
+
+	// a refused password doesn't spend the token
+	weak := url.Values{"token": {token}, "new_password": {"john"}, "confirm_password": {"john"}}
+	if w = post(testServer.resetPassword, weak); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "at least 8 characters") {
+		t.Errorf("Reset with weak password: response code is %v", w.Code)
+	}
+	long := strings.Repeat("x", password.BcryptMaxBytes+1)
+	if w = post(testServer.resetPassword, url.Values{"token": {token}, "new_password": {long}, "confirm_password": {long}}); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "at most 72 bytes") {
+		t.Errorf("Reset with too long password: response code is %v", w.Code)
+	}
+	form := url.Values{"token": {token}, "new_password": {"new_pass"}, "confirm_password": {"new_pass"}}
+	if w = post(testServer.resetPassword, form); w.Code != http.StatusSeeOther {
+		t.Errorf("Reset: response code is %v", w.Code)
+	}
+	if err := store.CheckSession(ctx, &session, data.SessionExpiry{}, time.Now()); err == nil {
+		t.Error("Session not revoked on password reset")
+	}
+	if resp := postLogin(testServer, user.Email, "new_pass"); resp.StatusCode != http.StatusSeeOther || len(resp.Cookies()) == 0 {
+		t.Errorf("Cannot sign in with the new password, response code is %v", resp.StatusCode)
+	}
+	if w = post(testServer.resetPassword, form); w.Code != http.StatusForbidden {
+		t.Errorf("Reset with used token: response code is %v", w.Code)
+	}
+}
+
+// heldMail is a transport which holds every email until release is closed
+type heldMail struct{ release chan struct{} }
+
+func (h heldMail) Send(ctx context.Context, msg *mailer.Message) error {
+	<-h.release
+	return nil
+}
+
+func TestPasswordResetDoesNotWaitForMail(t *testing.T) {
+	user := newTestUser(t, "peter@gmail.com", "user")
+	release := make(chan struct{})
+	s := *testServer
+	s.mail = mailer.New(heldMail{release}, "noreply@example.com", "templates/email")
+	s.mailing = &sync.WaitGroup{}
+	defer s.mailing.Wait()
+	defer close(release)
+
+	// the response for a registered email mustn't take longer than for
+	// an unknown one, so it can't wait for the email to go out
+	done := make(chan int)
+	go func() {
+		req := httptest.NewRequest("POST", "/forgot_password", strings.NewReader("email="+url.QueryEscape(user.Email)))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		s.requestPasswordReset(w, req)
+		done <- w.Code
+	}()
+	select {
+	case code := <-done:
+		if code != http.StatusOK {
+			t.Errorf("Response code is %v", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Response waits for the password reset email")
+	}
+}
+
+func TestSignupDoesNotWaitForMail(t *testing.T) {
+	defer deleteAllUsers()
+	release := make(chan struct{})
+	s := *testServer
+	s.mail = mailer.New(heldMail{release}, "noreply@example.com", "templates/email")
+	s.mailing = &sync.WaitGroup{}
+	defer s.mailing.Wait()
+	defer close(release)
+
+	// a slow mail server doesn't hold up the signup
+	done := make(chan int)
+	go func() {
+		form := url.Values{"name": {"Eve"}, "email": {"eve@gmail.com"}, "password": {"s3cret-pass"}}
+		req := httptest.NewRequest("POST", "/signup_account", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		s.signupAccount(w, req)
+		done <- w.Code
+	}()
+	select {
+	case code := <-done:
+		if code != http.StatusSeeOther {
+			t.Errorf("Response code is %v", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Signup waits for the verification email")
+	}
+}
+
+// verificationLink returns the path of the last verification link sent to the address
+func verificationLink(t *testing.T, email string) string {
+	testServer.mailing.Wait()
+	msg, _ := testMail.Last(email)
+	match := regexp.MustCompile(`/verify_email\?token=\S+`).FindString(msg.Text)
+	if match == "" {
+		t.Fatalf("No verification link sent to %s", email)
+	}
+	return match
+}
+
+func TestEmailVerification(t *testing.T) {
+	saved := config.RequireEmailVerification
+	defer func() { config.RequireEmailVerification = saved }()
+	config.RequireEmailVerification = true
+	defer deleteAllUsers()
+
+	postSignup(url.Values{"name": {"Peter"}, "email": {"peter@gmail.com"}, "password": {"s3cret-pass"}})
+	link := verificationLink(t, "peter@gmail.com")
+	if resp := postLogin(testServer, "peter@gmail.com", "s3cret-pass"); resp.StatusCode != http.StatusForbidden || len(resp.Cookies()) != 0 {
+		t.Errorf("Unverified user signed in, response code is %v", resp.StatusCode)
+	}
+
+	w := httptest.NewRecorder()
+	testServer.verifyEmail(w, httptest.NewRequest("GET", link, nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Verification: response code is %v", w.Code)
+	}
+	if resp := postLogin(testServer, "peter@gmail.com", "s3cret-pass"); resp.StatusCode != http.StatusSeeOther || len(resp.Cookies()) == 0 {
+		t.Errorf("Verified user cannot sign in, response code is %v", resp.StatusCode)
+	}
+
+	w = httptest.NewRecorder()
+	testServer.verifyEmail(w, httptest.NewRequest("GET", link+"x", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Altered link: response code is %v", w.Code)
+	}
+}
+
+func TestResendVerification(t *testing.T) {
+	user := newTestUser(t, "peter@gmail.com", "user")
+	resend := func(email string) int {
+		req := httptest.NewRequest("POST", "/resend_verification", strings.NewReader("email="+url.QueryEscape(email)))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		testServer.resendVerification(w, req)
+		testServer.mailing.Wait()
+		return w.Code
+	}
+	testMail.Reset()
+	if code := resend("nobody@gmail.com"); code != http.StatusOK || len(testMail.Messages()) != 0 {
+		t.Errorf("Resend to unknown email: response code is %v", code)
+	}
+	if code := resend(user.Email); code != http.StatusOK {
+		t.Errorf("Resend: response code is %v", code)
+	}
+	verificationLink(t, user.Email)
+}
+
+func TestEmailChange(t *testing.T) {
+	user := newTestUser(t, "peter@gmail.com", "user")
+	form := url.Values{"origin_email": {user.Email}, "name": {user.Name}, "email": {"pete@gmail.com"}, "role": {"user"}}
+	req := httptest.NewRequest("POST", "/admin/change_account", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	testServer.changeAccountAdmin(httptest.NewRecorder(), req)
+
+	// the old address stays in use until the new one is confirmed
+	user, err := store.UserByEmail(ctx, "peter@gmail.com")
+	if err != nil || user.PendingEmail != "pete@gmail.com" {
+		t.Fatalf("Email change not pending: %q, %v", user.PendingEmail, err)
+	}
+	w := httptest.NewRecorder()
+	testServer.verifyEmail(w, httptest.NewRequest("GET", verificationLink(t, "pete@gmail.com"), nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Verification: response code is %v", w.Code)
+	}
+	if user, err = store.UserById(ctx, user.Id); user.Email != "pete@gmail.com" || user.PendingEmail != "" || !user.EmailVerified() {
+		t.Errorf("Email not changed: %q, pending %q", user.Email, user.PendingEmail)
+	}
 }
@@ -6,11 +6,11 @@ import (
 	"github.com/bakhtik/webapp_template/data"
 )
 
-func index(w http.ResponseWriter, req *http.Request) {
-	if sess, err := session(w, req); err != nil {
-		generateHTML(w, nil, "layout", "public.navbar", "index")
+func (s *server) index(w http.ResponseWriter, req *http.Request) {
+	if sess, err := s.session(w, req); err != nil {
+		generateHTML(w, req, nil, "layout", "public.navbar", "index")
 	} else {
-		user, err := sess.User()
+		user, err := s.sessions.SessionUser(req.Context(), &sess)
 		if err != nil {
 			logger.SetPrefix("ERROR ")
 			logger.Println(err, "Cannot fetch user")
@@ -18,6 +18,6 @@ func index(w http.ResponseWriter, req *http.Request) {
 		data := struct {
 			data.User
 		}{user}
-		generateHTML(w, data, "layout", "private.navbar", "index")
+		generateHTML(w, req, data, "layout", "private.navbar", "index")
 	}
 }
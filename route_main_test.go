@@ -1,16 +1,66 @@
 package main
 
 import (
+	"context"
 	"io/ioutil"
+	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
+
+	"github.com/bakhtik/webapp_template/data"
+	"github.com/bakhtik/webapp_template/mailer"
+	"github.com/bakhtik/webapp_template/password"
+	"golang.org/x/crypto/bcrypt"
 )
 
+var ctx = context.Background()
+var store data.Store = data.NewMemory()
+var testServer = &server{users: store, sessions: store, invites: store, resets: store, twoFactor: store, remember: store, identities: store,
+	tokens: signedTokens{newKeyring([]byte("test-session-key"))}, passwords: testPasswords, policy: password.Policy{MinLength: 8, MaxBytes: password.BcryptMaxBytes}, mail: mailer.New(testMail, "noreply@example.com", "templates/email"), mailing: &sync.WaitGroup{}}
+
+// testPasswords hashes with the lowest cost to keep the tests fast
+var testPasswords = password.NewHasher(password.Bcrypt{Cost: bcrypt.MinCost})
+
+// testMail keeps the emails sent by testServer
+var testMail = &mailer.Capture{}
+
+// newTestUser creates a user in the test store, it is deleted when the test ends
+func newTestUser(t *testing.T, email, role string) data.User {
+	hash, err := testPasswords.Hash("john_pass")
+	if err != nil {
+		t.Fatal(err, "Cannot hash password")
+	}
+	user := data.User{Name: "John Doe", Email: email, Password: hash, Role: role}
+	if err := store.CreateUser(ctx, &user); err != nil {
+		t.Fatal(err, "Cannot create user")
+	}
+	t.Cleanup(func() { store.DeleteUser(ctx, &user) })
+	return user
+}
+
+// deleteAllUsers deletes the users created by the handlers under test
+func deleteAllUsers() {
+	users, _ := store.Users(ctx)
+	for _, user := range users {
+		store.DeleteUser(ctx, &user)
+	}
+}
+
+// newTestSession logs user in and returns the session with its cookie
+func newTestSession(t *testing.T, user data.User, device data.Device) (data.Session, *http.Cookie) {
+	session, err := store.CreateSession(ctx, &user, device)
+	if err != nil {
+		t.Fatal(err, "Cannot create session")
+	}
+	return session, &http.Cookie{Name: "session", Value: testServer.tokens.issue(session)}
+}
+
 func Test_Get_Index(t *testing.T) {
 	req := httptest.NewRequest("GET", "/", nil)
 	w := httptest.NewRecorder()
-	index(w, req)
+	testServer.index(w, req)
 
 	resp := w.Result()
 	body, _ := ioutil.ReadAll(resp.Body)
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bakhtik/webapp_template/data"
+)
+
+// purposes of the tokens signed for two-factor authentication
+const (
+	// twoFactorLoginPurpose is the pending login of a user who entered the password
+	twoFactorLoginPurpose = "two-factor-login"
+	// twoFactorSetupPurpose carries the secret a user is setting up
+	twoFactorSetupPurpose = "two-factor-setup"
+)
+
+// twoFactorCookie holds the pending login until the code is entered
+const twoFactorCookie = "two_factor"
+
+// twoFactorSetupLifetime is how long the code confirming a new secret can be entered
+const twoFactorSetupLifetime = 15 * time.Minute
+
+// twoFactorSetupPage is the data of the two_factor_setup template
+type twoFactorSetupPage struct {
+	data.User
+	Secret string
+	// URI is trusted as html/template refuses links with the otpauth scheme
+	URI     template.URL
+	Token   string
+	Invalid bool
+	// RecoveryCodes are shown once after they are created
+	RecoveryCodes []string
+}
+
+// startTwoFactor issues a short-lived pending login for the user who entered
+// the password and asks for the code, the login is remembered once it is finished
+func (s *server) startTwoFactor(w http.ResponseWriter, req *http.Request, user *data.User, remember bool) {
+	lifetime := time.Duration(config.TwoFactor.LoginLifetime) * time.Second
+	token := s.signToken(twoFactorLoginPurpose, time.Now().Add(lifetime), strconv.Itoa(user.Id), strconv.FormatBool(remember))
+	http.SetCookie(w, newCookie(twoFactorCookie, token, config.TwoFactor.LoginLifetime))
+	http.Redirect(w, req, "/two_factor", http.StatusSeeOther)
+}
+
+// pendingTwoFactor gets the user of the pending login and whether to remember it
+func (s *server) pendingTwoFactor(req *http.Request, now time.Time) (user data.User, remember bool, err error) {
+	cookie, err := req.Cookie(cookieName(twoFactorCookie))
+	if err != nil {
+		return
+	}
+	fields, err := s.verifyToken(twoFactorLoginPurpose, cookie.Value, now)
+	if err != nil || len(fields) != 2 {
+		return user, false, errInvalidToken
+	}
+	id, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return
+	}
+	remember = fields[1] == "true"
+	user, err = s.users.UserById(req.Context(), id)
+	return
+}
+
+// checkTwoFactor accepts a current TOTP code, which can't be used again, or
+// an unused recovery code of the user
+func (s *server) checkTwoFactor(ctx context.Context, user *data.User, code string, now time.Time) bool {
+	if step, ok := totpCheck(user.TOTPSecret, code, now); ok {
+		err := s.twoFactor.UseTOTPStep(ctx, user, step)
+		if err != nil {
+			logger.SetPrefix("WARNING ")
+			logger.Printf("%v: TOTP code of user %s used again", err, user.Email)
+		}
+		return err == nil
+	}
+	code = strings.TrimSpace(code)
+	if len(code) <= totpDigits {
+		return false
+	}
+	if err := s.twoFactor.UseRecoveryCode(ctx, user, code); err != nil {
+		return false
+	}
+	logger.SetPrefix("INFO ")
+	logger.Printf("User %s used a recovery code", user.Email)
+	return true
+}
+
+// GET /two_factor
+// Show the page to enter the code of a pending login
+func (s *server) twoFactorForm(w http.ResponseWriter, req *http.Request) {
+	if _, _, err := s.pendingTwoFactor(req, time.Now()); err != nil {
+		http.Redirect(w, req, "/login", http.StatusSeeOther)
+		return
+	}
+	generateHTML(w, req, struct{ Invalid bool }{}, "layout", "public.navbar", "two_factor")
+}
+
+// POST /two_factor
+// Finish the pending login if the code is right, wrong codes count as failed logins
+func (s *server) verifyTwoFactor(w http.ResponseWriter, req *http.Request) {
+	now := time.Now()
+	user, remember, err := s.pendingTwoFactor(req, now)
+	if err != nil || !user.TwoFactorEnabled() {
+		logger.SetPrefix("WARNING ")
+		logger.Printf("%v: Two-factor login from %s", err, clientIP(req))
+		http.Redirect(w, req, "/login", http.StatusSeeOther)
+		return
+	}
+	if ok, retryAfter := s.loginAllowed(req, user.Email, now); !ok {
+		tooManyAttempts(w, retryAfter)
+		return
+	}
+	if user.Locked(now) {
+		logger.SetPrefix("WARNING ")
+		logger.Printf("Login to locked account %s from %s", user.Email, clientIP(req))
+		tooManyAttempts(w, user.LockedUntil.Sub(now))
+		return
+	}
+	if !s.checkTwoFactor(req.Context(), &user, req.PostFormValue("code"), now) {
+		s.loginFailed(req.Context(), &user)
+		w.WriteHeader(http.StatusForbidden)
+		generateHTML(w, req, struct{ Invalid bool }{true}, "layout", "public.navbar", "two_factor")
+		return
+	}
+	http.SetCookie(w, newCookie(twoFactorCookie, "", -1))
+	s.signIn(w, req, &user, remember)
+}
+
+// GET /profile/two_factor
+// Show a new secret to add to an authenticator app, a user with two-factor
+// authentication moves to the new app with a code of the current one
+func (s *server) twoFactorSetup(w http.ResponseWriter, req *http.Request) {
+	sess, _ := s.session(w, req)
+	user, err := s.sessions.SessionUser(req.Context(), &sess)
+	if err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot fetch user")
+		http.Error(w, "Cannot find user", http.StatusForbidden)
+		return
+	}
+	secret, err := newTOTPSecret()
+	if err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot generate TOTP secret")
+		http.Error(w, "Cannot generate secret", http.StatusInternalServerError)
+		return
+	}
+	// the secret is only stored once a code confirms the app has it
+	token := s.signToken(twoFactorSetupPurpose, time.Now().Add(twoFactorSetupLifetime), strconv.Itoa(user.Id), secret)
+	data := twoFactorSetupPage{User: user, Secret: secret, URI: template.URL(totpURI(config.TwoFactor.Issuer, user.Email, secret)), Token: token}
+	generateHTML(w, req, data, "layout", "private.navbar", "two_factor_setup")
+}
+
+// POST /profile/two_factor
+// Enable two-factor authentication with the secret of the setup page if the
+// code matches it and show the recovery codes. The secret of a user with
+// two-factor authentication is only replaced given a code of the current one.
+func (s *server) enableTwoFactor(w http.ResponseWriter, req *http.Request) {
+	sess, _ := s.session(w, req)
+	user, err := s.sessions.SessionUser(req.Context(), &sess)
+	if err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot fetch user")
+		http.Error(w, "Cannot find user", http.StatusForbidden)
+		return
+	}
+	now, token := time.Now(), req.PostFormValue("token")
+	fields, err := s.verifyToken(twoFactorSetupPurpose, token, now)
+	if err != nil || len(fields) != 2 || fields[0] != strconv.Itoa(user.Id) {
+		http.Error(w, "The setup has expired, please start again", http.StatusForbidden)
+		return
+	}
+	secret := fields[1]
+	step, ok := totpCheck(secret, req.PostFormValue("code"), now)
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		data := twoFactorSetupPage{User: user, Secret: secret, URI: template.URL(totpURI(config.TwoFactor.Issuer, user.Email, secret)), Token: token, Invalid: true}
+		generateHTML(w, req, data, "layout", "private.navbar", "two_factor_setup")
+		return
+	}
+	if user.TwoFactorEnabled() && !s.confirmTwoFactor(w, req, &user, req.PostFormValue("current_code")) {
+		return
+	}
+	codes, err := s.twoFactor.EnableTOTP(req.Context(), &user, secret)
+	if err == data.ErrTwoFactorEnabled {
+		logger.SetPrefix("WARNING ")
+		logger.Printf("TOTP secret of user %s changed during the setup", user.Email)
+		http.Error(w, "Two-factor authentication is enabled already", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot enable TOTP")
+		http.Error(w, "Cannot enable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	if err = s.twoFactor.UseTOTPStep(req.Context(), &user, step); err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot record TOTP step")
+	}
+	logger.SetPrefix("INFO ")
+	logger.Printf("User %s enabled two-factor authentication", user.Email)
+	req = s.renewSession(w, req)
+	generateHTML(w, req, twoFactorSetupPage{User: user, RecoveryCodes: codes}, "layout", "private.navbar", "two_factor_setup")
+}
+
+// POST /profile/disable_two_factor
+// Disable two-factor authentication given a code
+func (s *server) disableTwoFactor(w http.ResponseWriter, req *http.Request) {
+	user, ok := s.twoFactorUser(w, req)
+	if !ok {
+		return
+	}
+	if twoFactorRequired(user) {
+		http.Error(w, "Two-factor authentication is required for your role", http.StatusForbidden)
+		return
+	}
+	if err := s.twoFactor.DisableTOTP(req.Context(), &user); err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot disable TOTP")
+		http.Error(w, "Cannot disable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	logger.SetPrefix("INFO ")
+	logger.Printf("User %s disabled two-factor authentication", user.Email)
+	s.renewSession(w, req)
+	http.Redirect(w, req, "/profile", http.StatusSeeOther)
+}
+
+// POST /profile/recovery_codes
+// Replace the recovery codes given a code and show the new ones
+func (s *server) recoveryCodes(w http.ResponseWriter, req *http.Request) {
+	user, ok := s.twoFactorUser(w, req)
+	if !ok {
+		return
+	}
+	codes, err := s.twoFactor.CreateRecoveryCodes(req.Context(), &user)
+	if err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot create recovery codes")
+		http.Error(w, "Cannot create recovery codes", http.StatusInternalServerError)
+		return
+	}
+	generateHTML(w, req, twoFactorSetupPage{User: user, RecoveryCodes: codes}, "layout", "private.navbar", "two_factor_setup")
+}
+
+// twoFactorUser gets the signed in user if the code posted with the request
+// is right, attempts are limited like logins. The response is written unless ok.
+func (s *server) twoFactorUser(w http.ResponseWriter, req *http.Request) (user data.User, ok bool) {
+	sess, _ := s.session(w, req)
+	user, err := s.sessions.SessionUser(req.Context(), &sess)
+	if err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot fetch user")
+		http.Error(w, "Cannot find user", http.StatusForbidden)
+		return
+	}
+	return user, s.confirmTwoFactor(w, req, &user, req.PostFormValue("code"))
+}
+
+// confirmTwoFactor reports whether the code is right for the current second
+// factor of the user, attempts are limited like logins. The response is
+// written unless it is.
+func (s *server) confirmTwoFactor(w http.ResponseWriter, req *http.Request, user *data.User, code string) bool {
+	now := time.Now()
+	if allowed, retryAfter := s.loginAllowed(req, user.Email, now); !allowed {
+		tooManyAttempts(w, retryAfter)
+		return false
+	}
+	if !user.TwoFactorEnabled() || !s.checkTwoFactor(req.Context(), user, code, now) {
+		http.Error(w, "Invalid code", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// twoFactorRequired reports whether the user can't do without two-factor authentication
+func twoFactorRequired(user data.User) bool {
+	return config.TwoFactor.RequireForAdmins && user.Role == "admin"
+}
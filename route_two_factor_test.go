@@ -0,0 +1,227 @@
+package main
+
+import (
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bakhtik/webapp_template/data"
+)
+
+// currentTOTP returns the code an authenticator app shows for the secret now
+func currentTOTP(t *testing.T, secret string) string {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err, "Invalid TOTP secret")
+	}
+	return hotp(key, totpStep(time.Now()))
+}
+
+// postTwoFactor posts the code of the pending login in resp
+func postTwoFactor(resp *http.Response, code string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/two_factor", strings.NewReader(url.Values{"code": {code}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, cookie := range resp.Cookies() {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	testServer.verifyTwoFactor(w, req)
+	return w
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	saved := config.TwoFactor
+	defer func() { config.TwoFactor = saved }()
+	config.TwoFactor.LoginLifetime = 60
+
+	user := newTestUser(t, "peter@gmail.com", "user")
+	secret, _ := newTOTPSecret()
+	codes, err := store.EnableTOTP(ctx, &user, secret)
+	if err != nil {
+		t.Fatal(err, "Cannot enable TOTP")
+	}
+
+	// the password alone gives a pending login but no session
+	resp := postLogin(testServer, user.Email, "john_pass")
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/two_factor" {
+		t.Fatalf("Response code is %v, location %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == "session" {
+			t.Fatal("Session created before the second step")
+		}
+	}
+
+	if w := postTwoFactor(resp, "000000"); w.Code != http.StatusForbidden {
+		t.Errorf("Wrong code: response code is %v", w.Code)
+	}
+	code := currentTOTP(t, secret)
+	w := postTwoFactor(resp, code)
+	if w.Code != http.StatusSeeOther || !strings.Contains(strings.Join(w.Header()["Set-Cookie"], ";"), "session=") {
+		t.Errorf("Right code: response code is %v", w.Code)
+	}
+	// a code signs in once
+	if w = postTwoFactor(resp, code); w.Code != http.StatusForbidden {
+		t.Errorf("Reused code: response code is %v", w.Code)
+	}
+	if w = postTwoFactor(resp, strings.ToUpper(codes[0])); w.Code != http.StatusSeeOther {
+		t.Errorf("Recovery code: response code is %v", w.Code)
+	}
+	if w = postTwoFactor(resp, codes[0]); w.Code != http.StatusForbidden {
+		t.Errorf("Reused recovery code: response code is %v", w.Code)
+	}
+
+	// without the pending login the code is worth nothing
+	if w = postTwoFactor(&http.Response{}, codes[1]); w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/login" {
+		t.Errorf("No pending login: response code is %v", w.Code)
+	}
+}
+
+func TestTwoFactorSetup(t *testing.T) {
+	user := newTestUser(t, "peter@gmail.com", "user")
+	_, cookie := newTestSession(t, user, data.Device{})
+
+	req := httptest.NewRequest("GET", "/profile/two_factor", nil)
+	req.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	testServer.twoFactorSetup(w, req)
+	body := w.Body.String()
+	secret := regexp.MustCompile(`<code>([A-Z2-7]+)</code>`).FindStringSubmatch(body)
+	token := regexp.MustCompile(`name="token" value="([^"]+)"`).FindStringSubmatch(body)
+	if secret == nil || token == nil || !strings.Contains(body, "otpauth://totp/") {
+		t.Fatalf("Setup page has no secret or token: %s", body)
+	}
+
+	enable := func(code string) *httptest.ResponseRecorder {
+		form := url.Values{"code": {code}, "token": {html.UnescapeString(token[1])}}
+		req := httptest.NewRequest("POST", "/profile/two_factor", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		testServer.enableTwoFactor(w, req)
+		return w
+	}
+	if w = enable("000000"); w.Code != http.StatusForbidden {
+		t.Errorf("Wrong code: response code is %v", w.Code)
+	}
+	if u, _ := store.UserById(ctx, user.Id); u.TwoFactorEnabled() {
+		t.Fatal("Enabled with a wrong code")
+	}
+	if w = enable(currentTOTP(t, secret[1])); w.Code != http.StatusOK || strings.Count(w.Body.String(), "<li><code>") != 10 {
+		t.Errorf("Response code is %v, recovery codes are not shown", w.Code)
+	}
+	if u, _ := store.UserById(ctx, user.Id); u.TOTPSecret != secret[1] {
+		t.Errorf("TOTP secret is %q, want %q", u.TOTPSecret, secret[1])
+	}
+}
+
+func TestTwoFactorRequiredForAdmins(t *testing.T) {
+	saved := config.TwoFactor
+	defer func() { config.TwoFactor = saved }()
+	config.TwoFactor.RequireForAdmins = true
+
+	admin := newTestUser(t, "admin@gmail.com", "admin")
+	_, cookie := newTestSession(t, admin, data.Device{})
+	mux := testServer.routes()
+	get := func() int {
+		req := httptest.NewRequest("GET", "/admin", nil)
+		req.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := get(); code != http.StatusForbidden {
+		t.Errorf("Without 2FA: response code is %v", code)
+	}
+	secret, _ := newTOTPSecret()
+	if _, err := store.EnableTOTP(ctx, &admin, secret); err != nil {
+		t.Fatal(err, "Cannot enable TOTP")
+	}
+	if code := get(); code != http.StatusOK {
+		t.Errorf("With 2FA: response code is %v", code)
+	}
+}
+
+// newSQLiteServer returns a copy of testServer using a migrated SQLite
+// database, the test store keeps everything in memory and can't tell
+// whether the SQL stores read what the handlers need
+func newSQLiteServer(t *testing.T) (*server, *data.SQLite) {
+	sq, err := data.NewSQLite(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err, "Cannot open database")
+	}
+	t.Cleanup(func() { sq.Db.Close() })
+	m, err := sq.Migrator()
+	if err != nil {
+		t.Fatal(err, "Cannot load migrations")
+	}
+	if _, err = m.Up(ctx); err != nil {
+		t.Fatal(err, "Cannot migrate database")
+	}
+	s := *testServer
+	s.users, s.sessions, s.invites, s.resets, s.twoFactor, s.remember, s.identities = sq, sq, sq, sq, sq, sq, sq
+	return &s, sq
+}
+
+func TestTwoFactorRoutesSQLite(t *testing.T) {
+	saved := config.TwoFactor
+	defer func() { config.TwoFactor = saved }()
+	config.TwoFactor.RequireForAdmins = true
+
+	s, sq := newSQLiteServer(t)
+	admin := data.User{Name: "John Doe", Email: "admin@gmail.com", Role: "admin"}
+	if err := sq.CreateUser(ctx, &admin); err != nil {
+		t.Fatal(err, "Cannot create user")
+	}
+	secret, _ := newTOTPSecret()
+	if _, err := sq.EnableTOTP(ctx, &admin, secret); err != nil {
+		t.Fatal(err, "Cannot enable TOTP")
+	}
+	sess, err := sq.CreateSession(ctx, &admin, data.Device{})
+	if err != nil {
+		t.Fatal(err, "Cannot create session")
+	}
+	cookie := &http.Cookie{Name: "session", Value: s.tokens.issue(sess)}
+	mux := s.routes()
+	serve := func(method, path string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set(csrfHeaderName, s.csrfToken(sess.Uuid))
+		req.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := serve("GET", "/admin", nil); w.Code != http.StatusOK {
+		t.Errorf("Admin with 2FA refused, response code is %v", w.Code)
+	}
+	if w := serve("GET", "/profile", nil); !strings.Contains(w.Body.String(), "recovery code(s) left") {
+		t.Error("Profile does not show 2FA as enabled")
+	}
+
+	// a new secret needs a code of the current one
+	w := serve("GET", "/profile/two_factor", nil)
+	replacement := regexp.MustCompile(`<code>([A-Z2-7]+)</code>`).FindStringSubmatch(w.Body.String())
+	token := regexp.MustCompile(`name="token" value="([^"]+)"`).FindStringSubmatch(w.Body.String())
+	if replacement == nil || token == nil || !strings.Contains(w.Body.String(), `name="current_code"`) {
+		t.Fatalf("Setup page does not ask for the current code: %s", w.Body.String())
+	}
+	form := url.Values{"code": {currentTOTP(t, replacement[1])}, "token": {html.UnescapeString(token[1])}}
+	if w = serve("POST", "/profile/two_factor", form); w.Code != http.StatusForbidden {
+		t.Errorf("Secret replaced without the current code, response code is %v", w.Code)
+	}
+	if u, _ := sq.UserById(ctx, admin.Id); u.TOTPSecret != secret {
+		t.Fatal("TOTP secret replaced without the current code")
+	}
+
+	if w = serve("POST", "/profile/recovery_codes", url.Values{"code": {currentTOTP(t, secret)}}); w.Code != http.StatusOK || strings.Count(w.Body.String(), "<li><code>") != 10 {
+		t.Errorf("Recovery codes not replaced, response code is %v", w.Code)
+	}
+}
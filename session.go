@@ -1,26 +1,198 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/bakhtik/webapp_template/data"
 )
 
-var sessionsCleaned time.Time
+// sessionCookieName is the cookie carrying the session uuid
+const sessionCookieName = "session"
 
-// Check if the user is logged in and has a session, if not err is not nil
-func session(w http.ResponseWriter, r *http.Request) (sess data.Session, err error) {
-	cookie, err := r.Cookie("session")
-	if err == nil {
-		sess = data.Session{Uuid: cookie.Value}
-		if err = sess.Check(); err != nil {
-			err = fmt.Errorf("Invalid session: %s", err)
-			return
+// sessionExpiry returns the configured session timeouts
+func sessionExpiry() data.SessionExpiry {
+	return data.SessionExpiry{
+		Idle:     time.Duration(config.SessionLength) * time.Second,
+		Lifetime: time.Duration(config.SessionLifetime) * time.Second,
+	}
+}
+
+// Check if the user is logged in and has a session, if not err is not nil.
+// Cookies which were altered are refused before the session is looked up.
+// Activity on the session is recorded at most once per touch interval, so the
+// idle timeout is effectively shortened by up to that interval.
+func (s *server) session(w http.ResponseWriter, r *http.Request) (sess data.Session, err error) {
+	if sess, err = s.validSession(r); err != nil {
+		return
+	}
+	if touchDue(sess) {
+		if err := s.sessions.TouchSession(r.Context(), &sess, time.Now()); err != nil {
+			logger.SetPrefix("WARNING ")
+			logger.Println(err, "Cannot record session activity")
 		}
-		cookie.MaxAge = config.SessionLength
-		http.SetCookie(w, cookie)
+	}
+	s.setSessionCookie(w, sess)
+	return
+}
+
+// validSession gets the session of the request's cookie if it is valid,
+// without recording activity
+func (s *server) validSession(r *http.Request) (sess data.Session, err error) {
+	cookie, err := r.Cookie(cookieName(sessionCookieName))
+	if err != nil {
+		return
+	}
+	if sess, err = s.tokens.parse(cookie.Value); err != nil {
+		err = fmt.Errorf("Invalid session: %s", err)
+		return
+	}
+	if err = s.sessions.CheckSession(r.Context(), &sess, sessionExpiry(), time.Now()); err != nil {
+		err = fmt.Errorf("Invalid session: %s", err)
 	}
 	return
 }
+
+// setSessionCookie sends the cookie of the session on login and refresh, it
+// lasts as long as the session
+func (s *server) setSessionCookie(w http.ResponseWriter, sess data.Session) {
+	maxAge := 0
+	if expiresAt := sess.ExpiresAt(sessionExpiry()); !expiresAt.IsZero() {
+		// MaxAge 0 would drop the attribute, keep at least a second
+		maxAge = int(time.Until(expiresAt)/time.Second) + 1
+	}
+	http.SetCookie(w, newCookie(sessionCookieName, s.tokens.issue(sess), maxAge))
+}
+
+// clearSessionCookie removes the session cookie on logout
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, newCookie(sessionCookieName, "", -1))
+}
+
+// rotateSession gives the session a new id and sends it, so that an id known
+// from before a change of the privileges or credentials of its user is useless
+func (s *server) rotateSession(w http.ResponseWriter, req *http.Request, sess *data.Session) (err error) {
+	if err = s.sessions.RotateSession(req.Context(), sess); err != nil {
+		return
+	}
+	s.setSessionCookie(w, *sess)
+	logger.SetPrefix("INFO ")
+	logger.Printf("Session %d of user %d rotated", sess.Id, sess.UserId)
+	return
+}
+
+// withSession returns a copy of the request carrying the rotated or restored
+// session, so that the handlers after it find the session and render forms
+// with the CSRF token bound to it
+func (s *server) withSession(req *http.Request, sess data.Session) *http.Request {
+	ctx := context.WithValue(req.Context(), csrfTokenKey, s.csrfToken(sess.Uuid))
+	r := req.Clone(ctx)
+	r.Header.Del("Cookie")
+	for _, cookie := range req.Cookies() {
+		if cookie.Name != cookieName(sessionCookieName) {
+			r.AddCookie(cookie)
+		}
+	}
+	r.AddCookie(&http.Cookie{Name: cookieName(sessionCookieName), Value: s.tokens.issue(sess)})
+	return r
+}
+
+// renewSession rotates the session of the request after its user changed
+// their second factor, a failure is logged and keeps the old id
+func (s *server) renewSession(w http.ResponseWriter, req *http.Request) *http.Request {
+	sess, err := s.session(w, req)
+	if err == nil {
+		err = s.rotateSession(w, req, &sess)
+	}
+	if err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot rotate session")
+		return req
+	}
+	return s.withSession(req, sess)
+}
+
+// credentialsChanged signs out all sessions and remembered logins of the user
+// after a change of the password, except the session of the request which
+// gets a new id if it belongs to the user
+func (s *server) credentialsChanged(w http.ResponseWriter, req *http.Request, user *data.User) {
+	except, exceptId := "", 0
+	if sess, err := s.session(w, req); err == nil && sess.UserId == user.Id {
+		if err = s.rotateSession(w, req, &sess); err != nil {
+			logger.SetPrefix("ERROR ")
+			logger.Println(err, "Cannot rotate session")
+		}
+		except, exceptId = sess.Uuid, sess.Id
+	}
+	if err := s.sessions.DeleteUserSessions(req.Context(), user, except); err != nil {
+		logger.SetPrefix("ERROR ")
+		logger.Println(err, "Cannot delete sessions")
+	}
+	s.forgetLogins(req, user, exceptId)
+}
+
+// touchDue reports if enough time has passed since the last recorded activity
+func touchDue(sess data.Session) bool {
+	return time.Since(sess.LastActivity) >= time.Duration(config.SessionTouchInterval)*time.Second
+}
+
+// cleanSessions removes expired sessions from the store
+func (s *server) cleanSessions(ctx context.Context) (int64, error) {
+	return s.sessions.CleanSessions(ctx, sessionExpiry(), time.Now())
+}
+
+// clientDevice describes the client of the request for a new session
+func clientDevice(r *http.Request) data.Device {
+	userAgent := r.UserAgent()
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
+	}
+	return data.Device{
+		UserAgent: userAgent,
+		IPAddress: clientIP(r),
+		Label:     deviceLabel(userAgent),
+	}
+}
+
+// browsers and platforms recognized in user agents, order matters
+// as for example Chrome and Edge also announce themselves as Safari
+var (
+	browsers = []struct{ token, name string }{
+		{"Edg", "Edge"}, {"OPR", "Opera"}, {"Firefox", "Firefox"},
+		{"Chrome", "Chrome"}, {"Safari", "Safari"},
+	}
+	platforms = []struct{ token, name string }{
+		{"iPhone", "iPhone"}, {"iPad", "iPad"}, {"Android", "Android"},
+		{"Windows", "Windows"}, {"Mac OS X", "macOS"}, {"Linux", "Linux"},
+	}
+)
+
+// deviceLabel makes a friendly name like "Firefox on Linux" from a user agent
+func deviceLabel(userAgent string) string {
+	browser, platform := "", ""
+	for _, b := range browsers {
+		if strings.Contains(userAgent, b.token) {
+			browser = b.name
+			break
+		}
+	}
+	for _, p := range platforms {
+		if strings.Contains(userAgent, p.token) {
+			platform = p.name
+			break
+		}
+	}
+	switch {
+	case browser != "" && platform != "":
+		return browser + " on " + platform
+	case browser != "":
+		return browser
+	case platform != "":
+		return platform
+	default:
+		return "Unknown device"
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bakhtik/webapp_template/data"
+)
+
+func TestDeviceLabel(t *testing.T) {
+	tests := map[string]string{
+		"Mozilla/5.0 (X11; Linux x86_64; rv:60.0) Gecko/20100101 Firefox/60.0":                                                       "Firefox on Linux",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/66.0.3359.139 Safari/537.36":        "Chrome on Windows",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/66.0 Safari/537.36 Edg/79.0.309.43": "Edge on Windows",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 11_3 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/11.0 Safari/604.1":  "Safari on iPhone",
+		"curl/7.58.0": "Unknown device",
+	}
+	for userAgent, want := range tests {
+		if label := deviceLabel(userAgent); label != want {
+			t.Errorf("Label of %q is %q, want %q", userAgent, label, want)
+		}
+	}
+}
+
+// cookieUuid returns the session uuid of a session cookie
+func cookieUuid(t *testing.T, cookie *http.Cookie) string {
+	sess, err := testServer.tokens.parse(cookie.Value)
+	if err != nil {
+		t.Fatal(err, "Invalid session cookie")
+	}
+	return sess.Uuid
+}
+
+// responseCookie returns the last cookie with the name set by the response
+func responseCookie(resp *http.Response, name string) (cookie *http.Cookie) {
+	for _, c := range resp.Cookies() {
+		if c.Name == name {
+			cookie = c
+		}
+	}
+	return
+}
+
+func TestSignInDeletesPreviousSession(t *testing.T) {
+	user := newTestUser(t, "peter@gmail.com", "user")
+	planted, cookie := newTestSession(t, user, data.Device{})
+
+	form := url.Values{"email": {user.Email}, "password": {"john_pass"}}
+	req := httptest.NewRequest("POST", "/authenticate", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	testServer.authenticate(w, req)
+
+	if err := store.CheckSession(ctx, &data.Session{Uuid: planted.Uuid}, data.SessionExpiry{}, time.Now()); err == nil {
+		t.Error("Session from before the login still valid")
+	}
+	if c := responseCookie(w.Result(), "session"); c == nil || cookieUuid(t, c) == planted.Uuid || c.Path != "/" {
+		t.Errorf("No new session cookie: %v", c)
+	}
+}
+
+func TestRoleChangeRotatesSession(t *testing.T) {
+	user := newTestUser(t, "peter@gmail.com", "user")
+	old, cookie := newTestSession(t, user, data.Device{})
+
+	form := url.Values{"origin_email": {user.Email}, "name": {user.Name}, "email": {user.Email}, "role": {"admin"}}
+	req := httptest.NewRequest("POST", "/admin/change_account", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	testServer.changeAccountAdmin(httptest.NewRecorder(), req)
+
+	// the live session gets the new role at once, under a new id
+	var seen *http.Request
+	handler := testServer.authenticated(testServer.authorized(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		seen = req
+	}), "admin"))
+	req = httptest.NewRequest("GET", "/admin", nil)
+	req.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || seen == nil {
+		t.Fatalf("Promoted user refused, response code is %v", w.Code)
+	}
+	rotated := responseCookie(w.Result(), "session")
+	if rotated == nil || cookieUuid(t, rotated) == old.Uuid {
+		t.Fatalf("Session not rotated: %v", rotated)
+	}
+	uuid := cookieUuid(t, rotated)
+	if c, err := seen.Cookie("session"); err != nil || cookieUuid(t, c) != uuid || csrfToken(seen) != testServer.csrfToken(uuid) {
+		t.Error("Handler did not get the rotated session")
+	}
+	if err := store.CheckSession(ctx, &data.Session{Uuid: old.Uuid}, data.SessionExpiry{}, time.Now()); err == nil {
+		t.Error("Old session id still valid")
+	}
+	s := data.Session{Uuid: uuid}
+	if err := store.CheckSession(ctx, &s, data.SessionExpiry{}, time.Now()); err != nil || s.RotationDue {
+		t.Errorf("Rotated session invalid or still due: %v", err)
+	}
+}
+
+func TestPasswordChangeRotatesSession(t *testing.T) {
+	user := newTestUser(t, "peter@gmail.com", "user")
+	current, cookie := newTestSession(t, user, data.Device{Label: "Firefox on Linux"})
+	other, _ := newTestSession(t, user, data.Device{Label: "Safari on iPhone"})
+
+	form := url.Values{"email": {user.Email}, "old_password": {"john_pass"}, "new_password": {"new_pass1"}, "confirm_password": {"new_pass1"}}
+	req := httptest.NewRequest("POST", "/change_account", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	testServer.changeAccount(w, req)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("Response code is %v", w.Code)
+	}
+
+	for _, uuid := range []string{current.Uuid, other.Uuid} {
+		if err := store.CheckSession(ctx, &data.Session{Uuid: uuid}, data.SessionExpiry{}, time.Now()); err == nil {
+			t.Errorf("Session %s still valid after password change", uuid)
+		}
+	}
+	rotated := responseCookie(w.Result(), "session")
+	if rotated == nil {
+		t.Fatal("No rotated session cookie")
+	}
+	if err := store.CheckSession(ctx, &data.Session{Uuid: cookieUuid(t, rotated)}, data.SessionExpiry{}, time.Now()); err != nil {
+		t.Error(err, "Current session signed out")
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/bakhtik/webapp_template/data"
+)
+
+// sessionTokens turn sessions into the values of their cookies and back, so
+// that altered or guessed cookies are refused before the store is asked
+type sessionTokens interface {
+	issue(sess data.Session) string
+	// parse returns the session of a cookie value, errInvalidToken if the
+	// value was altered or made with a key no longer in the keyring
+	parse(token string) (data.Session, error)
+}
+
+// keyring holds the session keys, the first one makes new tokens and all of
+// them are accepted, so that a key can be replaced without signing everyone out
+type keyring [][]byte
+
+// newKeyring derives the session keys from the configured secrets, which may
+// then serve other purposes as well
+func newKeyring(secrets ...[]byte) keyring {
+	keys := make(keyring, len(secrets))
+	for i, secret := range secrets {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte("session-token"))
+		keys[i] = mac.Sum(nil)
+	}
+	return keys
+}
+
+// newSessionTokens makes the tokens of the configured mode with the session
+// keys, or with fallback if none are configured
+func newSessionTokens(fallback []byte) (sessionTokens, error) {
+	secrets := [][]byte{fallback}
+	if len(config.SessionToken.Keys) > 0 {
+		secrets = nil
+		for _, key := range config.SessionToken.Keys {
+			secrets = append(secrets, []byte(key))
+		}
+	}
+	if config.SessionToken.Stateless {
+		return newEncryptedTokens(newKeyring(secrets...))
+	}
+	return signedTokens{newKeyring(secrets...)}, nil
+}
+
+// signedTokens are session uuids with their signature, the sessions are
+// loaded from the store
+type signedTokens struct {
+	keys keyring
+}
+
+func (t signedTokens) issue(sess data.Session) string {
+	return sess.Uuid + "." + sessionMAC(t.keys[0], sess.Uuid)
+}
+
+func (t signedTokens) parse(token string) (sess data.Session, err error) {
+	dot := strings.LastIndexByte(token, '.')
+	if dot < 0 {
+		return sess, errInvalidToken
+	}
+	for _, key := range t.keys {
+		if hmac.Equal([]byte(token[dot+1:]), []byte(sessionMAC(key, token[:dot]))) {
+			return data.Session{Uuid: token[:dot]}, nil
+		}
+	}
+	return sess, errInvalidToken
+}
+
+// sessionMAC signs the uuid with the key
+func sessionMAC(key []byte, uuid string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(uuid))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// sessionClaims are the content of an encrypted token, times are unix seconds
+type sessionClaims struct {
+	Id           int    `json:"i"`
+	Uuid         string `json:"u"`
+	UserId       int    `json:"s"`
+	LastActivity int64  `json:"a"`
+	CreatedAt    int64  `json:"c"`
+}
+
+// encryptedTokens carry the sessions encrypted with AES-256-GCM, so that
+// requests are checked without loading their sessions from the store
+type encryptedTokens struct {
+	aeads []cipher.AEAD
+}
+
+func newEncryptedTokens(keys keyring) (t encryptedTokens, err error) {
+	for _, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return t, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return t, err
+		}
+		t.aeads = append(t.aeads, aead)
+	}
+	return
+}
+
+func (t encryptedTokens) issue(sess data.Session) string {
+	bs, _ := json.Marshal(sessionClaims{sess.Id, sess.Uuid, sess.UserId, sess.LastActivity.Unix(), sess.CreatedAt.Unix()})
+	aead := t.aeads[0]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, bs, []byte(sessionCookieName)))
+}
+
+func (t encryptedTokens) parse(token string) (sess data.Session, err error) {
+	bs, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return sess, errInvalidToken
+	}
+	for _, aead := range t.aeads {
+		n := aead.NonceSize()
+		if len(bs) < n {
+			break
+		}
+		plain, err := aead.Open(nil, bs[:n], bs[n:], []byte(sessionCookieName))
+		if err != nil {
+			continue
+		}
+		var claims sessionClaims
+		if err = json.Unmarshal(plain, &claims); err != nil {
+			break
+		}
+		return data.Session{
+			Id:           claims.Id,
+			Uuid:         claims.Uuid,
+			UserId:       claims.UserId,
+			LastActivity: time.Unix(claims.LastActivity, 0),
+			CreatedAt:    time.Unix(claims.CreatedAt, 0),
+		}, nil
+	}
+	return sess, errInvalidToken
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bakhtik/webapp_template/data"
+)
+
+func TestSessionTokens(t *testing.T) {
+	oldKeys, newKeys := newKeyring([]byte("old")), newKeyring([]byte("new"), []byte("old"))
+	encrypted := func(keys keyring) sessionTokens {
+		tokens, err := newEncryptedTokens(keys)
+		if err != nil {
+			t.Fatal(err, "Cannot create encrypted tokens")
+		}
+		return tokens
+	}
+	modes := map[string]func(keyring) sessionTokens{
+		"signed":    func(keys keyring) sessionTokens { return signedTokens{keys} },
+		"encrypted": encrypted,
+	}
+	sess := data.Session{Id: 7, Uuid: "0b0e7a6c-4a8e-4b5e-9c39-2b7f0e8d1a11", UserId: 3,
+		LastActivity: time.Unix(1700000100, 0), CreatedAt: time.Unix(1700000000, 0)}
+
+	for name, mode := range modes {
+		tokens := mode(oldKeys)
+		token := tokens.issue(sess)
+		parsed, err := tokens.parse(token)
+		if err != nil || parsed.Uuid != sess.Uuid {
+			t.Errorf("%s: cannot parse token: %v", name, err)
+		}
+		if name == "encrypted" && parsed != sess {
+			t.Errorf("%s: parsed %+v, want %+v", name, parsed, sess)
+		}
+
+		// a new key in front still accepts the tokens of the old one
+		if _, err = mode(newKeys).parse(token); err != nil {
+			t.Errorf("%s: token of the old key refused: %v", name, err)
+		}
+		if _, err = mode(newKeyring([]byte("new"))).parse(token); err == nil {
+			t.Errorf("%s: token of a removed key accepted", name)
+		}
+
+		for _, forged := range []string{"", sess.Uuid, token[:len(token)-2] + "xx", "x" + token} {
+			if _, err = tokens.parse(forged); err == nil {
+				t.Errorf("%s: forged token %q accepted", name, forged)
+			}
+		}
+	}
+}
+
+func TestSessionRefusesUnsignedCookie(t *testing.T) {
+	user := newTestUser(t, "peter@gmail.com", "user")
+	sess, _ := newTestSession(t, user, data.Device{})
+
+	req := httptest.NewRequest("GET", "/profile", nil)
+	req.AddCookie(&http.Cookie{Name: "session", Value: sess.Uuid})
+	if _, err := testServer.session(httptest.NewRecorder(), req); err == nil {
+		t.Error("Session found by its bare uuid")
+	}
+}
+
+func TestStatelessSessions(t *testing.T) {
+	tokens, err := newEncryptedTokens(newKeyring([]byte("test-stateless-key")))
+	if err != nil {
+		t.Fatal(err, "Cannot create encrypted tokens")
+	}
+	s := *testServer
+	s.tokens, s.sessions = tokens, statelessSessions{store, store}
+	user := newTestUser(t, "peter@gmail.com", "user")
+
+	login := func() *http.Cookie {
+		cookie := responseCookie(postLogin(&s, user.Email, "john_pass"), "session")
+		if cookie == nil || strings.Contains(cookie.Value, ".") {
+			t.Fatalf("No encrypted session cookie: %v", cookie)
+		}
+		return cookie
+	}
+	check := func(cookie *http.Cookie) error {
+		req := httptest.NewRequest("GET", "/profile", nil)
+		req.AddCookie(cookie)
+		_, err := s.session(httptest.NewRecorder(), req)
+		return err
+	}
+
+	cookie, other := login(), login()
+	sess, _ := s.tokens.parse(cookie.Value)
+	// the session is checked without loading it
+	if err = store.DeleteSessionByUUID(ctx, &sess); err != nil {
+		t.Fatal(err, "Cannot delete session from the store")
+	}
+	if err = check(cookie); err != nil {
+		t.Errorf("Stateless session refused: %v", err)
+	}
+
+	// signing out everywhere revokes the cookies
+	if err = s.sessions.DeleteUserSessions(ctx, &user, ""); err != nil {
+		t.Fatal(err, "Cannot delete sessions")
+	}
+	if err = check(other); err == nil {
+		t.Error("Revoked session accepted")
+	}
+
+	req := httptest.NewRequest("POST", "/logout", nil)
+	cookie = login()
+	req.AddCookie(cookie)
+	s.logout(httptest.NewRecorder(), req)
+	if err = check(cookie); err == nil {
+		t.Error("Session accepted after logout")
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// errInvalidToken is returned for signed tokens which were altered, were
+// signed for another purpose or have expired
+var errInvalidToken = errors.New("invalid or expired token")
+
+// signedPayload is the content of a signed token
+type signedPayload struct {
+	Fields    []string `json:"f"`
+	ExpiresAt int64    `json:"e"`
+}
+
+// signToken binds fields to the server key until expiresAt. Tokens carry their
+// content, they don't need to be stored but can't be revoked before they expire.
+func (s *server) signToken(purpose string, expiresAt time.Time, fields ...string) string {
+	bs, _ := json.Marshal(signedPayload{fields, expiresAt.Unix()})
+	payload := base64.RawURLEncoding.EncodeToString(bs)
+	return payload + "." + s.tokenMAC(purpose, payload)
+}
+
+// verifyToken returns the fields of a token signed for purpose which has not expired at now
+func (s *server) verifyToken(purpose, token string, now time.Time) (fields []string, err error) {
+	dot := strings.IndexByte(token, '.')
+	if dot < 0 || !hmac.Equal([]byte(token[dot+1:]), []byte(s.tokenMAC(purpose, token[:dot]))) {
+		return nil, errInvalidToken
+	}
+	bs, err := base64.RawURLEncoding.DecodeString(token[:dot])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	var payload signedPayload
+	if err = json.Unmarshal(bs, &payload); err != nil || now.Unix() >= payload.ExpiresAt {
+		return nil, errInvalidToken
+	}
+	return payload.Fields, nil
+}
+
+// tokenMAC signs the payload, the purpose keeps a token from being used for something else
+func (s *server) tokenMAC(purpose, payload string) string {
+	mac := hmac.New(sha256.New, s.csrfKey)
+	mac.Write([]byte(purpose + "\x00" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignedToken(t *testing.T) {
+	s := &server{csrfKey: []byte("key")}
+	now := time.Now()
+	token := s.signToken("verify-email", now.Add(time.Hour), "1", "peter@gmail.com")
+	other := s.signToken("verify-email", now.Add(time.Hour), "2", "peter@gmail.com")
+
+	fields, err := s.verifyToken("verify-email", token, now)
+	if err != nil || len(fields) != 2 || fields[0] != "1" || fields[1] != "peter@gmail.com" {
+		t.Errorf("Token verified as %v, %v", fields, err)
+	}
+	tests := []struct {
+		name    string
+		server  *server
+		purpose string
+		token   string
+		now     time.Time
+	}{
+		{"expired", s, "verify-email", token, now.Add(time.Hour)},
+		{"other purpose", s, "reset-password", token, now},
+		{"other key", &server{csrfKey: []byte("other")}, "verify-email", token, now},
+		{"altered", s, "verify-email", other[:strings.Index(other, ".")] + token[strings.Index(token, "."):], now},
+		{"malformed", s, "verify-email", "token", now},
+	}
+	for _, test := range tests {
+		if _, err := test.server.verifyToken(test.purpose, test.token, test.now); err != errInvalidToken {
+			t.Errorf("%s: token verified", test.name)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/bakhtik/webapp_template/data"
+)
+
+// errSessionRevoked is returned for stateless sessions which were signed out
+var errSessionRevoked = errors.New("session revoked")
+
+// statelessSessions check the sessions carried by encrypted cookies against
+// the revocation list instead of loading them. The store still records the
+// sessions so that they can be listed and revoked, every deletion adds the
+// uuids to the list until their cookies would have expired.
+//
+// The ids of stateless sessions are only rotated by requests of their own
+// user, RotationDue of the store is not seen. Changed privileges apply at once
+// nonetheless as the user is loaded on every request.
+type statelessSessions struct {
+	data.SessionStore
+	revocations data.RevocationStore
+}
+
+// CheckSession checks the expiry of the claims and the revocation list
+func (st statelessSessions) CheckSession(ctx context.Context, s *data.Session, expiry data.SessionExpiry, now time.Time) error {
+	if s.Expired(expiry, now) {
+		return data.ErrSessionExpired
+	}
+	revoked, err := st.revocations.SessionRevoked(ctx, s.Uuid)
+	if err != nil {
+		return err
+	}
+	if revoked {
+		return errSessionRevoked
+	}
+	return nil
+}
+
+// TouchSession records activity on the session, the new time is carried by
+// the cookie sent with the response
+func (st statelessSessions) TouchSession(ctx context.Context, s *data.Session, now time.Time) (err error) {
+	err = st.SessionStore.TouchSession(ctx, s, now)
+	s.LastActivity = now
+	return
+}
+
+// RotateSession replaces the uuid of the session and revokes the old one
+func (st statelessSessions) RotateSession(ctx context.Context, s *data.Session) error {
+	old := s.Uuid
+	if err := st.SessionStore.RotateSession(ctx, s); err != nil {
+		return err
+	}
+	return st.revoke(ctx, []string{old})
+}
+
+// DeleteSessionByUUID revokes and deletes the session
+func (st statelessSessions) DeleteSessionByUUID(ctx context.Context, s *data.Session) error {
+	if err := st.revoke(ctx, []string{s.Uuid}); err != nil {
+		return err
+	}
+	return st.SessionStore.DeleteSessionByUUID(ctx, s)
+}
+
+// DeleteUserSession revokes and deletes a session of the user by id
+func (st statelessSessions) DeleteUserSession(ctx context.Context, u *data.User, id int) error {
+	if err := st.revokeUserSessions(ctx, u.Id, func(s data.Session) bool { return s.Id == id }); err != nil {
+		return err
+	}
+	return st.SessionStore.DeleteUserSession(ctx, u, id)
+}
+
+// DeleteUserSessions revokes and deletes all sessions of the user except the one with exceptUuid
+func (st statelessSessions) DeleteUserSessions(ctx context.Context, u *data.User, exceptUuid string) error {
+	if err := st.revokeUserSessions(ctx, u.Id, func(s data.Session) bool { return s.Uuid != exceptUuid }); err != nil {
+		return err
+	}
+	return st.SessionStore.DeleteUserSessions(ctx, u, exceptUuid)
+}
+
+// CleanSessions removes the sessions and revocations which expired at now
+func (st statelessSessions) CleanSessions(ctx context.Context, expiry data.SessionExpiry, now time.Time) (int64, error) {
+	cleaned, err := st.SessionStore.CleanSessions(ctx, expiry, now)
+	if err != nil {
+		return cleaned, err
+	}
+	if _, err = st.revocations.CleanRevocations(ctx, now); err != nil {
+		return cleaned, err
+	}
+	return cleaned, nil
+}
+
+// TryLock takes the lock of the store if it has locks, so that the janitor
+// runs on a single instance with stateless sessions too
+func (st statelessSessions) TryLock(ctx context.Context, name string) (unlock func(), ok bool, err error) {
+	if locker, isLocker := st.SessionStore.(data.Locker); isLocker {
+		return locker.TryLock(ctx, name)
+	}
+	return func() {}, true, nil
+}
+
+// revokeUserSessions revokes the sessions of the user which match, of all
+// users if userId is 0
+func (st statelessSessions) revokeUserSessions(ctx context.Context, userId int, match func(data.Session) bool) error {
+	sessions, err := st.Sessions(ctx, userId)
+	if err != nil {
+		return err
+	}
+	var uuids []string
+	for _, s := range sessions {
+		if match(s.Session) {
+			uuids = append(uuids, s.Uuid)
+		}
+	}
+	return st.revoke(ctx, uuids)
+}
+
+// revoke adds the uuids to the revocation list until no cookie of them can
+// be valid anymore
+func (st statelessSessions) revoke(ctx context.Context, uuids []string) error {
+	if len(uuids) == 0 {
+		return nil
+	}
+	var expiresAt time.Time
+	// an expiring cookie is valid until one of the timeouts since now at most
+	expiry := sessionExpiry()
+	for _, d := range []time.Duration{expiry.Idle, expiry.Lifetime} {
+		if at := time.Now().Add(d); d > 0 && (expiresAt.IsZero() || at.Before(expiresAt)) {
+			expiresAt = at
+		}
+	}
+	return st.revocations.RevokeSessions(ctx, uuids, expiresAt)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP parameters of RFC 6238, the defaults every authenticator app supports
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// totpSkew is how many steps a code may be off to allow for clock drift
+	totpSkew = 1
+)
+
+// totpEncoding encodes the secrets the way authenticator apps expect them
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newTOTPSecret generates a random 160 bit secret as recommended by RFC 4226
+func newTOTPSecret() (secret string, err error) {
+	bs := make([]byte, 20)
+	if _, err = rand.Read(bs); err != nil {
+		return
+	}
+	return totpEncoding.EncodeToString(bs), nil
+}
+
+// totpStep returns the time step of t
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// hotp computes the HOTP code of RFC 4226 for the counter
+func hotp(key []byte, counter int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	code := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, code%uint32(math.Pow10(totpDigits)))
+}
+
+// totpCheck looks for the code among the time steps around now and returns
+// the matching step, which must be recorded so that the code can't be reused
+func totpCheck(secret, code string, now time.Time) (step int64, ok bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	code = strings.Replace(code, " ", "", -1)
+	if err != nil || len(code) != totpDigits {
+		return
+	}
+	current := totpStep(now)
+	for step = current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(hotp(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI is the otpauth URI which adds the secret to an authenticator app
+func totpURI(issuer, account, secret string) string {
+	params := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
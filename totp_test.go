@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHOTP(t *testing.T) {
+	// test vectors of RFC 4226 appendix D
+	key := []byte("12345678901234567890")
+	want := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	for counter, code := range want {
+		if got := hotp(key, int64(counter)); got != code {
+			t.Errorf("hotp(%d) = %s, want %s", counter, got, code)
+		}
+	}
+}
+
+func TestTOTPCheck(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	// RFC 6238 appendix B gives 94287082 at 59 seconds, the last 6 digits for SHA1
+	now := time.Unix(59, 0)
+	tests := []struct {
+		name string
+		code string
+		now  time.Time
+		ok   bool
+	}{
+		{"current", "287082", now, true},
+		{"spaces", "287 082", now, true},
+		{"previous step", "287082", now.Add(totpPeriod * time.Second), true},
+		{"too old", "287082", now.Add(2 * totpPeriod * time.Second), false},
+		{"wrong", "287083", now, false},
+		{"short", "28708", now, false},
+	}
+	for _, test := range tests {
+		if step, ok := totpCheck(secret, test.code, test.now); ok != test.ok || ok && step != 1 {
+			t.Errorf("%s: step %d, ok %v", test.name, step, ok)
+		}
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri := totpURI("Webapp Template", "peter@gmail.com", "JBSWY3DPEHPK3PXP")
+	for _, want := range []string{"otpauth://totp/Webapp%20Template:peter@gmail.com?", "secret=JBSWY3DPEHPK3PXP", "issuer=Webapp+Template"} {
+		if !strings.Contains(uri, want) {
+			t.Errorf("%s does not contain %s", uri, want)
+		}
+	}
+}
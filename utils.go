@@ -10,16 +10,216 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
-	"net/url"
 	"os"
+	"sort"
+	"strings"
 	"time"
 )
 
+// Configuration of the application, durations are in seconds
 type Configuration struct {
 	Address       string
 	Static        string
-	SessionLength int
-	LogFile       string
+	SessionLength int // idle timeout of a session
+	// SessionLifetime limits a session since login regardless of activity
+	SessionLifetime int
+	// SessionTouchInterval is how often activity is written to the store
+	SessionTouchInterval int
+	// SessionCleanInterval is how often expired sessions are removed, 0 disables cleaning
+	SessionCleanInterval int
+	// RememberLifetime is how long "remember me" signs a user in again after
+	// their session expired, 0 hides the option
+	RememberLifetime int
+	LogFile          string
+	// CSRFKey signs the CSRF tokens and the links sent by email, it must be
+	// the same on all instances
+	CSRFKey     string
+	Store       string
+	AutoMigrate bool
+	Database    DatabaseConfiguration
+	Login       LoginConfiguration
+	// SignupMode is "open", "invite" for invited users only or "approval"
+	// for accounts an admin has to approve before they can sign in
+	SignupMode string
+	// InviteLifetime is how long an invite can be used
+	InviteLifetime int
+	// BaseURL is the public address of the site used for links in emails
+	BaseURL string
+	// PasswordResetLifetime is how long a password reset link can be used
+	PasswordResetLifetime int
+	// EmailVerificationLifetime is how long an email verification link can be used
+	EmailVerificationLifetime int
+	// RequireEmailVerification refuses logins until the email address is verified
+	RequireEmailVerification bool
+	Mail                     MailConfiguration
+	TwoFactor                TwoFactorConfiguration
+	Password                 PasswordConfiguration
+	Cookie                   CookieConfiguration
+	SessionToken             SessionTokenConfiguration
+	// OIDCProviders are the OpenID Connect identity providers users can sign in with
+	OIDCProviders []OIDCProviderConfiguration
+}
+
+// OIDCProviderConfiguration describes an OpenID Connect identity provider,
+// it redirects back to BaseURL + "/oidc/callback"
+type OIDCProviderConfiguration struct {
+	// Name identifies the provider in the identities linked to users, it
+	// must not change once users signed in with it
+	Name string
+	// Label is shown on the login button
+	Label string
+	// Issuer is the URL the provider is discovered from
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// Scopes are requested besides openid, "email" and "profile" if empty
+	Scopes []string
+	// DefaultRole is the role of the users created on their first login,
+	// empty lets only users with an account sign in
+	DefaultRole string
+}
+
+// SessionTokenConfiguration protects the session cookies
+type SessionTokenConfiguration struct {
+	// Keys sign the session cookies, or encrypt them in stateless mode. The
+	// first key makes new cookies and all are accepted, so a key is replaced
+	// by adding the new one in front and removing the old one once the
+	// cookies made with it expired. Without keys the CSRFKey is used.
+	Keys []string
+	// Stateless carries the sessions in their cookies, requests are checked
+	// against the list of revoked sessions instead of loading the sessions
+	Stateless bool
+}
+
+// CookieConfiguration holds the attributes of the session and the other
+// cookies of the application, which are always HttpOnly with Path=/
+type CookieConfiguration struct {
+	// Secure sends the cookies over HTTPS only, it is required by SameSite
+	// "none" and HostPrefix
+	Secure bool
+	// SameSite is "lax", "strict" or "none"
+	SameSite string
+	// Domain shares the cookies with the subdomains of the domain, empty
+	// keeps them to the host
+	Domain string
+	// HostPrefix names the cookies with the __Host- prefix
+	HostPrefix bool
+}
+
+// PasswordConfiguration selects how new passwords are hashed, the hashes made
+// otherwise are upgraded when their users sign in, and the policy for new passwords
+type PasswordConfiguration struct {
+	// Algorithm is "bcrypt" or "argon2id"
+	Algorithm string
+	// BcryptCost is the base-2 logarithm of the bcrypt iterations
+	BcryptCost int
+	// Argon2Memory is in KiB
+	Argon2Memory      int
+	Argon2Iterations  int
+	Argon2Parallelism int
+	// MinLength and the Require rules are what new passwords must satisfy
+	MinLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	// BreachedList is a file of SHA-1 hashes of breached passwords sorted in
+	// ascending order like the Pwned Passwords downloads, empty disables the check
+	BreachedList string
+}
+
+// TwoFactorConfiguration describes TOTP two-factor authentication, durations are in seconds
+type TwoFactorConfiguration struct {
+	// Issuer names the site in authenticator apps
+	Issuer string
+	// LoginLifetime is how long the code can be entered after the password
+	LoginLifetime int
+	// RequireForAdmins keeps admins out of the admin pages until they enable it
+	RequireForAdmins bool
+}
+
+// MailConfiguration describes how emails are sent
+type MailConfiguration struct {
+	// Transport is "smtp" or "maildrop" which writes the emails to files in Dir
+	Transport string
+	From      string
+	// Templates is the directory of the email templates
+	Templates string
+	Dir       string
+	SMTP      SMTPConfiguration
+}
+
+// SMTPConfiguration describes the SMTP server, durations are in seconds
+type SMTPConfiguration struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	// Timeout limits the delivery of an email
+	Timeout int
+}
+
+// LoginConfiguration limits password guessing. Rates are attempts per minute
+// with bursts of up to the burst size, a zero rate disables the limit.
+type LoginConfiguration struct {
+	IPRate     float64
+	IPBurst    int
+	EmailRate  float64
+	EmailBurst int
+	// LockoutThreshold is the number of consecutive failed logins locking the account, 0 disables lockout
+	LockoutThreshold int
+	// LockoutDuration is how long a locked account refuses logins
+	LockoutDuration int
+}
+
+// DatabaseConfiguration describes the connection to the database store,
+// durations are in seconds
+type DatabaseConfiguration struct {
+	Host            string
+	Port            int
+	Name            string
+	User            string
+	Password        string
+	SSLMode         string
+	File            string // SQLite database file
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime int
+	ConnectTimeout  int
+	ConnectAttempts int
+	RetryInterval   int
+	QueryTimeout    int
+}
+
+// PostgresDSN builds the lib/pq connection string from the configured parts
+func (db DatabaseConfiguration) PostgresDSN() string {
+	var params []string
+	add := func(key, value string) {
+		if value != "" {
+			params = append(params, key+"="+quoteDSNValue(value))
+		}
+	}
+	add("host", db.Host)
+	if db.Port != 0 {
+		add("port", fmt.Sprint(db.Port))
+	}
+	add("dbname", db.Name)
+	add("user", db.User)
+	add("password", db.Password)
+	add("sslmode", db.SSLMode)
+	if db.ConnectTimeout != 0 {
+		add("connect_timeout", fmt.Sprint(db.ConnectTimeout))
+	}
+	return strings.Join(params, " ")
+}
+
+// quoteDSNValue quotes a connection string value if it has spaces or quotes
+func quoteDSNValue(value string) string {
+	if !strings.ContainsAny(value, ` '\`) {
+		return value
+	}
+	value = strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value)
+	return "'" + value + "'"
 }
 
 var config Configuration
@@ -49,13 +249,21 @@ func loadConfig() {
 	}
 }
 
-func generateHTML(w http.ResponseWriter, data interface{}, filenames ...string) {
+// generateHTML renders the layout with data, templates can render the CSRF
+// token of the request as a hidden form field with {{ csrfField }}
+func generateHTML(w http.ResponseWriter, req *http.Request, data interface{}, filenames ...string) {
 	var files []string
 	for _, file := range filenames {
 		files = append(files, fmt.Sprintf("templates/%s.html", file))
 	}
 
-	templates := template.Must(template.ParseFiles(files...))
+	funcs := template.FuncMap{
+		"csrfField": func() template.HTML {
+			return template.HTML(fmt.Sprintf(`<input type="hidden" name="%s" value="%s">`,
+				csrfFieldName, template.HTMLEscapeString(csrfToken(req))))
+		},
+	}
+	templates := template.Must(template.New("").Funcs(funcs).ParseFiles(files...))
 	templates.ExecuteTemplate(w, "layout", data)
 }
 
@@ -72,6 +280,15 @@ func strSliceContains(slice []string, value string) (ok bool) {
 	return
 }
 
+// clientIP returns the address of the client without the port
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
 // handler for Apache-style logs
 func loggingHandler(writer io.Writer, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
@@ -95,12 +312,9 @@ func loggingHandler(writer io.Writer, next http.Handler) http.Handler {
 		c.Body.WriteTo(w)
 
 		// write log information
-		host, _, err := net.SplitHostPort(req.RemoteAddr)
-		if err != nil {
-			host = req.RemoteAddr
-		}
+		host := clientIP(req)
 		username := "-"
-		if url.User != nil {
+		if req.URL.User != nil {
 			if name := req.URL.User.Username(); name != "" {
 				username = name
 			}
@@ -128,11 +342,47 @@ func logged(h http.Handler) http.Handler {
 	}
 }
 
+// methods routes a request to the handler registered for its method,
+// HEAD is served by the GET handler
+type methods map[string]http.Handler
+
+func (ms methods) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h, ok := ms[req.Method]
+	if !ok && req.Method == http.MethodHead {
+		h, ok = ms[http.MethodGet]
+	}
+	if !ok {
+		w.Header().Set("Allow", ms.allow())
+		if req.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	h.ServeHTTP(w, req)
+}
+
+// allow lists the methods accepted by the route for the Allow header
+func (ms methods) allow() string {
+	allowed := []string{http.MethodOptions}
+	for method := range ms {
+		allowed = append(allowed, method)
+	}
+	if _, ok := ms[http.MethodGet]; ok {
+		if _, ok := ms[http.MethodHead]; !ok {
+			allowed = append(allowed, http.MethodHead)
+		}
+	}
+	sort.Strings(allowed)
+	return strings.Join(allowed, ", ")
+}
+
 // for authorized access only to handlers
-func authenticated(next http.Handler) http.Handler {
+func (s *server) authenticated(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		// check if authenticated
-		_, err := session(w, req)
+		sess, err := s.session(w, req)
 		if err != nil {
 			//http.Error(w, "not logged in", http.StatusUnauthorized)
 			logger.SetPrefix("WARNING ")
@@ -140,22 +390,38 @@ func authenticated(next http.Handler) http.Handler {
 			http.Redirect(w, req, "/", http.StatusSeeOther)
 			return // don't call original handler
 		}
+		// the privileges of the user changed since the id was issued
+		if sess.RotationDue {
+			if err = s.rotateSession(w, req, &sess); err != nil {
+				logger.SetPrefix("ERROR ")
+				logger.Println(err, "Cannot rotate session")
+				http.Redirect(w, req, "/", http.StatusSeeOther)
+				return
+			}
+			req = s.withSession(req, sess)
+		}
 		next.ServeHTTP(w, req)
 	})
 }
 
 // permission check
-func authorized(next http.Handler, roles ...string) http.Handler {
+func (s *server) authorized(next http.Handler, roles ...string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		sess, _ := session(w, req)
+		sess, _ := s.session(w, req)
 		if roles != nil {
-			user, err := sess.User()
+			user, err := s.sessions.SessionUser(req.Context(), &sess)
 			if !strSliceContains(roles, user.Role) {
 				logger.SetPrefix("WARNING ")
 				logger.Printf("%v: User %s has not permission for requested page", err, user.Name)
 				http.Error(w, "You must have admin rights to enter the page", http.StatusForbidden)
 				return
 			}
+			if twoFactorRequired(user) && !user.TwoFactorEnabled() {
+				logger.SetPrefix("WARNING ")
+				logger.Printf("User %s has not enabled two-factor authentication", user.Name)
+				http.Error(w, "You must enable two-factor authentication on your profile to enter the page", http.StatusForbidden)
+				return
+			}
 		}
 		next.ServeHTTP(w, req)
 	})
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPostgresDSN(t *testing.T) {
+	db := DatabaseConfiguration{
+		Host:           "db.local",
+		Port:           5433,
+		Name:           "webapp_template",
+		User:           "webapp",
+		Password:       `it's a \secret`,
+		SSLMode:        "verify-full",
+		ConnectTimeout: 3,
+	}
+	want := `host=db.local port=5433 dbname=webapp_template user=webapp password='it\'s a \\secret' sslmode=verify-full connect_timeout=3`
+	if dsn := db.PostgresDSN(); dsn != want {
+		t.Errorf("DSN is %q, want %q", dsn, want)
+	}
+}
+
+func TestMethods(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	route := methods{http.MethodGet: ok, http.MethodPost: ok}
+
+	tests := []struct {
+		method string
+		code   int
+	}{
+		{"GET", http.StatusNoContent},
+		{"HEAD", http.StatusNoContent},
+		{"POST", http.StatusNoContent},
+		{"OPTIONS", http.StatusNoContent},
+		{"PUT", http.StatusMethodNotAllowed},
+		{"DELETE", http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		route.ServeHTTP(w, httptest.NewRequest(test.method, "/", nil))
+		if w.Code != test.code {
+			t.Errorf("%s: response code is %v, want %v", test.method, w.Code, test.code)
+		}
+		if test.code == http.StatusMethodNotAllowed {
+			if allow := w.Header().Get("Allow"); allow != "GET, HEAD, OPTIONS, POST" {
+				t.Errorf("%s: Allow header is %q", test.method, allow)
+			}
+		}
+	}
+}